@@ -2,93 +2,289 @@ package auth
 
 import (
 	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gorilla/sessions"
 	"github.com/rs/zerolog/log"
-	"gopkg.in/boj/redistore.v1"
+	"io"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 type Users struct {
-	Lookup      map[string]string
+	lock        sync.RWMutex
+	Lookup      map[string]string   // Protected by lock, it is replaced as a whole when the users file is reloaded
+	roles       map[string][]string // Protected by lock, the roles of the users which have roles in the users file
+	totp        map[string]string   // Protected by lock, the TOTP secrets of the users with two-factor authentication
+	totpUsed    map[string]int64    // Protected by lock, the period of the last accepted TOTP code per user
+	path        string
 	store       sessions.Store
+	limiter     *LoginLimiter // Optional, limits the failed logins
+	registry    registry      // The active login sessions
 	sessionTime int
+
+	DefaultRoles    []string           // The roles of users without roles in the users file and of OpenID Connect users
+	Tokens          *Tokens            // Optional, the API tokens for non-browser clients
+	SessionsRevoked func(ids []string) // Optional, called with the ids of revoked login sessions
+	TokensRevoked   func(ids []string) // Optional, called with the ids of revoked API tokens
+
+	// The certificate field, config.ClientUsernameCN or config.ClientUsernameSAN, which names the user of a
+	// client certificate. Empty if client certificates are disabled.
+	ClientCertUsername string
+	// The certificate names which are mapped to the users file account of the same name. Other certificate
+	// users get the cert: prefix, and names of users file accounts are rejected.
+	ClientCertUsers []string
 }
 
+// The providers which authenticate the user of a session.
+const (
+	ProviderUsersFile = "file"
+	ProviderOIDC      = "oidc"
+)
+
+// The prefixes which namespace the users of the OpenID Connect issuer and of client certificates. The fields
+// of the users file are separated by ':', so prefixed users never collide with its accounts.
+const (
+	oidcPrefix        = ProviderOIDC + ":"
+	certificatePrefix = "cert:"
+)
+
 type UserInfo struct {
-	name string
-	pass string
+	name  string
+	pass  string
+	roles []string
+	totp  string
 }
 
 type Response struct {
-	Message string `json:"message"`
+	Message      string `json:"message"`
+	TOTPRequired bool   `json:"totpRequired,omitempty"` // The password was correct, but the TOTP code is missing
 }
 
-// LoadUsersFile loads the user information from the file specified by the path.
-func LoadUsersFile(path, redisAddress, redisPass string, secret []byte, sessionTimeout int) (*Users, error) {
-	store, err := redistore.NewRediStore(10, "tcp", redisAddress, redisPass, secret)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to connect to redis.")
-		return nil, err
-	}
+// LoadUsersFile loads the user information from the file specified by the path. The login sessions
+// are kept in the given store, and failed logins are limited by the limiter if it is not nil. An empty
+// path loads no users, e.g. if the users sign in with OpenID Connect only.
+func LoadUsersFile(path string, store sessions.Store, limiter *LoginLimiter, sessionTimeout int) (*Users, error) {
 	users := &Users{
 		Lookup:      map[string]string{},
+		path:        path,
 		store:       store,
+		limiter:     limiter,
+		registry:    newRegistry(store, time.Duration(sessionTimeout)*time.Second),
 		sessionTime: sessionTimeout,
 	}
+	if _, err := users.Reload(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Reload reads the users file again and swaps in the new users. It returns the names of the users
+// which were removed, their sessions are rejected from now on. If the file cannot be read, the
+// current users are kept.
+func (u *Users) Reload() ([]string, error) {
+	if u.path == "" {
+		return nil, nil
+	}
+	lookup, roles, totp, err := readFile(u.path)
+	if err != nil {
+		log.Error().Err(err).Str("file", u.path).Msg("Failed to read users file")
+		return nil, err
+	}
+
+	u.lock.Lock()
+	var removed []string
+	for name := range u.Lookup {
+		if _, ok := lookup[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	u.Lookup = lookup
+	u.roles = roles
+	u.totp = totp
+	u.lock.Unlock()
+
+	log.Debug().Strs("removed", removed).Msg(fmt.Sprintf("Loaded %d users", len(lookup)))
+	return removed, nil
+}
+
+// Watch reloads the users file when it changed or the process receives SIGHUP. The file is checked
+// every interval, an interval of zero only reloads on SIGHUP. The names of removed users are passed
+// to removed. Watch blocks forever.
+func (u *Users) Watch(interval time.Duration, removed func(names []string)) {
+	if u.path == "" {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
 
+	last, _ := os.Stat(u.path)
+	for {
+		select {
+		case <-hup:
+			log.Info().Str("file", u.path).Msg("Received SIGHUP, reloading users file")
+		case <-tick:
+			current, err := os.Stat(u.path)
+			if err != nil || !changed(last, current) {
+				continue
+			}
+			log.Info().Str("file", u.path).Msg("Users file changed, reloading")
+		}
+		last, _ = os.Stat(u.path)
+		names, err := u.Reload()
+		if err == nil && len(names) > 0 && removed != nil {
+			removed(names)
+		}
+	}
+}
+
+// changed checks if the file was replaced or modified.
+func changed(last, current os.FileInfo) bool {
+	return last == nil || !os.SameFile(last, current) ||
+		!last.ModTime().Equal(current.ModTime()) || last.Size() != current.Size()
+}
+
+// readFile reads the users file into a lookup from the name to the stored password, the roles of
+// the users which have roles, and the TOTP secrets of the users which have two-factor authentication.
+func readFile(path string) (map[string]string, map[string][]string, map[string]string, error) {
 	fd, err := os.Open(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 	defer func(fd *os.File) {
 		err := fd.Close()
 		if err != nil {
 			log.Error().Err(err).Msg("Failed to close file descriptor")
 		}
 	}(fd)
-	csvReader := csv.NewReader(fd)
+	infos, err := read(fd)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	lookup := map[string]string{}
+	roles := map[string][]string{}
+	totp := map[string]string{}
+	for _, info := range infos {
+		if !hashed(info.pass) {
+			log.Warn().Str("user", info.name).Msg("Plaintext passwords in the users file are deprecated, store a bcrypt, argon2id or htpasswd hash instead")
+		}
+		lookup[info.name] = info.pass
+		if len(info.roles) > 0 {
+			roles[info.name] = info.roles
+		}
+		if info.totp != "" {
+			totp[info.name] = info.totp
+		}
+	}
+	return lookup, roles, totp, nil
+}
+
+// read reads the colon separated user:password[:roles[:totp]] entries, lines starting with '#' are ignored.
+// Unknown roles are logged and ignored, the TOTP secret must be base32 encoded.
+func read(r io.Reader) ([]UserInfo, error) {
+	csvReader := csv.NewReader(r)
 	csvReader.Comma = ':'
 	csvReader.Comment = '#'
 	csvReader.TrimLeadingSpace = true
-	UserInfos, err := csvReader.ReadAll()
+	csvReader.FieldsPerRecord = -1
+	records, err := csvReader.ReadAll()
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to read users file")
 		return nil, err
 	}
-	for _, info := range UserInfos {
-		if len(info) != 2 {
+	infos := make([]UserInfo, 0, len(records))
+	for _, record := range records {
+		if len(record) < 2 || len(record) > 4 {
 			return nil, errors.New("malformed users file")
 		}
-		users.Lookup[info[0]] = info[1]
+		info := UserInfo{name: record[0], pass: record[1]}
+		if len(record) >= 3 {
+			var unknown []string
+			info.roles, unknown = parseRoles(record[2])
+			if len(unknown) > 0 {
+				log.Warn().Str("user", info.name).Strs("roles", unknown).Msg("Ignoring unknown roles in users file")
+			}
+		}
+		if len(record) == 4 && record[3] != "" {
+			if !ValidTOTPSecret(record[3]) {
+				return nil, fmt.Errorf("malformed totp secret of user %s", info.name)
+			}
+			info.totp = record[3]
+		}
+		infos = append(infos, info)
 	}
-
-	log.Debug().Msg(fmt.Sprintf("Loaded %d users", len(users.Lookup)))
-	return users, nil
+	return infos, nil
 }
 
 // CurrentUser according to the cookie in the request to get the session and then
-// to get the username. If the user not authenticated, "guest" will return.
+// to get the username. Without a session, the user of a verified client certificate
+// is used. If the user not authenticated, "guest" will return.
 func (u *Users) CurrentUser(r *http.Request) (string, bool) {
+	if info, ok := u.Session(r); ok {
+		return info.User, true
+	}
+	if user, ok := u.CertificateUser(r); ok {
+		return user, true
+	}
+	return "guest", false
+}
+
+// Session returns the login session of the request. Sessions which were revoked, have expired or
+// belong to a removed user are rejected.
+func (u *Users) Session(r *http.Request) (SessionInfo, bool) {
 	session, err := u.store.Get(r, "user")
 	session.Options.MaxAge = u.sessionTime
 	if err != nil {
 		log.Error().Err(err).Any("request", r).Msg("Failed to get the session from request or create a new session")
-		return "guest", false
+		return SessionInfo{}, false
+	}
+	username, ok := session.Values["user"].(string)
+	if !ok {
+		log.Debug().Str("user", "guest").Msg("Failed to get username from session")
+		return SessionInfo{}, false
 	}
-	if username, ok := session.Values["user"].(string); ok {
-		log.Debug().Str("user", username).Msg("Got username from session")
-		return username, ok
+	provider, _ := session.Values["provider"].(string)
+	if !u.known(username, provider) {
+		log.Info().Str("user", username).Msg("User of session was removed")
+		return SessionInfo{}, false
 	}
-	log.Debug().Str("user", "guest").Msg("Failed to get username from session")
-	return "guest", false
+	id, _ := session.Values["id"].(string)
+	info, ok, err := u.registry.touch(id, remoteIP(r))
+	if err != nil {
+		log.Error().Err(err).Str("user", username).Msg("Failed to look up the login session")
+		return SessionInfo{}, false
+	}
+	if !ok || info.User != username {
+		log.Info().Str("user", username).Str("session", id).Msg("Login session was revoked or expired")
+		return SessionInfo{}, false
+	}
+	log.Debug().Str("user", username).Msg("Got username from session")
+	return info, true
 }
 
 // Logout log out the user included in the request by creating a new session
-// and overwriting the old session.
+// and overwriting the old session. The login session is revoked.
 func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
+	if info, ok := u.Session(r); ok {
+		u.revoke(info.ID)
+	}
 	session := sessions.NewSession(u.store, "user")
 	session.IsNew = true
+	session.Options = cookieOptions(u.store)
+	session.Options.MaxAge = 0
 	if err := u.store.Save(r, w, session); err != nil {
 		w.WriteHeader(500)
 		_ = json.NewEncoder(w).Encode(&Response{
@@ -99,40 +295,128 @@ func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(200)
 }
 
-// validateUser check if the user and password are correct.
+// Roles returns the roles of the user, users without roles in the users file get the default roles.
+// Users of other providers always get the default roles.
+func (u *Users) Roles(user string) []string {
+	if strings.Contains(user, ":") {
+		return u.DefaultRoles
+	}
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	if roles, ok := u.roles[user]; ok {
+		return roles
+	}
+	return u.DefaultRoles
+}
+
+// known checks if the user of a session or token is still valid. OIDC users are not in the users file,
+// but must be in the namespace of the issuer.
+func (u *Users) known(user, provider string) bool {
+	if provider == ProviderOIDC {
+		return strings.HasPrefix(user, oidcPrefix)
+	}
+	return u.exists(user)
+}
+
+// exists checks if the user is in the users file.
+func (u *Users) exists(user string) bool {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	_, ok := u.Lookup[user]
+	return ok
+}
+
+// validateUser check if the user and password are correct. The password is compared in constant time,
+// and unknown users are checked against a dummy hash so that they cannot be told apart by timing.
 func (u *Users) validateUser(user, passwd string) bool {
+	u.lock.RLock()
 	pwd, ok := u.Lookup[user]
+	u.lock.RUnlock()
 	if !ok {
+		verifyPassword(dummyHash, passwd)
 		log.Info().Str("user", user).Msg("User not found")
 		return false
 	}
-	if pwd != passwd {
-		log.Info().Str("user", user).Str("password", passwd).Msg("Password not match")
+	if !verifyPassword(pwd, passwd) {
+		log.Info().Str("user", user).Msg("Password not match")
 		return false
 	}
 	return true
 }
 
+// validateTOTP checks the TOTP code of users with two-factor authentication, users without a secret need
+// no code. A code is accepted only once. It reports if a wrong code was sent, a missing code is no failure.
+func (u *Users) validateTOTP(user, code string) (failed bool, ok bool) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	secret, enabled := u.totp[user]
+	if !enabled {
+		return false, true
+	}
+	if code == "" {
+		log.Debug().Str("user", user).Msg("Two-factor code required")
+		return false, false
+	}
+	step, valid := verifyTOTP(secret, code, time.Now())
+	if !valid || step <= u.totpUsed[user] {
+		log.Info().Str("user", user).Msg("Two-factor code not match")
+		return true, false
+	}
+	if u.totpUsed == nil {
+		u.totpUsed = map[string]int64{}
+	}
+	u.totpUsed[user] = step
+	return false, true
+}
+
 // Authenticate will check if the user and password are correct. If so,
 // it will create a new session which stored the user information. And
 // then save the session to the store with response 200. If the password is
-// not correct, it will return 401.
+// not correct, it will return 401. Users with a TOTP secret also need the
+// code form value, without it 401 is returned with totpRequired set. If the user
+// or the address is locked out after too many failed attempts, it will return
+// 429 with Retry-After.
 func (u *Users) Authenticate(w http.ResponseWriter, r *http.Request) {
 	user := r.FormValue("user")
 	pass := r.FormValue("pass")
+	addr := remoteIP(r)
+	if u.limiter != nil {
+		if wait := u.limiter.locked(user, addr); wait > 0 {
+			log.Info().Str("user", user).Str("ip", addr).Dur("wait", wait).Msg("Login rejected, locked out")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			_ = json.NewEncoder(w).Encode(&Response{
+				Message: "Too many failed login attempts, please try again later",
+			})
+			return
+		}
+	}
 	if !u.validateUser(user, pass) {
+		if u.limiter != nil {
+			u.limiter.failed(user, addr)
+		}
 		w.WriteHeader(401)
 		_ = json.NewEncoder(w).Encode(&Response{
 			Message: fmt.Sprintf("User %s not found or password not match", user),
 		})
 		return
 	}
+	if failed, ok := u.validateTOTP(user, r.FormValue("code")); !ok {
+		if failed && u.limiter != nil {
+			u.limiter.failed(user, addr)
+		}
+		w.WriteHeader(401)
+		_ = json.NewEncoder(w).Encode(&Response{
+			Message:      "Invalid two-factor code",
+			TOTPRequired: true,
+		})
+		return
+	}
+	if u.limiter != nil {
+		u.limiter.succeeded(user)
+	}
 
-	session := sessions.NewSession(u.store, "user")
-	session.IsNew = true
-	session.Options.MaxAge = u.sessionTime
-	session.Values["user"] = user
-	if err := u.store.Save(r, w, session); err != nil {
+	if err := u.login(w, r, user, ProviderUsersFile); err != nil {
 		w.WriteHeader(500)
 		_ = json.NewEncoder(w).Encode(&Response{
 			Message: "Login system error, please try again",
@@ -141,3 +425,40 @@ func (u *Users) Authenticate(w http.ResponseWriter, r *http.Request) {
 	}
 	w.WriteHeader(200)
 }
+
+// login creates a new session for the user authenticated by the provider, registers it and saves it to the store.
+func (u *Users) login(w http.ResponseWriter, r *http.Request, user, provider string) error {
+	id, err := randomString(16, hex.EncodeToString)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := u.registry.add(SessionInfo{
+		ID:       id,
+		User:     user,
+		Provider: provider,
+		IP:       remoteIP(r),
+		Created:  now,
+		LastSeen: now,
+	}); err != nil {
+		log.Error().Err(err).Str("user", user).Msg("Failed to register the login session")
+		return err
+	}
+	session := sessions.NewSession(u.store, "user")
+	session.IsNew = true
+	session.Options = cookieOptions(u.store)
+	session.Options.MaxAge = u.sessionTime
+	session.Values["user"] = user
+	session.Values["provider"] = provider
+	session.Values["id"] = id
+	return u.store.Save(r, w, session)
+}
+
+// remoteIP returns the IP address of the client sending the request.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
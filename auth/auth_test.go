@@ -1,12 +1,35 @@
 package auth
 
 import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"github.com/ezshare/server/config"
+	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 	"github.com/rs/zerolog/log"
+	"io"
+	"math/big"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestReader(t *testing.T) {
@@ -42,6 +65,7 @@ func TestUsers_CurrentUser(t *testing.T) {
 	users := &Users{
 		Lookup:      map[string]string{"testuser": "testpassword"},
 		store:       sessions.NewCookieStore([]byte("secret")),
+		registry:    newRegistry(nil, 0),
 		sessionTime: 10,
 	}
 
@@ -53,14 +77,14 @@ func TestUsers_CurrentUser(t *testing.T) {
 	session.Values["user"] = "user"
 	_ = session.Save(req, httptest.NewRecorder())
 
-	username := users.CurrentUser(req)
+	username, _ := users.CurrentUser(req)
 	log.Info().Str("username", username).Msg("current user")
 	passwd := users.Lookup[username]
 	log.Info().Str("pass", passwd).Msg("current user pass")
 }
 
 func loadUserFile(path string) (*Users, error) {
-	users, err := LoadUsersFile(path, []byte("secret"), 10)
+	users, err := LoadUsersFile(path, sessions.NewCookieStore([]byte("secret")), nil, 10)
 	if err != nil {
 		log.Error().Err(err).Msg("load users file failed")
 		return nil, err
@@ -73,6 +97,7 @@ func TestUsers_validateUser(t *testing.T) {
 	users := &Users{
 		Lookup:      map[string]string{"testuser": "testpassword"},
 		store:       sessions.NewCookieStore([]byte("secret")),
+		registry:    newRegistry(nil, 0),
 		sessionTime: 10,
 	}
 
@@ -89,6 +114,7 @@ func TestUsers_Authenticate(t *testing.T) {
 	users := &Users{
 		Lookup:      map[string]string{"testuser": "testpassword"},
 		store:       sessions.NewCookieStore([]byte("secret")),
+		registry:    newRegistry(nil, 0),
 		sessionTime: 10,
 	}
 
@@ -105,5 +131,823 @@ func TestUsers_Authenticate(t *testing.T) {
 	_ = session.Save(req, httptest.NewRecorder())
 
 	users.Authenticate(httptest.NewRecorder(), req)
-	log.Info().Str("user", users.CurrentUser(req)).Str("pass", users.Lookup[users.CurrentUser(req)]).Msg("authenticate success")
+	username, _ := users.CurrentUser(req)
+	log.Info().Str("user", username).Str("pass", users.Lookup[username]).Msg("authenticate success")
+}
+
+func TestVerifyPassword(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("0123456789abcdef")
+	argon2Hash := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, 1024, 1, 1,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("secret"), salt, 1, 1024, 1, 32)))
+
+	for _, stored := range []string{
+		string(bcryptHash),
+		"$2y$" + strings.TrimPrefix(string(bcryptHash), "$2a$"),
+		argon2Hash,
+		"$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/",
+		"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+		"secret",
+	} {
+		if !hashed(stored) && stored != "secret" {
+			t.Errorf("%s not recognised as hash", stored)
+		}
+		if !verifyPassword(stored, "secret") {
+			t.Errorf("password not verified against %s", stored)
+		}
+		if verifyPassword(stored, "wrong") {
+			t.Errorf("wrong password verified against %s", stored)
+		}
+	}
+
+	if got := apr1("a longer password than sixteen", "xy"); got != "$apr1$xy$7Eb1kP4fun1.UZe5c3KdZ1" {
+		t.Errorf("unexpected apr1 hash %s", got)
+	}
+}
+
+func TestVerifyPasswordMalformedArgon2id(t *testing.T) {
+	salt := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	hash := base64.RawStdEncoding.EncodeToString(make([]byte, 32))
+	for _, params := range []string{
+		"m=1024,t=0,p=1",
+		"m=1024,t=1,p=0",
+		"m=1024,t=1000000,p=1",
+		"m=0,t=1,p=1",
+		"m=4294967295,t=1,p=1",
+		"m=1024,t=-1,p=1",
+		"m=1024,t=1",
+	} {
+		stored := fmt.Sprintf("$argon2id$v=%d$%s$%s$%s", argon2.Version, params, salt, hash)
+		if verifyPassword(stored, "secret") {
+			t.Errorf("password verified against %s", stored)
+		}
+	}
+}
+
+func TestUsersFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte("# users information\nadmin:123456\n\n# colleagues\nuser1:123456"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	file, err := OpenUsersFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.SetPassword("admin", hash)
+	file.SetPassword("user2", "654321")
+	if !file.Remove("user1") || file.Remove("user1") {
+		t.Fatal("user1 not removed exactly once")
+	}
+	if err := file.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "# users information\nadmin:" + hash + "\n\n# colleagues\nuser2:654321\n"
+	if string(content) != expected {
+		t.Fatalf("unexpected content %q", content)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o640 {
+		t.Fatalf("file mode not kept: %v %v", info, err)
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	infos, err := read(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].name != "admin" || !verifyPassword(infos[0].pass, "secret") {
+		t.Fatalf("unexpected users %+v", infos)
+	}
+}
+
+func TestUsers_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte("admin:123456\nuser1:123456\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	users := &Users{path: path, store: sessions.NewCookieStore([]byte("secret")), registry: newRegistry(nil, 0)}
+	if _, err := users.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost:8080", nil)
+	recorder := httptest.NewRecorder()
+	if err := users.login(recorder, req, "user1", ProviderUsersFile); err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(recorder.Result().Cookies()[0])
+	if _, ok := users.CurrentUser(req); !ok {
+		t.Fatal("user1 not logged in")
+	}
+
+	if err := os.WriteFile(path, []byte("admin:123456\nuser2:123456\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := users.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != "user1" {
+		t.Fatalf("unexpected removed users %v", removed)
+	}
+	if _, ok := users.CurrentUser(req); ok {
+		t.Fatal("session of removed user still valid")
+	}
+	if !users.validateUser("user2", "123456") {
+		t.Fatal("added user not valid")
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Reload(); err == nil || !users.validateUser("user2", "123456") {
+		t.Fatal("users not kept when the file cannot be read")
+	}
+}
+
+func TestNewSessionStore(t *testing.T) {
+	if _, err := NewSessionStore(config.Config{SessionStore: config.SessionStoreFilesystem, Secret: []byte("secret")}); err == nil {
+		t.Fatal("filesystem session store without path created")
+	}
+	for _, store := range []string{config.SessionStoreCookie, config.SessionStoreFilesystem} {
+		t.Run(store, func(t *testing.T) {
+			conf := config.Config{SessionStore: store, SessionStorePath: t.TempDir(), Secret: []byte("secret")}
+			sessionStore, err := NewSessionStore(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			users := &Users{Lookup: map[string]string{"testuser": "testpassword"}, store: sessionStore, registry: newRegistry(sessionStore, time.Minute), sessionTime: 60}
+
+			req := httptest.NewRequest("POST", "http://localhost:8080/login", nil)
+			req.Form = map[string][]string{"user": {"testuser"}, "pass": {"testpassword"}}
+			recorder := httptest.NewRecorder()
+			users.Authenticate(recorder, req)
+			if recorder.Code != 200 {
+				t.Fatalf("login failed with %d", recorder.Code)
+			}
+
+			req = httptest.NewRequest("GET", "http://localhost:8080/config", nil)
+			for _, cookie := range recorder.Result().Cookies() {
+				req.AddCookie(cookie)
+			}
+			if username, ok := users.CurrentUser(req); !ok || username != "testuser" {
+				t.Fatalf("unexpected current user %s", username)
+			}
+
+			// The login sessions of the filesystem store survive a restart.
+			users.registry = newRegistry(sessionStore, time.Minute)
+			if _, ok := users.Session(req); ok != (store == config.SessionStoreFilesystem) {
+				t.Fatalf("session after restart accepted: %v", ok)
+			}
+		})
+	}
+}
+
+func TestUsers_AuthenticateLockout(t *testing.T) {
+	users := &Users{
+		Lookup:   map[string]string{"testuser": "testpassword"},
+		store:    sessions.NewCookieStore([]byte("secret")),
+		registry: newRegistry(nil, 0),
+		limiter: &LoginLimiter{
+			counter:          newMemoryCounter(),
+			MaxAttempts:      2,
+			MaxAttemptsPerIP: 10,
+			Lockout:          time.Minute,
+			MaxLockout:       time.Hour,
+			Window:           time.Hour,
+		},
+	}
+	login := func(user, pass, addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "http://localhost:8080/login", nil)
+		req.RemoteAddr = addr + ":1234"
+		req.Form = map[string][]string{"user": {user}, "pass": {pass}}
+		recorder := httptest.NewRecorder()
+		users.Authenticate(recorder, req)
+		return recorder
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := login("testuser", "wrong", "192.0.2.1").Code; code != 401 {
+			t.Fatalf("failed attempt %d returned %d", i, code)
+		}
+	}
+	recorder := login("testuser", "testpassword", "192.0.2.2")
+	if recorder.Code != 429 || recorder.Header().Get("Retry-After") != "60" {
+		t.Fatalf("locked out user returned %d with Retry-After %q", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+	if code := login("otheruser", "wrong", "192.0.2.2").Code; code != 401 {
+		t.Fatalf("other user returned %d", code)
+	}
+
+	// Every further failure doubles the lockout.
+	users.limiter.failed("testuser", "192.0.2.1")
+	if wait := users.limiter.locked("testuser", "192.0.2.3"); wait <= time.Minute || wait > 2*time.Minute {
+		t.Fatalf("unexpected lockout %s", wait)
+	}
+}
+
+// mockIssuer is a minimal OpenID Connect issuer which signs ID tokens with an RSA key and checks the PKCE verifier.
+type mockIssuer struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	challenge string
+	nonce     string
+	claims    map[string]any
+}
+
+func startMockIssuer(t *testing.T, claims map[string]any) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &mockIssuer{key: key, claims: claims}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                issuer.URL,
+			"authorization_endpoint":                issuer.URL + "/authorize",
+			"token_endpoint":                        issuer.URL + "/token",
+			"jwks_uri":                              issuer.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if r.FormValue("code") != "code" || base64.RawURLEncoding.EncodeToString(sum[:]) != issuer.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     issuer.idToken(t),
+		})
+	})
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+func (m *mockIssuer) idToken(t *testing.T) string {
+	claims := map[string]any{
+		"iss":   m.URL,
+		"aud":   "ezshare",
+		"sub":   "subject",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": m.nonce,
+	}
+	for key, value := range m.claims {
+		claims[key] = value
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDC(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		allowedGroups []string
+		status        int
+	}{
+		{name: "signed in", status: http.StatusFound},
+		{name: "allowed group", allowedGroups: []string{"admins", "staff"}, status: http.StatusFound},
+		{name: "forbidden group", allowedGroups: []string{"admins"}, status: http.StatusForbidden},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			issuer := startMockIssuer(t, map[string]any{"preferred_username": "alice", "groups": []string{"staff"}})
+			// A users file account with the same name must not lend its roles to the OIDC user.
+			users := &Users{
+				Lookup:       map[string]string{"alice": "secret"},
+				roles:        map[string][]string{"alice": {RoleAdmin}},
+				DefaultRoles: []string{RoleViewer},
+				store:        sessions.NewCookieStore([]byte("secret")),
+				registry:     newRegistry(nil, 0),
+			}
+			oidc, err := NewOIDC(context.Background(), config.Config{
+				OIDCIssuer:        issuer.URL,
+				OIDCClientID:      "ezshare",
+				OIDCRedirectURL:   "http://localhost:8080/login/oidc/callback",
+				OIDCScopes:        []string{"openid"},
+				OIDCUsernameClaim: "preferred_username",
+				OIDCGroupsClaim:   "groups",
+				OIDCAllowedGroups: test.allowedGroups,
+			}, users)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			login := httptest.NewRecorder()
+			oidc.Login(login, httptest.NewRequest("GET", "http://localhost:8080/login/oidc", nil))
+			location, err := url.Parse(login.Header().Get("Location"))
+			if err != nil || login.Code != http.StatusFound {
+				t.Fatalf("unexpected login response %d %s", login.Code, location)
+			}
+			query := location.Query()
+			if query.Get("code_challenge_method") != "S256" {
+				t.Fatalf("PKCE not used: %s", location)
+			}
+			issuer.challenge, issuer.nonce = query.Get("code_challenge"), query.Get("nonce")
+
+			callback := httptest.NewRequest("GET", "http://localhost:8080/login/oidc/callback?code=code&state="+url.QueryEscape(query.Get("state")), nil)
+			for _, cookie := range login.Result().Cookies() {
+				callback.AddCookie(cookie)
+			}
+			recorder := httptest.NewRecorder()
+			oidc.Callback(recorder, callback)
+			if recorder.Code != test.status {
+				t.Fatalf("callback returned %d: %s", recorder.Code, recorder.Body)
+			}
+			if test.status != http.StatusFound {
+				return
+			}
+
+			req := httptest.NewRequest("GET", "http://localhost:8080/config", nil)
+			for _, cookie := range recorder.Result().Cookies() {
+				if cookie.Name == "user" {
+					req.AddCookie(cookie)
+				}
+			}
+			username, ok := users.CurrentUser(req)
+			if !ok || username != "oidc:alice" {
+				t.Fatalf("unexpected current user %s", username)
+			}
+			if roles := users.Roles(username); len(roles) != 1 || roles[0] != RoleViewer {
+				t.Fatalf("unexpected roles %v", roles)
+			}
+
+			// Sessions of OIDC users outside of the namespace are rejected.
+			legacy := httptest.NewRecorder()
+			if err := users.login(legacy, req, "alice", ProviderOIDC); err != nil {
+				t.Fatal(err)
+			}
+			req = httptest.NewRequest("GET", "http://localhost:8080/config", nil)
+			for _, cookie := range legacy.Result().Cookies() {
+				req.AddCookie(cookie)
+			}
+			if _, ok := users.Session(req); ok {
+				t.Fatal("session of an OIDC user without prefix accepted")
+			}
+		})
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	for _, test := range []struct {
+		authMode      string
+		authenticated bool
+		roles         []string
+		permission    Permission
+		allowed       bool
+	}{
+		{authMode: config.AuthModeTurn, permission: PermissionCreate, allowed: true},
+		{authMode: config.AuthModeTurn, permission: PermissionTurn, allowed: false},
+		{authMode: config.AuthModeAll, permission: PermissionCreate, allowed: false},
+		{authMode: config.AuthModeAll, permission: PermissionJoin, allowed: true},
+		{authMode: config.AuthModeAll, authenticated: true, roles: []string{RoleHost}, permission: PermissionTurn, allowed: true},
+		{authMode: config.AuthModeNone, authenticated: true, roles: []string{RoleViewer}, permission: PermissionShare, allowed: false},
+		{authMode: config.AuthModeAll, authenticated: true, roles: []string{RoleViewer}, permission: PermissionJoin, allowed: true},
+		{authMode: config.AuthModeAll, authenticated: true, roles: []string{RoleViewer, RoleAdmin}, permission: PermissionCreate, allowed: true},
+		{authMode: config.AuthModeAll, authenticated: true, permission: PermissionJoin, allowed: false},
+	} {
+		if allowed := Can(test.authMode, test.authenticated, test.roles, test.permission); allowed != test.allowed {
+			t.Errorf("%s %v %v %s: expected %v", test.authMode, test.authenticated, test.roles, test.permission, test.allowed)
+		}
+	}
+
+	infos, err := read(strings.NewReader("admin:123456:admin,bogus\nuser1:123456\nuser2:123456:viewer\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos[0].roles) != 1 || infos[0].roles[0] != RoleAdmin || infos[1].roles != nil || infos[2].roles[0] != RoleViewer {
+		t.Fatalf("unexpected roles %+v", infos)
+	}
+}
+
+func TestTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	tokens, err := LoadTokens(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := &Users{
+		Lookup:   map[string]string{"bot": "secret", "viewer": "secret"},
+		roles:    map[string][]string{"viewer": {RoleViewer}},
+		store:    sessions.NewCookieStore([]byte("secret")),
+		registry: newRegistry(nil, 0),
+		Tokens:   tokens,
+	}
+	users.DefaultRoles = []string{RoleHost}
+	loggedIn := func(user string) *http.Request {
+		req := httptest.NewRequest("POST", "http://localhost:8080/login", nil)
+		req.Form = map[string][]string{"user": {user}, "pass": {"secret"}}
+		recorder := httptest.NewRecorder()
+		users.Authenticate(recorder, req)
+		req = httptest.NewRequest("POST", "http://localhost:8080/tokens", nil)
+		for _, cookie := range recorder.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		return req
+	}
+
+	req := loggedIn("viewer")
+	req.Form = map[string][]string{"scopes": {"join,share"}}
+	recorder := httptest.NewRecorder()
+	users.CreateToken(recorder, req)
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("scope beyond the role returned %d", recorder.Code)
+	}
+
+	req = loggedIn("bot")
+	req.Form = map[string][]string{"name": {"recorder"}, "scopes": {"join"}, "ttl": {"86400"}}
+	recorder = httptest.NewRecorder()
+	users.CreateToken(recorder, req)
+	var issued struct {
+		ID      string    `json:"id"`
+		Token   string    `json:"token"`
+		Hash    string    `json:"hash"`
+		Expires time.Time `json:"expires"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&issued); err != nil || recorder.Code != 200 {
+		t.Fatalf("issue failed with %d: %v", recorder.Code, err)
+	}
+	if issued.Hash != "" || time.Until(issued.Expires) > time.Hour {
+		t.Fatalf("unexpected token %+v", issued)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), strings.SplitN(issued.Token, ".", 2)[1]) {
+		t.Fatal("token secret stored in plaintext")
+	}
+	if users.Tokens, err = LoadTokens(path, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "http://localhost:8080/stream?token="+url.QueryEscape(issued.Token), nil),
+		httptest.NewRequest("GET", "http://localhost:8080/stream", nil),
+	} {
+		if req.URL.RawQuery == "" {
+			req.Header.Set("Authorization", "Bearer "+issued.Token)
+		}
+		token, err := users.TokenUser(req)
+		if err != nil || token.User != "bot" || len(token.Scopes) != 1 || token.Scopes[0] != PermissionJoin {
+			t.Fatalf("unexpected token %+v: %v", token, err)
+		}
+	}
+	stream := httptest.NewRequest("GET", "http://localhost:8080/stream", nil)
+	stream.Header.Set("Authorization", "Bearer "+issued.ID+".wrong")
+	if _, err := users.TokenUser(stream); err != ErrInvalidToken {
+		t.Fatalf("wrong secret accepted: %v", err)
+	}
+
+	// Managing tokens requires a login session.
+	recorder = httptest.NewRecorder()
+	users.ListTokens(recorder, httptest.NewRequest("GET", "http://localhost:8080/tokens", nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("listing without session returned %d", recorder.Code)
+	}
+
+	var revoked []string
+	users.TokensRevoked = func(ids []string) { revoked = append(revoked, ids...) }
+	revoke := mux.SetURLVars(loggedIn("bot"), map[string]string{"id": issued.ID})
+	recorder = httptest.NewRecorder()
+	users.RevokeToken(recorder, revoke)
+	stream.Header.Set("Authorization", "Bearer "+issued.Token)
+	if _, err := users.TokenUser(stream); recorder.Code != 200 || err != ErrInvalidToken {
+		t.Fatalf("revoked token accepted: %d %v", recorder.Code, err)
+	}
+	if len(revoked) != 1 || revoked[0] != issued.ID {
+		t.Fatalf("revocation not reported: %v", revoked)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	users := &Users{
+		Lookup:   map[string]string{"alice": "secret", "bob": "secret", "root": "secret"},
+		roles:    map[string][]string{"root": {RoleAdmin}},
+		store:    sessions.NewCookieStore([]byte("secret")),
+		registry: newRegistry(nil, 0),
+	}
+	var revoked []string
+	users.SessionsRevoked = func(ids []string) { revoked = append(revoked, ids...) }
+	login := func(user string) []*http.Cookie {
+		req := httptest.NewRequest("POST", "http://localhost:8080/login", nil)
+		req.Form = map[string][]string{"user": {user}, "pass": {"secret"}}
+		recorder := httptest.NewRecorder()
+		users.Authenticate(recorder, req)
+		return recorder.Result().Cookies()
+	}
+	request := func(method, target string, cookies []*http.Cookie) *http.Request {
+		req := httptest.NewRequest(method, target, nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		return req
+	}
+	list := func(cookies []*http.Cookie, query string) (int, []SessionInfo) {
+		recorder := httptest.NewRecorder()
+		users.ListSessions(recorder, request("GET", "http://localhost:8080/sessions"+query, cookies))
+		var infos []SessionInfo
+		_ = json.NewDecoder(recorder.Body).Decode(&infos)
+		return recorder.Code, infos
+	}
+
+	laptop, phone, bob, root := login("alice"), login("alice"), login("bob"), login("root")
+	code, infos := list(laptop, "")
+	if code != 200 || len(infos) != 2 || !infos[0].Current || infos[1].Current || infos[0].IP == "" {
+		t.Fatalf("unexpected sessions %d %+v", code, infos)
+	}
+	if code, _ := list(laptop, "?all=true"); code != http.StatusForbidden {
+		t.Fatalf("non-admin listed all sessions: %d", code)
+	}
+	if code, infos := list(root, "?all=true"); code != 200 || len(infos) != 4 {
+		t.Fatalf("admin listed %d %+v", code, infos)
+	}
+
+	_, bobs := list(bob, "")
+	recorder := httptest.NewRecorder()
+	users.RevokeSession(recorder, mux.SetURLVars(request("DELETE", "http://localhost:8080/sessions/x", laptop), map[string]string{"id": bobs[0].ID}))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("revoked the session of another user: %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	users.RevokeSession(recorder, mux.SetURLVars(request("DELETE", "http://localhost:8080/sessions/x", laptop), map[string]string{"id": infos[1].ID}))
+	if recorder.Code != 200 || len(revoked) != 1 || revoked[0] != infos[1].ID {
+		t.Fatalf("revoke returned %d, revoked %v", recorder.Code, revoked)
+	}
+	if _, ok := users.CurrentUser(request("GET", "http://localhost:8080/config", phone)); ok {
+		t.Fatal("revoked session accepted")
+	}
+	if user, ok := users.CurrentUser(request("GET", "http://localhost:8080/config", laptop)); !ok || user != "alice" {
+		t.Fatal("other session of the user rejected")
+	}
+
+	recorder = httptest.NewRecorder()
+	users.RevokeSession(recorder, mux.SetURLVars(request("DELETE", "http://localhost:8080/sessions/x", root), map[string]string{"id": bobs[0].ID}))
+	if _, ok := users.CurrentUser(request("GET", "http://localhost:8080/config", bob)); recorder.Code != 200 || ok {
+		t.Fatalf("admin revoke returned %d", recorder.Code)
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	conf := config.Config{Secret: []byte("secret"), ServerTLS: true, CheckOrigin: func(origin string) bool { return origin == "https://trusted.example" }}
+	csrf := NewCSRF(conf)
+	protected := csrf.Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+
+	recorder := httptest.NewRecorder()
+	token, err := csrf.Token(recorder, httptest.NewRequest("GET", "https://localhost/config", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := recorder.Result().Cookies()[0]
+	if !cookie.Secure || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.Value == token {
+		t.Fatalf("unexpected csrf cookie %+v", cookie)
+	}
+
+	post := func(origin, header string, form url.Values, cookies ...*http.Cookie) int {
+		req := httptest.NewRequest("POST", "https://localhost/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if header != "" {
+			req.Header.Set("X-CSRF-Token", header)
+		}
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		recorder := httptest.NewRecorder()
+		protected.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+	planted := &http.Cookie{Name: cookie.Name, Value: "planted"}
+	for name, test := range map[string]struct {
+		code int
+		got  int
+	}{
+		"header":         {200, post("https://localhost", token, nil, cookie)},
+		"form":           {200, post("", "", url.Values{"csrf": {token}}, cookie)},
+		"allowed origin": {200, post("https://trusted.example", token, nil, cookie)},
+		"foreign origin": {403, post("https://evil.example", token, nil, cookie)},
+		"no token":       {403, post("https://localhost", "", nil, cookie)},
+		"no cookie":      {403, post("https://localhost", token, nil)},
+		"planted cookie": {403, post("https://localhost", "planted", nil, planted)},
+	} {
+		if test.got != test.code {
+			t.Errorf("%s: got %d, want %d", name, test.got, test.code)
+		}
+	}
+
+	store, err := NewSessionStore(config.Config{Secret: []byte("secret"), ServerTLS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := cookieOptions(store)
+	if !options.Secure || !options.HttpOnly || options.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("unexpected session cookie options %+v", options)
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	// The SHA1 test vectors of RFC 6238, truncated to 6 digits.
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	for unix, code := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924", 2000000000: "279037"} {
+		if _, ok := verifyTOTP(secret, code, time.Unix(unix, 0)); !ok {
+			t.Errorf("code %s not valid at %d", code, unix)
+		}
+	}
+	if _, ok := verifyTOTP(secret, "287082", time.Unix(59+3*totpPeriod, 0)); ok {
+		t.Error("expired code accepted")
+	}
+
+	path := filepath.Join(t.TempDir(), "users")
+	file, _ := OpenUsersFile(path)
+	hash, _ := HashPassword("secret")
+	file.SetPassword("alice", hash)
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.SetTOTP("alice", secret)
+	if err := file.Save(); err != nil {
+		t.Fatal(err)
+	}
+	users, err := LoadUsersFile(path, sessions.NewCookieStore([]byte("secret")), nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(code string) (int, Response) {
+		req := httptest.NewRequest("POST", "http://localhost:8080/login", nil)
+		req.Form = map[string][]string{"user": {"alice"}, "pass": {"secret"}, "code": {code}}
+		recorder := httptest.NewRecorder()
+		users.Authenticate(recorder, req)
+		var response Response
+		_ = json.NewDecoder(recorder.Body).Decode(&response)
+		return recorder.Code, response
+	}
+	if code, response := login(""); code != 401 || !response.TOTPRequired {
+		t.Fatalf("login without code returned %d %+v", code, response)
+	}
+	if code, _ := login("000000"); code != 401 {
+		t.Fatalf("login with wrong code returned %d", code)
+	}
+	key, _ := decodeTOTPSecret(secret)
+	valid := hotp(key, time.Now().Unix()/totpPeriod)
+	if code, _ := login(valid); code != 200 {
+		t.Fatalf("login with valid code returned %d", code)
+	}
+	if code, _ := login(valid); code != 401 {
+		t.Fatalf("replayed code returned %d", code)
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	newCert := func(template, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, _ := x509.ParseCertificate(der)
+		return cert, key
+	}
+	ca, caKey := newCert(&x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ezshare test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	client, clientKey := newCert(&x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "build-agent"},
+		DNSNames:     []string{"agent.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := ClientCertTLSConfig(config.Config{TLSClientAuth: config.ClientAuthOptional, TLSClientCAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := &Users{
+		Lookup:             map[string]string{},
+		roles:              map[string][]string{"build-agent": {RoleAdmin}},
+		DefaultRoles:       []string{RoleViewer},
+		store:              sessions.NewCookieStore([]byte("secret")),
+		registry:           newRegistry(nil, 0),
+		ClientCertUsername: config.ClientUsernameCN,
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := users.CurrentUser(r)
+		_, _ = fmt.Fprintf(w, "%s %t", user, ok)
+	}))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(certificates ...tls.Certificate) string {
+		transport := server.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.Certificates = certificates
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if err != nil {
+			return err.Error()
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	certificate := tls.Certificate{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey}
+	if got := get(certificate); got != "cert:build-agent true" {
+		t.Fatalf("cn user: %s", got)
+	}
+	if roles := users.Roles("cert:build-agent"); len(roles) != 1 || roles[0] != RoleViewer {
+		t.Fatalf("unexpected roles %v", roles)
+	}
+
+	// Names of users file accounts are only accepted if they are mapped.
+	users.Lookup["build-agent"] = "secret"
+	if got := get(certificate); got != "guest false" {
+		t.Fatalf("unmapped account: %s", got)
+	}
+	users.ClientCertUsers = []string{"build-agent"}
+	if got := get(certificate); got != "build-agent true" {
+		t.Fatalf("mapped account: %s", got)
+	}
+
+	users.ClientCertUsername = config.ClientUsernameSAN
+	if got := get(certificate); got != "cert:agent.example true" {
+		t.Fatalf("san user: %s", got)
+	}
+	if got := get(); got != "guest false" {
+		t.Fatalf("optional certificate: %s", got)
+	}
+
+	untrusted, untrustedKey := newCert(&x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "intruder"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, nil, nil)
+	if got := get(tls.Certificate{Certificate: [][]byte{untrusted.Raw}, PrivateKey: untrustedKey}); strings.Contains(got, "intruder") {
+		t.Fatalf("untrusted certificate accepted: %s", got)
+	}
 }
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+
+	"github.com/ezshare/server/config"
+	"github.com/rs/zerolog/log"
+)
+
+// ClientCertTLSConfig creates the TLS config which verifies client certificates against the CA bundle of
+// the config. It returns nil if client certificates are disabled.
+func ClientCertTLSConfig(conf config.Config) (*tls.Config, error) {
+	if conf.TLSClientAuth == "" || conf.TLSClientAuth == config.ClientAuthNone {
+		return nil, nil
+	}
+	bundle, err := os.ReadFile(conf.TLSClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, errors.New("no certificates found in " + conf.TLSClientCAFile)
+	}
+	clientAuth := tls.VerifyClientCertIfGiven
+	if conf.TLSClientAuth == config.ClientAuthRequired {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	log.Debug().Str("mode", conf.TLSClientAuth).Str("ca", conf.TLSClientCAFile).Msg("Verifying client certificates")
+	return &tls.Config{ClientCAs: pool, ClientAuth: clientAuth}, nil
+}
+
+// CertificateUser returns the user of the verified client certificate of the request. The name is the
+// subject CN, or the first DNS name, email address or URI of the SAN, see ClientCertUsername. The user is
+// the name with the cert: prefix, or the users file account of the same name if it is in ClientCertUsers.
+// Other names of users file accounts are rejected.
+func (u *Users) CertificateUser(r *http.Request) (string, bool) {
+	if u.ClientCertUsername == "" || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	var user string
+	if u.ClientCertUsername == config.ClientUsernameSAN {
+		switch {
+		case len(cert.DNSNames) > 0:
+			user = cert.DNSNames[0]
+		case len(cert.EmailAddresses) > 0:
+			user = cert.EmailAddresses[0]
+		case len(cert.URIs) > 0:
+			user = cert.URIs[0].String()
+		}
+	} else {
+		user = cert.Subject.CommonName
+	}
+	if user == "" {
+		log.Info().Str("subject", cert.Subject.String()).Str("field", u.ClientCertUsername).Msg("Client certificate has no username")
+		return "", false
+	}
+	if u.exists(user) {
+		if !slices.Contains(u.ClientCertUsers, user) {
+			log.Warn().Str("user", user).Str("subject", cert.Subject.String()).Msg("Client certificate names a users file account which is not mapped")
+			return "", false
+		}
+		log.Debug().Str("user", user).Msg("Got users file account from client certificate")
+		return user, true
+	}
+	user = certificatePrefix + user
+	log.Debug().Str("user", user).Msg("Got username from client certificate")
+	return user, true
+}
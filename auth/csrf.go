@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+
+	"github.com/ezshare/server/config"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	csrfCookie = "ezshare_csrf"
+	csrfHeader = "X-CSRF-Token"
+	csrfField  = "csrf"
+)
+
+// CSRF protects the form handlers which use the session cookie against cross-site requests. It is a
+// double-submit cookie: the browser gets a random cookie, and the UI sends its HMAC, which it gets from
+// /config, with every protected request. Other sites can neither read the token nor forge it from a
+// cookie they planted.
+type CSRF struct {
+	key         []byte
+	secure      bool
+	checkOrigin func(origin string) bool
+}
+
+// NewCSRF creates the CSRF protection keyed with the secret of the config.
+func NewCSRF(conf config.Config) *CSRF {
+	return &CSRF{key: conf.Secret, secure: conf.ServerTLS, checkOrigin: conf.CheckOrigin}
+}
+
+// Token returns the CSRF token of the request, a new cookie is set if the request has none.
+func (c *CSRF) Token(w http.ResponseWriter, r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(csrfCookie); err == nil && cookie.Value != "" {
+		return c.sign(cookie.Value), nil
+	}
+	value, err := randomString(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   c.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return c.sign(value), nil
+}
+
+// Protect rejects requests from foreign origins and requests without a valid token in the X-CSRF-Token
+// header or the csrf form value with 403.
+func (c *CSRF) Protect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.sameOrigin(r) {
+			log.Info().Str("ip", remoteIP(r)).Str("origin", r.Header.Get("Origin")).Str("path", r.URL.Path).Msg("Rejected cross-site request")
+			writeResponse(w, http.StatusForbidden, "Cross-site request rejected")
+			return
+		}
+		if !c.valid(r) {
+			log.Info().Str("ip", remoteIP(r)).Str("path", r.URL.Path).Msg("Rejected request with invalid csrf token")
+			writeResponse(w, http.StatusForbidden, "Invalid csrf token, please reload the page")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sameOrigin checks the Origin header, which browsers send with every POST and DELETE request.
+func (c *CSRF) sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return u.Host == r.Host || c.checkOrigin(origin)
+}
+
+func (c *CSRF) valid(r *http.Request) bool {
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		token = r.FormValue(csrfField)
+	}
+	return hmac.Equal([]byte(token), []byte(c.sign(cookie.Value)))
+}
+
+func (c *CSRF) sign(value string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
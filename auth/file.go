@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// UsersFile is the users file as edited by the users command. The file is kept line by line, so that
+// comments, blank lines and the order of the entries survive an edit.
+type UsersFile struct {
+	path  string
+	lines []string
+}
+
+// OpenUsersFile reads the users file, a missing file is treated as empty.
+func OpenUsersFile(path string) (*UsersFile, error) {
+	f := &UsersFile{path: path}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimSuffix(strings.ReplaceAll(string(content), "\r\n", "\n"), "\n")
+	if text != "" {
+		f.lines = strings.Split(text, "\n")
+	}
+	return f, nil
+}
+
+// Users returns the names of the users in the order of the file.
+func (f *UsersFile) Users() []string {
+	var names []string
+	for _, line := range f.lines {
+		if name, _, ok := entry(line); ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Has checks if the user exists.
+func (f *UsersFile) Has(name string) bool {
+	return f.find(name) >= 0
+}
+
+// SetPassword sets the password hash of the user, the user is appended if it does not exist. The other
+// fields of the user are kept.
+func (f *UsersFile) SetPassword(name, hash string) {
+	f.set(name, 1, hash)
+}
+
+// SetRoles sets the roles of the user, no roles means the default roles.
+func (f *UsersFile) SetRoles(name string, roles []string) {
+	f.set(name, 2, strings.Join(roles, ","))
+}
+
+// SetTOTP sets the TOTP secret of the user, an empty secret disables two-factor authentication.
+func (f *UsersFile) SetTOTP(name, secret string) {
+	f.set(name, 3, secret)
+}
+
+// Roles returns the roles of the user in the file.
+func (f *UsersFile) Roles(name string) []string {
+	value := f.field(name, 2)
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// TOTP returns the TOTP secret of the user, it is empty if the user has no two-factor authentication.
+func (f *UsersFile) TOTP(name string) string {
+	return f.field(name, 3)
+}
+
+// field returns a colon separated field of the user.
+func (f *UsersFile) field(name string, field int) string {
+	i := f.find(name)
+	if i < 0 {
+		return ""
+	}
+	fields := strings.Split(strings.TrimLeft(f.lines[i], " \t"), ":")
+	if len(fields) <= field {
+		return ""
+	}
+	return fields[field]
+}
+
+// set sets a colon separated field of the user, trailing empty fields are removed.
+func (f *UsersFile) set(name string, field int, value string) {
+	i := f.find(name)
+	if i < 0 {
+		f.lines = append(f.lines, name)
+		i = len(f.lines) - 1
+	}
+	fields := strings.Split(strings.TrimLeft(f.lines[i], " \t"), ":")
+	for len(fields) <= field {
+		fields = append(fields, "")
+	}
+	fields[field] = value
+	for len(fields) > 2 && fields[len(fields)-1] == "" {
+		fields = fields[:len(fields)-1]
+	}
+	f.lines[i] = strings.Join(fields, ":")
+}
+
+// Remove removes the user and reports if it existed.
+func (f *UsersFile) Remove(name string) bool {
+	i := f.find(name)
+	if i < 0 {
+		return false
+	}
+	f.lines = append(f.lines[:i], f.lines[i+1:]...)
+	return true
+}
+
+// Save writes the file atomically by writing a temporary file next to it and renaming it.
+func (f *UsersFile) Save() error {
+	content := strings.Join(f.lines, "\n")
+	if content != "" {
+		content += "\n"
+	}
+	return writeFileAtomic(f.path, []byte(content))
+}
+
+// writeFileAtomic replaces the file by writing a temporary file next to it and renaming it, the mode
+// of an existing file is kept.
+func writeFileAtomic(path string, content []byte) error {
+	mode := os.FileMode(0o600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (f *UsersFile) find(name string) int {
+	for i, line := range f.lines {
+		if n, _, ok := entry(line); ok && n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// ValidUsername checks if the name can be stored in the users file.
+func ValidUsername(name string) bool {
+	return name != "" && !strings.HasPrefix(name, "#") && !strings.ContainsAny(name, ": \t\r\n\"")
+}
+
+// HashPassword hashes the password with bcrypt for storing it in the users file.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// entry splits a line of the users file into the name and the rest, comments and blank lines are no entries.
+func entry(line string) (string, string, bool) {
+	line = strings.TrimLeft(line, " \t")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+	name, rest, _ := strings.Cut(line, ":")
+	return name, rest, true
+}
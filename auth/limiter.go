@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/ezshare/server/config"
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/sessions"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/boj/redistore.v1"
+)
+
+// counter keeps the failed login attempts and lockouts. It lives in the same backing store as the
+// sessions, so that the limits are shared between instances using the redis session store.
+type counter interface {
+	// incr counts a failed attempt of the key and returns the failures within the window.
+	incr(key string, window time.Duration) (int64, error)
+	// lockOut locks the key for the duration.
+	lockOut(key string, d time.Duration) error
+	// locked returns how long the key is still locked.
+	locked(key string) (time.Duration, error)
+	// reset forgets the failed attempts of the key.
+	reset(key string) error
+}
+
+// LoginLimiter protects the login against brute-force attacks. Failed attempts are counted per username
+// and per IP address, once a limit is reached the key is locked out. Every further failure doubles the
+// lockout up to MaxLockout.
+type LoginLimiter struct {
+	counter counter
+
+	MaxAttempts      int           // Failed attempts per username before the lockout, zero disables the limit
+	MaxAttemptsPerIP int           // Failed attempts per IP address before the lockout, zero disables the limit
+	Lockout          time.Duration // The first lockout
+	MaxLockout       time.Duration // The longest lockout
+	Window           time.Duration // Failed attempts are forgotten after this time without failures
+}
+
+// NewLoginLimiter creates the LoginLimiter from the config. The attempts are counted in redis if the
+// session store is a redis store, otherwise in memory.
+func NewLoginLimiter(conf config.Config, store sessions.Store) *LoginLimiter {
+	var c counter = newMemoryCounter()
+	if redisStore, ok := store.(*redistore.RediStore); ok {
+		c = &redisCounter{pool: redisStore.Pool}
+	}
+	return &LoginLimiter{
+		counter:          c,
+		MaxAttempts:      conf.LoginMaxAttempts,
+		MaxAttemptsPerIP: conf.LoginMaxAttemptsPerIP,
+		Lockout:          time.Duration(conf.LoginLockoutSeconds) * time.Second,
+		MaxLockout:       time.Duration(conf.LoginMaxLockoutSeconds) * time.Second,
+		Window:           time.Duration(conf.LoginAttemptWindowSeconds) * time.Second,
+	}
+}
+
+// locked returns how long the login of the user from the address is still locked out.
+func (l *LoginLimiter) locked(user, addr string) time.Duration {
+	var wait time.Duration
+	for _, key := range l.keys(user, addr) {
+		d, err := l.counter.locked(key)
+		if err != nil {
+			log.Error().Err(err).Str("key", key).Msg("Failed to check login lockout")
+			continue
+		}
+		if d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// failed counts a failed login of the user from the address and locks the keys out which reached their limit.
+func (l *LoginLimiter) failed(user, addr string) {
+	for _, key := range l.keys(user, addr) {
+		limit := l.MaxAttempts
+		if key == "ip:"+addr {
+			limit = l.MaxAttemptsPerIP
+		}
+		failures, err := l.counter.incr(key, l.Window)
+		if err != nil {
+			log.Error().Err(err).Str("key", key).Msg("Failed to count login attempt")
+			continue
+		}
+		if failures < int64(limit) {
+			continue
+		}
+		lockout := l.lockout(failures - int64(limit))
+		if err := l.counter.lockOut(key, lockout); err != nil {
+			log.Error().Err(err).Str("key", key).Msg("Failed to lock out login")
+			continue
+		}
+		log.Warn().Str("key", key).Int64("failures", failures).Dur("lockout", lockout).Msg("Login locked out")
+	}
+}
+
+// succeeded forgets the failed attempts of the user. The failures of the address are kept, so that an
+// attacker cannot reset them with an account of their own.
+func (l *LoginLimiter) succeeded(user string) {
+	if l.MaxAttempts <= 0 {
+		return
+	}
+	if err := l.counter.reset("user:" + user); err != nil {
+		log.Error().Err(err).Str("user", user).Msg("Failed to reset login attempts")
+	}
+}
+
+// lockout returns the lockout after the given number of failures beyond the limit.
+func (l *LoginLimiter) lockout(beyond int64) time.Duration {
+	if beyond > 32 {
+		beyond = 32
+	}
+	lockout := float64(l.Lockout) * math.Pow(2, float64(beyond))
+	if l.MaxLockout > 0 && lockout > float64(l.MaxLockout) {
+		return l.MaxLockout
+	}
+	return time.Duration(lockout)
+}
+
+// keys returns the keys of the enabled limits.
+func (l *LoginLimiter) keys(user, addr string) []string {
+	var keys []string
+	if l.MaxAttempts > 0 {
+		keys = append(keys, "user:"+user)
+	}
+	if l.MaxAttemptsPerIP > 0 {
+		keys = append(keys, "ip:"+addr)
+	}
+	return keys
+}
+
+// memoryCounter keeps the attempts in memory for single instance deployments.
+type memoryCounter struct {
+	lock     sync.Mutex
+	failures map[string]*failures
+	lockouts map[string]time.Time
+}
+
+type failures struct {
+	count   int64
+	expires time.Time
+}
+
+func newMemoryCounter() *memoryCounter {
+	return &memoryCounter{failures: map[string]*failures{}, lockouts: map[string]time.Time{}}
+}
+
+func (c *memoryCounter) incr(key string, window time.Duration) (int64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	c.sweep(now)
+	f, ok := c.failures[key]
+	if !ok {
+		f = &failures{}
+		c.failures[key] = f
+	}
+	f.count++
+	f.expires = now.Add(window)
+	return f.count, nil
+}
+
+func (c *memoryCounter) lockOut(key string, d time.Duration) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lockouts[key] = time.Now().Add(d)
+	return nil
+}
+
+func (c *memoryCounter) locked(key string) (time.Duration, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	until, ok := c.lockouts[key]
+	if !ok {
+		return 0, nil
+	}
+	wait := time.Until(until)
+	if wait <= 0 {
+		delete(c.lockouts, key)
+		return 0, nil
+	}
+	return wait, nil
+}
+
+func (c *memoryCounter) reset(key string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.failures, key)
+	return nil
+}
+
+// sweep removes expired failures and lockouts, so that the maps do not grow with every address ever seen.
+func (c *memoryCounter) sweep(now time.Time) {
+	for key, f := range c.failures {
+		if now.After(f.expires) {
+			delete(c.failures, key)
+		}
+	}
+	for key, until := range c.lockouts {
+		if now.After(until) {
+			delete(c.lockouts, key)
+		}
+	}
+}
+
+// redisCounter keeps the attempts in the redis of the session store.
+type redisCounter struct {
+	pool *redis.Pool
+}
+
+func (c *redisCounter) incr(key string, window time.Duration) (int64, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	_ = conn.Send("MULTI")
+	_ = conn.Send("INCR", "login_failures_"+key)
+	_ = conn.Send("PEXPIRE", "login_failures_"+key, window.Milliseconds())
+	values, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, err
+	}
+	return redis.Int64(values[0], nil)
+}
+
+func (c *redisCounter) lockOut(key string, d time.Duration) error {
+	conn := c.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("SET", "login_lockout_"+key, 1, "PX", d.Milliseconds())
+	return err
+}
+
+func (c *redisCounter) locked(key string) (time.Duration, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	ms, err := redis.Int64(conn.Do("PTTL", "login_lockout_"+key))
+	if err != nil || ms <= 0 {
+		return 0, err
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+func (c *redisCounter) reset(key string) error {
+	conn := c.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", "login_failures_"+key)
+	return err
+}
@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/ezshare/server/config"
+	"github.com/ezshare/server/util"
+	"github.com/gorilla/sessions"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
+)
+
+// oidcSessionTime is how long an OpenID Connect login may take, from the redirect to the issuer until the callback.
+const oidcSessionTime = 600
+
+// OIDC signs users in with the authorization code flow with PKCE of an OpenID Connect issuer. On success
+// it creates the same user session as Users.Authenticate, so that Users.CurrentUser reports the user.
+type OIDC struct {
+	users    *Users
+	verifier *oidc.IDTokenVerifier
+	oauth    oauth2.Config
+
+	UsernameClaim string
+	GroupsClaim   string
+	AllowedGroups []string // If not empty, the user must be in one of the groups
+}
+
+// NewOIDC discovers the issuer of the config and creates the OIDC login for the users.
+func NewOIDC(ctx context.Context, conf config.Config, users *Users) (*OIDC, error) {
+	provider, err := oidc.NewProvider(ctx, conf.OIDCIssuer)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug().Str("issuer", conf.OIDCIssuer).Strs("allowedGroups", conf.OIDCAllowedGroups).Msg("Using OpenID Connect login")
+	return &OIDC{
+		users:    users,
+		verifier: provider.Verifier(&oidc.Config{ClientID: conf.OIDCClientID}),
+		oauth: oauth2.Config{
+			ClientID:     conf.OIDCClientID,
+			ClientSecret: conf.OIDCClientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  conf.OIDCRedirectURL,
+			Scopes:       conf.OIDCScopes,
+		},
+		UsernameClaim: conf.OIDCUsernameClaim,
+		GroupsClaim:   conf.OIDCGroupsClaim,
+		AllowedGroups: conf.OIDCAllowedGroups,
+	}, nil
+}
+
+// Login redirects the user to the issuer. The state, the nonce and the PKCE verifier are kept in a short-lived
+// session until the callback.
+func (o *OIDC) Login(w http.ResponseWriter, r *http.Request) {
+	state, nonce, verifier := util.RandString(32), util.RandString(32), oauth2.GenerateVerifier()
+
+	session := sessions.NewSession(o.users.store, "oidc")
+	session.IsNew = true
+	session.Options = cookieOptions(o.users.store)
+	session.Options.MaxAge = oidcSessionTime
+	session.Values["state"] = state
+	session.Values["nonce"] = nonce
+	session.Values["verifier"] = verifier
+	if err := o.users.store.Save(r, w, session); err != nil {
+		log.Error().Err(err).Msg("Failed to save OpenID Connect session")
+		w.WriteHeader(500)
+		_ = json.NewEncoder(w).Encode(&Response{
+			Message: "Login system error, please try again",
+		})
+		return
+	}
+	http.Redirect(w, r, o.oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), http.StatusFound)
+}
+
+// Callback exchanges the authorization code, verifies the ID token and signs the user in. The user is
+// redirected to the start page.
+func (o *OIDC) Callback(w http.ResponseWriter, r *http.Request) {
+	session, err := o.users.store.Get(r, "oidc")
+	if err != nil || session.IsNew {
+		o.fail(w, http.StatusBadRequest, "OpenID Connect login expired, please try again", err)
+		return
+	}
+	state, _ := session.Values["state"].(string)
+	nonce, _ := session.Values["nonce"].(string)
+	verifier, _ := session.Values["verifier"].(string)
+
+	// The login session is single use.
+	session.Options.MaxAge = -1
+	if err := o.users.store.Save(r, w, session); err != nil {
+		log.Error().Err(err).Msg("Failed to delete OpenID Connect session")
+	}
+
+	if state == "" || r.URL.Query().Get("state") != state {
+		o.fail(w, http.StatusBadRequest, "OpenID Connect state mismatch", nil)
+		return
+	}
+	if reason := r.URL.Query().Get("error"); reason != "" {
+		o.fail(w, http.StatusUnauthorized, "OpenID Connect login denied: "+reason, nil)
+		return
+	}
+
+	token, err := o.oauth.Exchange(r.Context(), r.URL.Query().Get("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		o.fail(w, http.StatusUnauthorized, "OpenID Connect code exchange failed", err)
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		o.fail(w, http.StatusUnauthorized, "OpenID Connect response contains no id token", nil)
+		return
+	}
+	idToken, err := o.verifier.Verify(r.Context(), rawIDToken)
+	if err != nil {
+		o.fail(w, http.StatusUnauthorized, "OpenID Connect id token invalid", err)
+		return
+	}
+	if idToken.Nonce != nonce {
+		o.fail(w, http.StatusUnauthorized, "OpenID Connect nonce mismatch", nil)
+		return
+	}
+
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		o.fail(w, http.StatusUnauthorized, "OpenID Connect claims invalid", err)
+		return
+	}
+	user, err := o.authorize(claims)
+	if err != nil {
+		o.fail(w, http.StatusForbidden, err.Error(), nil)
+		return
+	}
+
+	if err := o.users.login(w, r, user, ProviderOIDC); err != nil {
+		o.fail(w, http.StatusInternalServerError, "Login system error, please try again", err)
+		return
+	}
+	log.Info().Str("user", user).Str("subject", idToken.Subject).Msg("Signed in with OpenID Connect")
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// authorize returns the user of the claims, and checks the groups if they are restricted. The user is the
+// username claim with the oidc: prefix, so that it never gets the roles of a users file account.
+func (o *OIDC) authorize(claims map[string]any) (string, error) {
+	name, _ := claims[o.UsernameClaim].(string)
+	if name == "" {
+		return "", fmt.Errorf("claim %s is missing", o.UsernameClaim)
+	}
+	user := oidcPrefix + name
+	if len(o.AllowedGroups) == 0 {
+		return user, nil
+	}
+
+	var groups []string
+	switch value := claims[o.GroupsClaim].(type) {
+	case string:
+		groups = []string{value}
+	case []any:
+		for _, group := range value {
+			if name, ok := group.(string); ok {
+				groups = append(groups, name)
+			}
+		}
+	}
+	for _, group := range groups {
+		if slices.Contains(o.AllowedGroups, group) {
+			return user, nil
+		}
+	}
+	return "", errors.New("user " + name + " is not in an allowed group")
+}
+
+func (o *OIDC) fail(w http.ResponseWriter, status int, message string, err error) {
+	log.Info().Err(err).Int("status", status).Msg(message)
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(&Response{
+		Message: message,
+	})
+}
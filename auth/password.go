@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against when the user does not exist, so that unknown users take as long as
+// known users with a wrong password.
+const dummyHash = "$2a$10$dj.DUYLqhkerl0i5wZap6.6OZytyQeRyFYvvNewjPy5GzPPOtsJ9C"
+
+// apr1Alphabet is the base64 alphabet used by crypt(3) style hashes.
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// argon2id hashes with more memory (KiB) or iterations are rejected, so that a malformed hash cannot
+// exhaust the server on every login.
+const (
+	argon2MaxMemory = 1 << 20
+	argon2MaxTime   = 16
+)
+
+// hashed checks if the stored password is a hash which verifyPassword recognises.
+func hashed(stored string) bool {
+	return isBcrypt(stored) ||
+		strings.HasPrefix(stored, "$argon2id$") ||
+		strings.HasPrefix(stored, "$apr1$") ||
+		strings.HasPrefix(stored, "{SHA}")
+}
+
+func isBcrypt(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// verifyPassword checks the password against the stored value in constant time. The stored value is
+// recognised by its prefix: bcrypt ($2a$, $2b$, $2y$), argon2id ($argon2id$), Apache htpasswd MD5 ($apr1$)
+// and SHA1 ({SHA}). Anything else is compared as plaintext.
+func verifyPassword(stored, password string) bool {
+	switch {
+	case isBcrypt(stored):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	case strings.HasPrefix(stored, "$argon2id$"):
+		return verifyArgon2id(stored, password)
+	case strings.HasPrefix(stored, "$apr1$"):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(stored, "$apr1$"), "$")
+		return subtle.ConstantTimeCompare([]byte(apr1(password, salt)), []byte(stored)) == 1
+	case strings.HasPrefix(stored, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte("{SHA}"+base64.StdEncoding.EncodeToString(sum[:])), []byte(stored)) == 1
+	default:
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	}
+}
+
+// VerifyPassword checks the password against a hash of HashPassword, e.g. of a room password. Unlike
+// the users file, plaintext is never accepted.
+func VerifyPassword(hash, password string) bool {
+	return hashed(hash) && verifyPassword(hash, password)
+}
+
+// verifyArgon2id checks the password against an argon2id hash in the PHC string format
+// $argon2id$v=19$m=65536,t=3,p=4$salt$hash.
+func verifyArgon2id(stored, password string) bool {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return false
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+	if time < 1 || time > argon2MaxTime || threads < 1 || memory < 8*uint32(threads) || memory > argon2MaxMemory {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(hash) == 0 {
+		return false
+	}
+	key := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(hash)))
+	return subtle.ConstantTimeCompare(key, hash) == 1
+}
+
+// apr1 computes the Apache htpasswd variant of the MD5 crypt hash.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alternate := md5.New()
+	alternate.Write(pw)
+	alternate.Write([]byte(salt))
+	alternate.Write(pw)
+	alt := alternate.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		ctx.Write(alt[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 == 1 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 == 1 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	var out strings.Builder
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	f := func(i int) uint32 { return uint32(final[i]) }
+	encode(f(0)<<16|f(6)<<8|f(12), 4)
+	encode(f(1)<<16|f(7)<<8|f(13), 4)
+	encode(f(2)<<16|f(8)<<8|f(14), 4)
+	encode(f(3)<<16|f(9)<<8|f(15), 4)
+	encode(f(4)<<16|f(10)<<8|f(5), 4)
+	encode(f(11), 2)
+	return magic + salt + "$" + out.String()
+}
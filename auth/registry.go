@@ -0,0 +1,391 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/boj/redistore.v1"
+)
+
+// sessionIdle is how long a login session without a max age is kept after it was last seen.
+const sessionIdle = 7 * 24 * time.Hour
+
+// saveInterval limits how often a persisted registry is written only because sessions were seen.
+const saveInterval = time.Minute
+
+// SessionInfo describes a login session.
+type SessionInfo struct {
+	ID       string    `json:"id"`
+	User     string    `json:"user"`
+	Provider string    `json:"provider"`
+	IP       string    `json:"ip"`
+	Created  time.Time `json:"created"`
+	LastSeen time.Time `json:"lastSeen"`
+	Current  bool      `json:"current,omitempty"` // Set when listing the sessions of a request
+}
+
+// registry keeps the active login sessions, so that they can be listed and revoked independent of the
+// session store. Sessions which are not in the registry are rejected. Like the login attempts, it lives
+// in redis if the session store is a redis store, otherwise in memory. The memory registry of the
+// filesystem store is saved in a file next to the sessions.
+type registry interface {
+	// add registers a new session.
+	add(info SessionInfo) error
+	// get returns an active session.
+	get(id string) (SessionInfo, bool, error)
+	// touch updates the last seen time and address of an active session.
+	touch(id, ip string) (SessionInfo, bool, error)
+	// list returns the active sessions of the user, of all users if user is empty.
+	list(user string) ([]SessionInfo, error)
+	// remove revokes a session.
+	remove(id string) error
+}
+
+// newRegistry creates the registry for the session store. Sessions expire after ttl, or sessionIdle after they
+// were last seen if ttl is zero.
+func newRegistry(store sessions.Store, ttl time.Duration) registry {
+	idle := ttl <= 0
+	if idle {
+		ttl = sessionIdle
+	}
+	if redisStore, ok := store.(*redistore.RediStore); ok {
+		return &redisRegistry{pool: redisStore.Pool, ttl: ttl, idle: idle}
+	}
+	m := &memoryRegistry{sessions: map[string]*SessionInfo{}, ttl: ttl, idle: idle}
+	if fsStore, ok := store.(*filesystemStore); ok {
+		m.path = fsStore.registryPath
+		if err := m.load(); err != nil {
+			log.Error().Err(err).Str("file", m.path).Msg("Failed to load login sessions, all users have to login again")
+		}
+	}
+	return m
+}
+
+// memoryRegistry keeps the sessions in memory for single instance deployments. Without a path the sessions
+// are lost on restart, so all users have to login again.
+type memoryRegistry struct {
+	lock     sync.Mutex
+	sessions map[string]*SessionInfo
+	ttl      time.Duration
+	idle     bool   // The ttl counts from the last time the session was seen
+	path     string // Optional, the JSON file the sessions are saved in
+}
+
+// load reads the saved sessions, a missing file is treated as empty.
+func (m *memoryRegistry) load() error {
+	content, err := os.ReadFile(m.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var infos []*SessionInfo
+	if err := json.Unmarshal(content, &infos); err != nil {
+		return err
+	}
+	for _, info := range infos {
+		m.sessions[info.ID] = info
+	}
+	m.prune()
+	log.Debug().Str("file", m.path).Int("sessions", len(m.sessions)).Msg("Loaded login sessions")
+	return nil
+}
+
+// save writes the sessions to the file if the registry has one, the lock must be held.
+func (m *memoryRegistry) save() error {
+	if m.path == "" {
+		return nil
+	}
+	infos := make([]*SessionInfo, 0, len(m.sessions))
+	for _, info := range m.sessions {
+		infos = append(infos, info)
+	}
+	content, err := json.Marshal(infos)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(m.path, content)
+}
+
+func (m *memoryRegistry) add(info SessionInfo) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.prune()
+	m.sessions[info.ID] = &info
+	if err := m.save(); err != nil {
+		delete(m.sessions, info.ID)
+		return err
+	}
+	return nil
+}
+
+func (m *memoryRegistry) get(id string) (SessionInfo, bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	info, ok := m.sessions[id]
+	if !ok || m.expired(info) {
+		return SessionInfo{}, false, nil
+	}
+	return *info, true, nil
+}
+
+func (m *memoryRegistry) touch(id, ip string) (SessionInfo, bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	info, ok := m.sessions[id]
+	if !ok || m.expired(info) {
+		delete(m.sessions, id)
+		return SessionInfo{}, false, nil
+	}
+	saved := info.LastSeen
+	info.LastSeen = time.Now()
+	info.IP = ip
+	if info.LastSeen.Sub(saved) > saveInterval {
+		if err := m.save(); err != nil {
+			log.Warn().Err(err).Str("file", m.path).Msg("Failed to save login sessions")
+		}
+	}
+	return *info, true, nil
+}
+
+func (m *memoryRegistry) list(user string) ([]SessionInfo, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.prune()
+	var infos []SessionInfo
+	for _, info := range m.sessions {
+		if user == "" || info.User == user {
+			infos = append(infos, *info)
+		}
+	}
+	sortSessions(infos)
+	return infos, nil
+}
+
+func (m *memoryRegistry) remove(id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	info, ok := m.sessions[id]
+	if !ok {
+		return nil
+	}
+	delete(m.sessions, id)
+	if err := m.save(); err != nil {
+		m.sessions[id] = info
+		return err
+	}
+	return nil
+}
+
+func (m *memoryRegistry) expired(info *SessionInfo) bool {
+	if m.idle {
+		return time.Since(info.LastSeen) > m.ttl
+	}
+	return time.Since(info.Created) > m.ttl
+}
+
+// prune removes the expired sessions, the lock must be held.
+func (m *memoryRegistry) prune() {
+	for id, info := range m.sessions {
+		if m.expired(info) {
+			delete(m.sessions, id)
+		}
+	}
+}
+
+// redisRegistry keeps every session as a JSON value which expires with the session, and the ids of the
+// sessions in a set per user and a set of all sessions. Ids of expired sessions are removed from the sets
+// when listing.
+type redisRegistry struct {
+	pool *redis.Pool
+	ttl  time.Duration
+	idle bool // The ttl counts from the last time the session was seen
+}
+
+func (r *redisRegistry) add(info SessionInfo) error {
+	value, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	conn := r.pool.Get()
+	defer conn.Close()
+	_ = conn.Send("MULTI")
+	_ = conn.Send("SET", "login_session_"+info.ID, value, "PX", r.ttl.Milliseconds())
+	_ = conn.Send("SADD", "login_sessions_"+info.User, info.ID)
+	_ = conn.Send("SADD", "login_sessions", info.ID)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (r *redisRegistry) get(id string) (SessionInfo, bool, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+	return r.read(conn, id)
+}
+
+func (r *redisRegistry) read(conn redis.Conn, id string) (SessionInfo, bool, error) {
+	value, err := redis.Bytes(conn.Do("GET", "login_session_"+id))
+	if err == redis.ErrNil {
+		return SessionInfo{}, false, nil
+	}
+	if err != nil {
+		return SessionInfo{}, false, err
+	}
+	var info SessionInfo
+	if err := json.Unmarshal(value, &info); err != nil {
+		return SessionInfo{}, false, err
+	}
+	return info, true, nil
+}
+
+func (r *redisRegistry) touch(id, ip string) (SessionInfo, bool, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+	info, ok, err := r.read(conn, id)
+	if !ok || err != nil {
+		return info, ok, err
+	}
+	info.LastSeen = time.Now()
+	info.IP = ip
+	value, err := json.Marshal(info)
+	if err != nil {
+		return SessionInfo{}, false, err
+	}
+	ttl := r.ttl.Milliseconds()
+	if !r.idle {
+		// The session keeps its expiry. PTTL and SET PX instead of SET KEEPTTL also work before Redis 6.
+		if ttl, err = redis.Int64(conn.Do("PTTL", "login_session_"+id)); err != nil {
+			return SessionInfo{}, false, err
+		}
+		if ttl <= 0 {
+			return SessionInfo{}, false, nil
+		}
+	}
+	_, err = conn.Do("SET", "login_session_"+id, value, "PX", ttl, "XX")
+	return info, true, err
+}
+
+func (r *redisRegistry) list(user string) ([]SessionInfo, error) {
+	set := "login_sessions"
+	if user != "" {
+		set = "login_sessions_" + user
+	}
+	conn := r.pool.Get()
+	defer conn.Close()
+	ids, err := redis.Strings(conn.Do("SMEMBERS", set))
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	keys := make([]interface{}, len(ids))
+	for i, id := range ids {
+		keys[i] = "login_session_" + id
+	}
+	values, err := redis.ByteSlices(conn.Do("MGET", keys...))
+	if err != nil {
+		return nil, err
+	}
+	var infos []SessionInfo
+	for i, value := range values {
+		if value == nil {
+			_, _ = conn.Do("SREM", set, ids[i])
+			continue
+		}
+		var info SessionInfo
+		if err := json.Unmarshal(value, &info); err == nil {
+			infos = append(infos, info)
+		}
+	}
+	sortSessions(infos)
+	return infos, nil
+}
+
+func (r *redisRegistry) remove(id string) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", "login_session_"+id)
+	return err
+}
+
+// ListSessions lists the login sessions of the logged-in user, the session of the request is marked as current.
+// Admins list the sessions of all users with the query parameter all=true.
+func (u *Users) ListSessions(w http.ResponseWriter, r *http.Request) {
+	current, ok := u.Session(r)
+	if !ok {
+		writeResponse(w, http.StatusUnauthorized, "You need to login")
+		return
+	}
+	user := current.User
+	if r.URL.Query().Get("all") == "true" {
+		if !hasRole(u.Roles(current.User), RoleAdmin) {
+			writeResponse(w, http.StatusForbidden, "Only admins can list the sessions of all users")
+			return
+		}
+		user = ""
+	}
+	infos, err := u.registry.list(user)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list login sessions")
+		writeResponse(w, http.StatusInternalServerError, "Login system error, please try again")
+		return
+	}
+	if infos == nil {
+		infos = []SessionInfo{}
+	}
+	for i := range infos {
+		infos[i].Current = infos[i].ID == current.ID
+	}
+	_ = json.NewEncoder(w).Encode(infos)
+}
+
+// RevokeSession revokes the login session with the id of the route and closes its connections. Users may
+// revoke their own sessions, admins any session.
+func (u *Users) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	current, ok := u.Session(r)
+	if !ok {
+		writeResponse(w, http.StatusUnauthorized, "You need to login")
+		return
+	}
+	id := mux.Vars(r)["id"]
+	info, ok, err := u.registry.get(id)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to look up the login session")
+		writeResponse(w, http.StatusInternalServerError, "Login system error, please try again")
+		return
+	}
+	if !ok || (info.User != current.User && !hasRole(u.Roles(current.User), RoleAdmin)) {
+		writeResponse(w, http.StatusNotFound, "Session not found")
+		return
+	}
+	if err := u.revoke(id); err != nil {
+		writeResponse(w, http.StatusInternalServerError, "Login system error, please try again")
+		return
+	}
+	log.Info().Str("user", current.User).Str("session", id).Str("owner", info.User).Msg("Revoked login session")
+	w.WriteHeader(200)
+}
+
+// revoke removes the login session from the registry and reports it to SessionsRevoked.
+func (u *Users) revoke(id string) error {
+	if err := u.registry.remove(id); err != nil {
+		log.Error().Err(err).Str("session", id).Msg("Failed to revoke the login session")
+		return err
+	}
+	if u.SessionsRevoked != nil {
+		u.SessionsRevoked([]string{id})
+	}
+	return nil
+}
+
+func sortSessions(infos []SessionInfo) {
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Created.Before(infos[j].Created) })
+}
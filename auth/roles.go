@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"strings"
+
+	"github.com/ezshare/server/config"
+)
+
+// The roles of authenticated users. The roles of a user are listed comma separated after the password in
+// the users file, users without roles get the default roles.
+const (
+	RoleAdmin  = "admin"
+	RoleHost   = "host"
+	RoleViewer = "viewer"
+)
+
+// Permission is an action in a room which can be restricted.
+type Permission string
+
+const (
+	PermissionCreate Permission = "create" // Create rooms
+	PermissionTurn   Permission = "turn"   // Create rooms relaying through the TURN server
+	PermissionShare  Permission = "share"  // Share the screen
+	PermissionJoin   Permission = "join"   // Join rooms
+)
+
+var rolePermissions = map[string][]Permission{
+	RoleAdmin:  {PermissionCreate, PermissionTurn, PermissionShare, PermissionJoin},
+	RoleHost:   {PermissionCreate, PermissionTurn, PermissionShare, PermissionJoin},
+	RoleViewer: {PermissionJoin},
+}
+
+// guestPermissions are the permissions of users who are not logged in, depending on the auth mode.
+var guestPermissions = map[string][]Permission{
+	config.AuthModeNone: {PermissionCreate, PermissionTurn, PermissionShare, PermissionJoin},
+	config.AuthModeTurn: {PermissionCreate, PermissionShare, PermissionJoin},
+	config.AuthModeAll:  {PermissionShare, PermissionJoin},
+}
+
+// ValidRole checks if the role is known.
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// Permissions returns what a client may do. Authenticated users are limited by their roles, guests by the auth mode.
+func Permissions(authMode string, authenticated bool, roles []string) []Permission {
+	if !authenticated {
+		return guestPermissions[authMode]
+	}
+	var permissions []Permission
+	for _, permission := range []Permission{PermissionCreate, PermissionTurn, PermissionShare, PermissionJoin} {
+		for _, role := range roles {
+			if hasPermission(rolePermissions[role], permission) {
+				permissions = append(permissions, permission)
+				break
+			}
+		}
+	}
+	return permissions
+}
+
+// Can reports if a client may do the action, see Permissions.
+func Can(authMode string, authenticated bool, roles []string, permission Permission) bool {
+	return hasPermission(Permissions(authMode, authenticated, roles), permission)
+}
+
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPermission(permissions []Permission, permission Permission) bool {
+	for _, p := range permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRoles parses the comma separated roles of the users file, unknown roles are returned separately.
+func parseRoles(value string) (roles, unknown []string) {
+	for _, role := range strings.Split(value, ",") {
+		role = strings.TrimSpace(role)
+		if role == "" {
+			continue
+		}
+		if ValidRole(role) {
+			roles = append(roles, role)
+		} else {
+			unknown = append(unknown, role)
+		}
+	}
+	return roles, unknown
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/ezshare/server/config"
+	"github.com/gorilla/sessions"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/boj/redistore.v1"
+)
+
+// NewSessionStore creates the session store selected by the config. The cookie store keeps the whole
+// session in a signed and encrypted cookie, the filesystem store keeps it in a file per session and the
+// login sessions in login_sessions.json next to them, and the redis store shares the sessions between
+// multiple instances. The cookies are HttpOnly and SameSite=Lax,
+// and only sent over HTTPS if the server uses TLS.
+func NewSessionStore(conf config.Config) (sessions.Store, error) {
+	options := &sessions.Options{
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   conf.ServerTLS,
+		SameSite: http.SameSiteLaxMode,
+	}
+	switch conf.SessionStore {
+	case config.SessionStoreRedis:
+		store, err := redistore.NewRediStore(10, "tcp", conf.RedisAddress, conf.RedisPass, conf.Secret)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to connect to redis.")
+			return nil, err
+		}
+		options.MaxAge = store.Options.MaxAge
+		store.Options = options
+		log.Debug().Str("address", conf.RedisAddress).Msg("Using redis session store")
+		return store, nil
+	case config.SessionStoreFilesystem:
+		if conf.SessionStorePath == "" {
+			return nil, errors.New("the filesystem session store needs a path")
+		}
+		if err := os.MkdirAll(conf.SessionStorePath, 0o700); err != nil {
+			return nil, err
+		}
+		log.Debug().Str("path", conf.SessionStorePath).Msg("Using filesystem session store")
+		store := sessions.NewFilesystemStore(conf.SessionStorePath, conf.Secret)
+		options.MaxAge = store.Options.MaxAge
+		store.Options = options
+		return &filesystemStore{FilesystemStore: store, registryPath: filepath.Join(conf.SessionStorePath, "login_sessions.json")}, nil
+	default:
+		log.Debug().Msg("Using cookie session store")
+		encryptionKey := sha256.Sum256(conf.Secret)
+		store := sessions.NewCookieStore(conf.Secret, encryptionKey[:])
+		options.MaxAge = store.Options.MaxAge
+		store.Options = options
+		return store, nil
+	}
+}
+
+// cookieOptions returns the default cookie options of the store for sessions created with sessions.NewSession.
+func cookieOptions(store sessions.Store) *sessions.Options {
+	options := sessions.Options{Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode}
+	switch store := store.(type) {
+	case *sessions.CookieStore:
+		options = *store.Options
+	case *sessions.FilesystemStore:
+		options = *store.Options
+	case *filesystemStore:
+		options = *store.Options
+	case *redistore.RediStore:
+		options = *store.Options
+	}
+	return &options
+}
+
+// filesystemStore is the filesystem session store with the file of its login sessions, so that they
+// survive restarts like the sessions.
+type filesystemStore struct {
+	*sessions.FilesystemStore
+	registryPath string
+}
@@ -0,0 +1,318 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrInvalidToken is returned for API tokens which are unknown, expired, revoked or belong to a removed user.
+var ErrInvalidToken = errors.New("invalid api token")
+
+// Token is an API token for non-browser clients. Only the SHA-256 hash of the secret is stored.
+type Token struct {
+	ID       string       `json:"id"`
+	User     string       `json:"user"`
+	Provider string       `json:"provider"`
+	Name     string       `json:"name"`
+	Scopes   []Permission `json:"scopes"`
+	Hash     string       `json:"hash,omitempty"`
+	Created  time.Time    `json:"created"`
+	Expires  time.Time    `json:"expires"`
+}
+
+// Tokens keeps the API tokens in a JSON file, which is rewritten atomically on every change.
+type Tokens struct {
+	lock   sync.Mutex
+	path   string
+	tokens map[string]*Token
+
+	MaxTTL time.Duration // The longest lifetime of a token
+}
+
+// LoadTokens loads the API tokens from the file, a missing file is treated as empty. Expired tokens are dropped.
+func LoadTokens(path string, maxTTL time.Duration) (*Tokens, error) {
+	t := &Tokens{path: path, tokens: map[string]*Token{}, MaxTTL: maxTTL}
+	content, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(content) > 0 {
+		var tokens []*Token
+		if err := json.Unmarshal(content, &tokens); err != nil {
+			return nil, err
+		}
+		for _, token := range tokens {
+			t.tokens[token.ID] = token
+		}
+	}
+	t.prune()
+	log.Debug().Str("file", path).Int("tokens", len(t.tokens)).Msg("Loaded api tokens")
+	return t, nil
+}
+
+// Issue creates a token for the user and returns it with its secret. The secret is only available here.
+func (t *Tokens) Issue(user, provider, name string, scopes []Permission, ttl time.Duration) (string, *Token, error) {
+	if ttl <= 0 || ttl > t.MaxTTL {
+		ttl = t.MaxTTL
+	}
+	id, err := randomString(8, hex.EncodeToString)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomString(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now()
+	token := &Token{
+		ID:       id,
+		User:     user,
+		Provider: provider,
+		Name:     name,
+		Scopes:   scopes,
+		Hash:     hashSecret(secret),
+		Created:  now,
+		Expires:  now.Add(ttl),
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.prune()
+	t.tokens[id] = token
+	if err := t.save(); err != nil {
+		delete(t.tokens, id)
+		return "", nil, err
+	}
+	return id + "." + secret, token, nil
+}
+
+// Verify returns the token of the secret if it is valid.
+func (t *Tokens) Verify(value string) (*Token, bool) {
+	id, secret, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, false
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	token, ok := t.tokens[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hashSecret(secret))) != 1 {
+		return nil, false
+	}
+	if time.Now().After(token.Expires) {
+		return nil, false
+	}
+	verified := *token
+	return &verified, true
+}
+
+// List returns the tokens of the user without their hashes, the tokens of all users if user is empty.
+func (t *Tokens) List(user string) []Token {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	tokens := []Token{}
+	for _, token := range t.tokens {
+		if (user == "" || token.User == user) && time.Now().Before(token.Expires) {
+			listed := *token
+			listed.Hash = ""
+			tokens = append(tokens, listed)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created.Before(tokens[j].Created) })
+	return tokens
+}
+
+// Get returns the token with the id.
+func (t *Tokens) Get(id string) (Token, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	token, ok := t.tokens[id]
+	if !ok {
+		return Token{}, false
+	}
+	return *token, true
+}
+
+// Revoke deletes the token with the id.
+func (t *Tokens) Revoke(id string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	token, ok := t.tokens[id]
+	if !ok {
+		return ErrInvalidToken
+	}
+	delete(t.tokens, id)
+	if err := t.save(); err != nil {
+		t.tokens[id] = token
+		return err
+	}
+	return nil
+}
+
+// prune drops the expired tokens, the lock must be held.
+func (t *Tokens) prune() {
+	now := time.Now()
+	for id, token := range t.tokens {
+		if now.After(token.Expires) {
+			delete(t.tokens, id)
+		}
+	}
+}
+
+// save writes the tokens to the file, the lock must be held.
+func (t *Tokens) save() error {
+	tokens := make([]*Token, 0, len(t.tokens))
+	for _, token := range t.tokens {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created.Before(tokens[j].Created) })
+	content, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(t.path, content)
+}
+
+// TokenUser returns the API token of the request, which is sent as "Authorization: Bearer <token>" or in the
+// token query parameter. If the request carries no token, nil is returned without an error.
+func (u *Users) TokenUser(r *http.Request) (*Token, error) {
+	value := r.URL.Query().Get("token")
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		value = strings.TrimPrefix(header, "Bearer ")
+	}
+	if value == "" {
+		return nil, nil
+	}
+	if u.Tokens == nil {
+		return nil, ErrInvalidToken
+	}
+	token, ok := u.Tokens.Verify(value)
+	if !ok || !u.known(token.User, token.Provider) {
+		log.Info().Str("ip", remoteIP(r)).Msg("Invalid api token")
+		return nil, ErrInvalidToken
+	}
+	log.Debug().Str("user", token.User).Str("token", token.ID).Msg("Got username from api token")
+	return token, nil
+}
+
+// CreateToken issues an API token for the logged-in user. The form values are the name of the token, the comma
+// separated scopes, which default to join and cannot exceed the permissions of the user, and the lifetime in
+// seconds as ttl, which is capped at the longest lifetime. The token is only returned in this response.
+func (u *Users) CreateToken(w http.ResponseWriter, r *http.Request) {
+	session, ok := u.Session(r)
+	if !ok {
+		writeResponse(w, http.StatusUnauthorized, "You need to login")
+		return
+	}
+	user := session.User
+
+	value := r.FormValue("scopes")
+	if value == "" {
+		value = string(PermissionJoin)
+	}
+	allowed := Permissions("", true, u.Roles(user))
+	var scopes []Permission
+	for _, scope := range strings.Split(value, ",") {
+		scope := Permission(strings.TrimSpace(scope))
+		if !hasPermission(allowed, scope) {
+			writeResponse(w, http.StatusBadRequest, "Scope "+string(scope)+" is unknown or not allowed")
+			return
+		}
+		scopes = append(scopes, scope)
+	}
+	var ttl time.Duration
+	if value := r.FormValue("ttl"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			writeResponse(w, http.StatusBadRequest, "Invalid ttl")
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	secret, token, err := u.Tokens.Issue(user, session.Provider, r.FormValue("name"), scopes, ttl)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to issue api token")
+		writeResponse(w, http.StatusInternalServerError, "Login system error, please try again")
+		return
+	}
+	log.Info().Str("user", user).Str("token", token.ID).Interface("scopes", scopes).Time("expires", token.Expires).Msg("Issued api token")
+	listed := *token
+	listed.Hash = ""
+	_ = json.NewEncoder(w).Encode(struct {
+		Token
+		Secret string `json:"token"`
+	}{Token: listed, Secret: secret})
+}
+
+// ListTokens lists the API tokens of the logged-in user. Like CreateToken, it requires a login session.
+func (u *Users) ListTokens(w http.ResponseWriter, r *http.Request) {
+	session, ok := u.Session(r)
+	if !ok {
+		writeResponse(w, http.StatusUnauthorized, "You need to login")
+		return
+	}
+	_ = json.NewEncoder(w).Encode(u.Tokens.List(session.User))
+}
+
+// RevokeToken revokes the API token with the id of the route and closes its connections. Users may revoke
+// their own tokens, admins any token. Like CreateToken, it requires a login session.
+func (u *Users) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	session, ok := u.Session(r)
+	if !ok {
+		writeResponse(w, http.StatusUnauthorized, "You need to login")
+		return
+	}
+	user := session.User
+	id := mux.Vars(r)["id"]
+	token, ok := u.Tokens.Get(id)
+	if !ok || (token.User != user && !hasRole(u.Roles(user), RoleAdmin)) {
+		writeResponse(w, http.StatusNotFound, "Token not found")
+		return
+	}
+	if err := u.Tokens.Revoke(id); err != nil {
+		log.Error().Err(err).Msg("Failed to revoke api token")
+		writeResponse(w, http.StatusInternalServerError, "Login system error, please try again")
+		return
+	}
+	if u.TokensRevoked != nil {
+		u.TokensRevoked([]string{id})
+	}
+	log.Info().Str("user", user).Str("token", id).Str("owner", token.User).Msg("Revoked api token")
+	w.WriteHeader(200)
+}
+
+// writeResponse writes the status with the message.
+func writeResponse(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(&Response{
+		Message: message,
+	})
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(n int, encode func([]byte) string) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encode(b), nil
+}
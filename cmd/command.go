@@ -17,6 +17,7 @@ func Run() {
 			Aliases: []string{"s"},
 			Action:  Start,
 		},
+		usersCommand,
 	}
 
 	err := app.Run(os.Args)
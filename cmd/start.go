@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"github.com/ezshare/server/auth"
 	"github.com/ezshare/server/config"
 	"github.com/ezshare/server/router"
@@ -9,6 +10,7 @@ import (
 	"github.com/ezshare/server/ws"
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli"
+	"time"
 )
 
 func Start(ctx *cli.Context) {
@@ -18,23 +20,76 @@ func Start(ctx *cli.Context) {
 		return
 	}
 
-	users, err := auth.LoadUsersFile(c.UsersFile, c.RedisAddress, c.RedisPass, c.Secret, c.SessionTimeoutSeconds)
+	store, err := auth.NewSessionStore(*c)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create session store")
+		return
+	}
+
+	users, err := auth.LoadUsersFile(c.UsersFile, store, auth.NewLoginLimiter(*c, store), c.SessionTimeoutSeconds)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to load users file")
 		return
 	}
 
-	turnServer, err := turn.Start(c)
+	for _, role := range c.DefaultRoles {
+		if !auth.ValidRole(role) {
+			log.Error().Str("role", role).Msg("Unknown role in EZSHARE_DEFAULT_ROLES")
+			return
+		}
+	}
+	users.DefaultRoles = c.DefaultRoles
+
+	tlsConfig, err := auth.ClientCertTLSConfig(*c)
 	if err != nil {
-		log.Error().Err(err).Msg("Could not start turn server")
+		log.Error().Err(err).Msg("Failed to load client certificate CA bundle")
 		return
 	}
+	if tlsConfig != nil {
+		users.ClientCertUsername = c.TLSClientUsername
+		users.ClientCertUsers = c.TLSClientUsers
+	}
+
+	if c.TokensFile != "" {
+		users.Tokens, err = auth.LoadTokens(c.TokensFile, time.Duration(c.TokenMaxTTLSeconds)*time.Second)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to load api tokens")
+			return
+		}
+	}
+
+	var oidc *auth.OIDC
+	if c.OIDC() {
+		oidc, err = auth.NewOIDC(context.Background(), *c, users)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to discover OpenID Connect issuer")
+			return
+		}
+	}
+
+	var turnServer turn.Server
+	if c.TurnMode == config.TurnModeExternal {
+		turnServer = &turn.ExternalServer{
+			Secret: []byte(c.TurnExternalSecret),
+			TTL:    time.Duration(c.TurnCredentialTTLSeconds) * time.Second,
+		}
+		log.Info().Strs("urls", c.TurnExternalURLs).Msg("Using external turn server")
+	} else {
+		turnServer, err = turn.Start(c)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not start turn server")
+			return
+		}
+	}
 
 	rooms := ws.NewRooms(turnServer, users, *c)
+	users.SessionsRevoked = rooms.RevokeSessions
+	users.TokensRevoked = rooms.RevokeTokens
 	go rooms.Start()
+	go users.Watch(time.Duration(c.UsersFileWatchSeconds)*time.Second, rooms.RemoveUsers)
 
-	r := router.Router(*c, rooms, users)
-	err = server.Start(r, c.ServerAddress, c.TLSCertFile, c.TLSKeyFile)
+	r := router.Router(*c, rooms, users, oidc)
+	err = server.Start(r, c.ServerAddress, c.TLSCertFile, c.TLSKeyFile, tlsConfig)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to start http server")
 		return
@@ -0,0 +1,293 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/ezshare/server/auth"
+	"github.com/ezshare/server/config"
+	"github.com/urfave/cli"
+	"golang.org/x/term"
+	"os"
+	"strings"
+)
+
+// usersFileFlag selects the users file, it defaults to EZSHARE_USERS_FILE of the config file.
+var usersFileFlag = cli.StringFlag{
+	Name:  "file, f",
+	Usage: "the users file, defaults to EZSHARE_USERS_FILE or ./users",
+}
+
+// rolesFlag sets the comma separated roles of a user, no roles means EZSHARE_DEFAULT_ROLES.
+var rolesFlag = cli.StringFlag{
+	Name:  "roles, r",
+	Usage: "the comma separated roles admin, host or viewer, defaults to EZSHARE_DEFAULT_ROLES",
+}
+
+// usersCommand manages the users file read by auth.LoadUsersFile.
+var usersCommand = cli.Command{
+	Name:  "users",
+	Usage: "Manage the users file",
+	Subcommands: []cli.Command{
+		{
+			Name:      "add",
+			Usage:     "Add a user",
+			ArgsUsage: "<name>",
+			Flags:     []cli.Flag{usersFileFlag, rolesFlag},
+			Action:    UsersAdd,
+		},
+		{
+			Name:      "passwd",
+			Usage:     "Change the password of a user",
+			ArgsUsage: "<name>",
+			Flags:     []cli.Flag{usersFileFlag},
+			Action:    UsersPasswd,
+		},
+		{
+			Name:      "remove",
+			Usage:     "Remove a user",
+			Aliases:   []string{"rm"},
+			ArgsUsage: "<name>",
+			Flags:     []cli.Flag{usersFileFlag},
+			Action:    UsersRemove,
+		},
+		{
+			Name:      "roles",
+			Usage:     "Show or set the roles of a user",
+			ArgsUsage: "<name> [admin|host|viewer,...]",
+			Flags:     []cli.Flag{usersFileFlag},
+			Action:    UsersRoles,
+		},
+		{
+			Name:      "totp",
+			Usage:     "Enroll a new TOTP secret for two-factor authentication and print its otpauth URI",
+			ArgsUsage: "<name>",
+			Flags: []cli.Flag{usersFileFlag, cli.BoolFlag{
+				Name:  "disable, d",
+				Usage: "remove the TOTP secret instead",
+			}},
+			Action: UsersTOTP,
+		},
+		{
+			Name:   "list",
+			Usage:  "List the users",
+			Flags:  []cli.Flag{usersFileFlag},
+			Action: UsersList,
+		},
+	},
+}
+
+// UsersAdd adds a user with a prompted password.
+func UsersAdd(ctx *cli.Context) error {
+	file, name, err := openUsersFile(ctx, true)
+	if err != nil {
+		return err
+	}
+	if file.Has(name) {
+		return fmt.Errorf("user %s already exists", name)
+	}
+	roles, err := parseRoles(ctx.String("roles"))
+	if err != nil {
+		return err
+	}
+	if err := setPassword(file, name); err != nil {
+		return err
+	}
+	file.SetRoles(name, roles)
+	if err := file.Save(); err != nil {
+		return err
+	}
+	fmt.Printf("Added user %s\n", name)
+	return nil
+}
+
+// UsersPasswd changes the password of an existing user.
+func UsersPasswd(ctx *cli.Context) error {
+	file, name, err := openUsersFile(ctx, true)
+	if err != nil {
+		return err
+	}
+	if !file.Has(name) {
+		return fmt.Errorf("user %s not found", name)
+	}
+	if err := setPassword(file, name); err != nil {
+		return err
+	}
+	if err := file.Save(); err != nil {
+		return err
+	}
+	fmt.Printf("Changed password of user %s\n", name)
+	return nil
+}
+
+// UsersRemove removes a user.
+func UsersRemove(ctx *cli.Context) error {
+	file, name, err := openUsersFile(ctx, true)
+	if err != nil {
+		return err
+	}
+	if !file.Remove(name) {
+		return fmt.Errorf("user %s not found", name)
+	}
+	if err := file.Save(); err != nil {
+		return err
+	}
+	fmt.Printf("Removed user %s\n", name)
+	return nil
+}
+
+// UsersRoles prints the roles of a user, or sets them if they are given.
+func UsersRoles(ctx *cli.Context) error {
+	file, name, err := openUsersFile(ctx, true)
+	if err != nil {
+		return err
+	}
+	if !file.Has(name) {
+		return fmt.Errorf("user %s not found", name)
+	}
+	if len(ctx.Args()) < 2 {
+		fmt.Println(strings.Join(file.Roles(name), ","))
+		return nil
+	}
+	roles, err := parseRoles(ctx.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	file.SetRoles(name, roles)
+	if err := file.Save(); err != nil {
+		return err
+	}
+	fmt.Printf("Set roles of user %s to %s\n", name, strings.Join(roles, ","))
+	return nil
+}
+
+// UsersTOTP enrolls a new TOTP secret for a user, which replaces an existing secret, and prints the otpauth
+// URI for authenticator apps. With --disable the secret is removed.
+func UsersTOTP(ctx *cli.Context) error {
+	file, name, err := openUsersFile(ctx, true)
+	if err != nil {
+		return err
+	}
+	if !file.Has(name) {
+		return fmt.Errorf("user %s not found", name)
+	}
+	if ctx.Bool("disable") {
+		file.SetTOTP(name, "")
+		if err := file.Save(); err != nil {
+			return err
+		}
+		fmt.Printf("Disabled two-factor authentication of user %s\n", name)
+		return nil
+	}
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		return err
+	}
+	file.SetTOTP(name, secret)
+	if err := file.Save(); err != nil {
+		return err
+	}
+	fmt.Printf("Enrolled two-factor authentication of user %s, add it to an authenticator app:\n", name)
+	fmt.Println(auth.TOTPURI("ezshare", name, secret))
+	return nil
+}
+
+// UsersList prints the names of all users with their roles, and totp for users with two-factor authentication.
+func UsersList(ctx *cli.Context) error {
+	file, _, err := openUsersFile(ctx, false)
+	if err != nil {
+		return err
+	}
+	for _, name := range file.Users() {
+		fields := []string{name}
+		if roles := file.Roles(name); len(roles) > 0 {
+			fields = append(fields, strings.Join(roles, ","))
+		}
+		if file.TOTP(name) != "" {
+			fields = append(fields, "totp")
+		}
+		fmt.Println(strings.Join(fields, " "))
+	}
+	return nil
+}
+
+// parseRoles parses comma separated roles and rejects unknown roles.
+func parseRoles(value string) ([]string, error) {
+	var roles []string
+	for _, role := range strings.Split(value, ",") {
+		role = strings.TrimSpace(role)
+		if role == "" {
+			continue
+		}
+		if !auth.ValidRole(role) {
+			return nil, fmt.Errorf("unknown role %s", role)
+		}
+		roles = append(roles, role)
+	}
+	return roles, nil
+}
+
+// openUsersFile opens the selected users file, and returns the user name argument if required.
+func openUsersFile(ctx *cli.Context, withName bool) (*auth.UsersFile, string, error) {
+	name := ctx.Args().First()
+	if withName && !auth.ValidUsername(name) {
+		return nil, "", errors.New("a user name without colons, quotes and whitespace is required")
+	}
+
+	path := ctx.String("file")
+	if path == "" {
+		if err := config.LoadEnvFiles(); err != nil {
+			return nil, "", err
+		}
+		path = os.Getenv("EZSHARE_USERS_FILE")
+	}
+	if path == "" {
+		path = "./users"
+	}
+	file, err := auth.OpenUsersFile(path)
+	return file, name, err
+}
+
+// setPassword prompts for the password of the user and sets its hash.
+func setPassword(file *auth.UsersFile, name string) error {
+	password, err := promptPassword(fmt.Sprintf("Password for %s: ", name))
+	if err != nil {
+		return err
+	}
+	if password == "" {
+		return errors.New("the password must not be empty")
+	}
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		repeated, err := promptPassword("Repeat password: ")
+		if err != nil {
+			return err
+		}
+		if repeated != password {
+			return errors.New("the passwords do not match")
+		}
+	}
+
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	file.SetPassword(name, hash)
+	return nil
+}
+
+// promptPassword reads a password without echoing it. If stdin is no terminal, a line is read from it
+// so that passwords can be piped in by scripts.
+func promptPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return string(password), err
+}
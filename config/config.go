@@ -8,11 +8,13 @@ import (
 	"github.com/joho/godotenv"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/rs/zerolog/log"
+	"net"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -26,51 +28,115 @@ const (
 	AuthModeNone = "none"
 )
 
+const (
+	SessionStoreCookie     = "cookie"
+	SessionStoreFilesystem = "filesystem"
+	SessionStoreRedis      = "redis"
+)
+
+const (
+	ClientAuthNone     = "none"
+	ClientAuthOptional = "optional"
+	ClientAuthRequired = "required"
+)
+
+const (
+	ClientUsernameCN  = "cn"
+	ClientUsernameSAN = "san"
+)
+
+const (
+	TurnModeInternal = "internal"
+	TurnModeHMAC     = "hmac"
+	TurnModeExternal = "external"
+)
+
 type Config struct {
-	ExternalIP []string `split_words:"true"`
+	ExternalIP               []string `split_words:"true"`
+	ExternalIPRefreshSeconds int      `default:"60" split_words:"true"`
 
 	ServerTLS             bool   `split_words:"true"`
 	ServerAddress         string `default:":5050" split_words:"true"`
 	Secret                []byte `split_words:"true"`
 	SessionTimeoutSeconds int    `default:"0" split_words:"true"`
 
-	TurnAddress    string      `default:":3478" required:"true" split_words:"true"`
-	TurnPort       string      `ignored:"true"`
-	TurnPortRange  string      `split_words:"true"`
-	TurnRealm      string      `default:"ezshare" split_words:"true"`
-	TurnIPProvider ip.Provider `ignored:"true"`
-
-	AuthMode                 string            `default:"turn" split_words:"true"`
-	TLSCertFile              string            `split_words:"true"`
-	TLSKeyFile               string            `split_words:"true"`
-	CorsAllowedOrigins       []string          `split_words:"true"`
-	CheckOrigin              func(string) bool `ignored:"true" json:"-"`
-	UsersFile                string            `split_words:"true"`
-	CloseRoomWhenOwnerLeaves bool              `default:"true" split_words:"true"`
-	Version                  string            `default:"1.0"`
-	RedisAddress             string            `default:":6379" required:"true" split_words:"true"`
-	RedisPass                string            `split_words:"true" required:"true"`
+	TurnAddress                   string      `default:":3478" required:"true" split_words:"true"`
+	TurnPort                      string      `ignored:"true"`
+	TurnPortRange                 string      `split_words:"true"`
+	TurnRelayBindAddress          string      `split_words:"true"`
+	TurnRelayAddress              string      `split_words:"true"`
+	TurnRealm                     string      `default:"ezshare" split_words:"true"`
+	TurnIPProvider                ip.Provider `ignored:"true"`
+	TurnMode                      string      `default:"internal" split_words:"true"`
+	TurnCredentialTTLSeconds      int         `default:"86400" split_words:"true"`
+	TurnExternalURLs              []string    `split_words:"true"`
+	TurnExternalSecret            string      `split_words:"true"`
+	TurnPeerAllow                 []string    `split_words:"true"`
+	TurnPeerDeny                  []string    `split_words:"true"`
+	TurnPeerDenyPrivate           bool        `default:"true" split_words:"true"`
+	TurnQuotaBytesPerSecond       int64       `split_words:"true"`
+	TurnQuotaTotalBytes           int64       `split_words:"true"`
+	TurnQuotaAllocations          int         `split_words:"true"`
+	TurnUserQuotaBytesPerSecond   int64       `split_words:"true"`
+	TurnUserQuotaTotalBytes       int64       `split_words:"true"`
+	TurnUserQuotaAllocations      int         `split_words:"true"`
+	TurnGlobalQuotaBytesPerSecond int64       `split_words:"true"`
+	TurnGlobalQuotaAllocations    int         `split_words:"true"`
+	TurnAuditLog                  string      `split_words:"true"`
+	TurnTLSAddress                string      `split_words:"true"`
+	TurnTLSPort                   string      `ignored:"true"`
+	TurnTLSHost                   string      `split_words:"true"`
+	TurnTLSCertFile               string      `split_words:"true"`
+	TurnTLSKeyFile                string      `split_words:"true"`
+
+	AuthMode                  string            `default:"turn" split_words:"true"`
+	TLSCertFile               string            `split_words:"true"`
+	TLSKeyFile                string            `split_words:"true"`
+	TLSClientAuth             string            `default:"none" split_words:"true"`
+	TLSClientCAFile           string            `split_words:"true"`
+	TLSClientUsername         string            `default:"cn" split_words:"true"`
+	TLSClientUsers            []string          `split_words:"true"`
+	CorsAllowedOrigins        []string          `split_words:"true"`
+	CheckOrigin               func(string) bool `ignored:"true" json:"-"`
+	UsersFile                 string            `split_words:"true"`
+	UsersFileWatchSeconds     int               `default:"5" split_words:"true"`
+	DefaultRoles              []string          `default:"host" split_words:"true"`
+	TokensFile                string            `split_words:"true"`
+	TokenMaxTTLSeconds        int               `default:"7776000" split_words:"true"`
+	CloseRoomWhenOwnerLeaves  bool              `default:"true" split_words:"true"`
+	JoinRequestTimeoutSeconds int               `default:"120" split_words:"true"`
+	Version                   string            `default:"1.0"`
+	LoginMaxAttempts          int               `default:"5" split_words:"true"`
+	LoginMaxAttemptsPerIP     int               `default:"20" split_words:"true"`
+	LoginLockoutSeconds       int               `default:"30" split_words:"true"`
+	LoginMaxLockoutSeconds    int               `default:"3600" split_words:"true"`
+	LoginAttemptWindowSeconds int               `default:"900" split_words:"true"`
+	OIDCIssuer                string            `split_words:"true"`
+	OIDCClientID              string            `split_words:"true"`
+	OIDCClientSecret          string            `split_words:"true"`
+	OIDCRedirectURL           string            `split_words:"true"`
+	OIDCScopes                []string          `default:"openid,profile,email" split_words:"true"`
+	OIDCUsernameClaim         string            `default:"preferred_username" split_words:"true"`
+	OIDCGroupsClaim           string            `default:"groups" split_words:"true"`
+	OIDCAllowedGroups         []string          `split_words:"true"`
+	SessionStore              string            `default:"cookie" split_words:"true"`
+	SessionStorePath          string            `split_words:"true"`
+	RedisAddress              string            `default:":6379" split_words:"true"`
+	RedisPass                 string            `split_words:"true"`
 }
 
-// LoadConfig according to the start mode to determine the directory of
-// the config file. If the start mode is Dev, the wording directory will
-// be chosen. If Prod, is executable directory.
-//
-// When getting the config file path, it tries to load the config file in
-// the order of the files slice. If the file is found, it will load the
-// file to the environment variables. Then it will process the environment
-// variables to generate Config.
-func LoadConfig() (*Config, error) {
+// LoadEnvFiles loads the first existing config file into the environment.
+func LoadEnvFiles() error {
 	log.Debug().Msg("Begin to load config file...")
 	dir, err := workOrExecAbsDir()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	for _, file := range configFilePath(dir) {
 		_, existErr := os.Stat(file)
 		if existErr == nil {
 			if err := godotenv.Load(file); err != nil {
-				return nil, err
+				return err
 			}
 			log.Debug().Str("file", file).Msg("Config file loaded")
 			break
@@ -79,6 +145,21 @@ func LoadConfig() (*Config, error) {
 			continue
 		}
 	}
+	return nil
+}
+
+// LoadConfig according to the start mode to determine the directory of
+// the config file. If the start mode is Dev, the wording directory will
+// be chosen. If Prod, is executable directory.
+//
+// When getting the config file path, it tries to load the config file in
+// the order of the files slice. If the file is found, it will load the
+// file to the environment variables. Then it will process the environment
+// variables to generate Config.
+func LoadConfig() (*Config, error) {
+	if err := LoadEnvFiles(); err != nil {
+		return nil, err
+	}
 
 	log.Debug().Msg("Begin to process env config...")
 	config := &Config{}
@@ -93,6 +174,57 @@ func LoadConfig() (*Config, error) {
 	}
 	log.Debug().Msg("Auth mode checked")
 
+	log.Debug().Msg("Begin to check session store")
+	if config.SessionStore != SessionStoreCookie && config.SessionStore != SessionStoreFilesystem && config.SessionStore != SessionStoreRedis {
+		return nil, errors.New("invalid session store " + config.SessionStore)
+	}
+	if config.SessionStore == SessionStoreRedis && config.RedisAddress == "" {
+		return nil, errors.New("EZSHARE_REDIS_ADDRESS must be set if the redis session store is used")
+	}
+	if config.SessionStore == SessionStoreFilesystem && config.SessionStorePath == "" {
+		// The default of the filesystem store is the shared temporary directory, which other local users can write.
+		return nil, errors.New("EZSHARE_SESSION_STORE_PATH must be set if the filesystem session store is used")
+	}
+	if config.SessionStore == SessionStoreFilesystem && config.SessionTimeoutSeconds <= 0 {
+		// The filesystem store deletes sessions without a max age instead of keeping them for the browser session.
+		return nil, errors.New("EZSHARE_SESSION_TIMEOUT_SECONDS must be positive if the filesystem session store is used")
+	}
+	if (config.LoginMaxAttempts > 0 || config.LoginMaxAttemptsPerIP > 0) && (config.LoginLockoutSeconds <= 0 || config.LoginAttemptWindowSeconds <= 0) {
+		return nil, errors.New("EZSHARE_LOGIN_LOCKOUT_SECONDS and EZSHARE_LOGIN_ATTEMPT_WINDOW_SECONDS must be positive if login attempts are limited")
+	}
+	log.Debug().Msg("Session store checked")
+
+	if config.TokensFile != "" && config.TokenMaxTTLSeconds <= 0 {
+		return nil, errors.New("EZSHARE_TOKEN_MAX_TTL_SECONDS must be positive if EZSHARE_TOKENS_FILE is set")
+	}
+	if config.OIDC() && (config.OIDCClientID == "" || config.OIDCRedirectURL == "") {
+		return nil, errors.New("EZSHARE_OIDC_CLIENT_ID and EZSHARE_OIDC_REDIRECT_URL must be set if EZSHARE_OIDC_ISSUER is set")
+	}
+
+	if config.JoinRequestTimeoutSeconds <= 0 {
+		return nil, errors.New("EZSHARE_JOIN_REQUEST_TIMEOUT_SECONDS must be positive")
+	}
+
+	log.Debug().Msg("Begin to check turn mode")
+	if config.TurnMode != TurnModeInternal && config.TurnMode != TurnModeHMAC && config.TurnMode != TurnModeExternal {
+		return nil, errors.New("invalid turn mode " + config.TurnMode)
+	}
+	if config.TurnMode != TurnModeInternal && config.TurnCredentialTTLSeconds <= 0 {
+		return nil, errors.New("EZSHARE_TURN_CREDENTIAL_TTL_SECONDS must be positive in " + config.TurnMode + " turn mode")
+	}
+	if config.TurnMode == TurnModeHMAC && len(config.Secret) == 0 {
+		return nil, errors.New("EZSHARE_SECRET must be set in hmac turn mode, credentials signed with a random secret are invalid after a restart and on other instances")
+	}
+	if config.TurnMode == TurnModeExternal {
+		if len(config.TurnExternalURLs) == 0 {
+			return nil, errors.New("EZSHARE_TURN_EXTERNAL_URLS must be set in external turn mode")
+		}
+		if config.TurnExternalSecret == "" {
+			return nil, errors.New("EZSHARE_TURN_EXTERNAL_SECRET must be set in external turn mode")
+		}
+	}
+	log.Debug().Msg("Turn mode checked")
+
 	log.Debug().Msg("Begin to check TLS settings...")
 	if config.ServerTLS {
 		if config.TLSCertFile == "" {
@@ -102,6 +234,34 @@ func LoadConfig() (*Config, error) {
 			return nil, errors.New("EZSHARE_TLS_KEY_FILE must be set if TLS is enabled")
 		}
 	}
+	if config.TLSClientAuth != ClientAuthNone && config.TLSClientAuth != ClientAuthOptional && config.TLSClientAuth != ClientAuthRequired {
+		return nil, errors.New("invalid tls client auth " + config.TLSClientAuth)
+	}
+	if config.TLSClientAuth != ClientAuthNone {
+		if !config.ServerTLS {
+			return nil, errors.New("EZSHARE_SERVER_TLS must be enabled for client certificates")
+		}
+		if config.TLSClientCAFile == "" {
+			return nil, errors.New("EZSHARE_TLS_CLIENT_CA_FILE must be set for client certificates")
+		}
+		if config.TLSClientUsername != ClientUsernameCN && config.TLSClientUsername != ClientUsernameSAN {
+			return nil, errors.New("invalid tls client username " + config.TLSClientUsername)
+		}
+	}
+	if config.TurnTLSAddress != "" && config.TurnMode != TurnModeExternal {
+		if config.TurnTLSCertFile == "" && config.TurnTLSKeyFile == "" {
+			config.TurnTLSCertFile = config.TLSCertFile
+			config.TurnTLSKeyFile = config.TLSKeyFile
+		}
+		if config.TurnTLSCertFile == "" || config.TurnTLSKeyFile == "" {
+			return nil, errors.New("EZSHARE_TURN_TLS_CERT_FILE and EZSHARE_TURN_TLS_KEY_FILE or EZSHARE_TLS_CERT_FILE and EZSHARE_TLS_KEY_FILE must be set if TURN TLS is enabled")
+		}
+		_, port, err := net.SplitHostPort(config.TurnTLSAddress)
+		if err != nil {
+			return nil, fmt.Errorf("invalid turn tls address: %s", err)
+		}
+		config.TurnTLSPort = port
+	}
 	log.Debug().Msg("TLS settings checked")
 
 	if len(config.Secret) == 0 {
@@ -135,8 +295,17 @@ func LoadConfig() (*Config, error) {
 	}
 	log.Debug().Msg("CORS check function generated")
 
+	if config.TurnMode == TurnModeExternal {
+		// The external TURN server advertises its own addresses, neither the
+		// external ip nor the port range is needed.
+		config.TurnIPProvider = &ip.Static{}
+		log.Debug().Strs("urls", config.TurnExternalURLs).Msg("Using external TURN server")
+		log.Debug().Msg("All config loaded")
+		return config, nil
+	}
+
 	log.Debug().Msg("Begin to generate IP provider...")
-	turnIPProvider, err := parseIPProvider(config.ExternalIP)
+	turnIPProvider, err := parseIPProvider(config.ExternalIP, time.Duration(config.ExternalIPRefreshSeconds)*time.Second)
 	if err != nil {
 		return nil, err
 	}
@@ -149,6 +318,18 @@ func LoadConfig() (*Config, error) {
 	config.TurnPort = strings.Split(config.TurnAddress, ":")[1]
 	log.Debug().Msg("IP provider generated")
 
+	if config.TurnRelayBindAddress != "" {
+		// A static relay address binds to a single local address, e.g. behind a 1:1 NAT,
+		// and does not need a port range.
+		log.Debug().Msg("Begin to check static relay address...")
+		if net.ParseIP(config.TurnRelayAddress) == nil {
+			return nil, errors.New("EZSHARE_TURN_RELAY_ADDRESS must be a valid ip if EZSHARE_TURN_RELAY_BIND_ADDRESS is set")
+		}
+		log.Debug().Msg("Static relay address checked")
+		log.Debug().Msg("All config loaded")
+		return config, nil
+	}
+
 	log.Debug().Msg("Begin to parse port range...")
 	minport, maxport, err := config.parsePortRange()
 	if err != nil {
@@ -225,6 +406,16 @@ func (c *Config) parsePortRange() (uint16, uint16, error) {
 	return uint16(min64), uint16(max64), nil
 }
 
+// OIDC reports whether users can sign in with OpenID Connect.
+func (c *Config) OIDC() bool {
+	return c.OIDCIssuer != ""
+}
+
+// TurnTLS reports whether the TURN server accepts TLS connections.
+func (c *Config) TurnTLS() bool {
+	return c.TurnTLSPort != ""
+}
+
 // PortRange provides externally accessible ports for TURN.
 func (c *Config) PortRange() (uint16, uint16, bool) {
 	m, mm, _ := c.parsePortRange()
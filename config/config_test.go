@@ -2,7 +2,11 @@ package config
 
 import (
 	"github.com/rs/zerolog/log"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestExecutablePath(t *testing.T) {
@@ -27,3 +31,30 @@ func TestConfigFilePath(t *testing.T) {
 	configFilePaths := configFilePath(path)
 	log.Info().Strs("files", configFilePaths).Msg("Config files")
 }
+
+func TestParseIPProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("203.0.113.7\n2001:db8::7\n"))
+	}))
+	defer server.Close()
+
+	for _, ips := range [][]string{{"203.0.113.7", "2001:db8::7"}, {server.URL}} {
+		provider, err := parseIPProvider(ips, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v4, v6, err := provider.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !v4.Equal(net.ParseIP("203.0.113.7")) || !v6.Equal(net.ParseIP("2001:db8::7")) {
+			t.Fatalf("unexpected ips %s %s for %v", v4, v6, ips)
+		}
+	}
+
+	for _, ips := range [][]string{{"dns:"}, {"dns:example.com", "203.0.113.7"}, {"not an ip"}} {
+		if _, err := parseIPProvider(ips, time.Minute); err == nil {
+			t.Fatalf("expected error for %v", ips)
+		}
+	}
+}
@@ -4,15 +4,28 @@ import (
 	"errors"
 	"github.com/ezshare/server/config/ip"
 	"net"
+	"strings"
+	"time"
 )
 
-func parseIPProvider(ips []string) (ip.Provider, error) {
+func parseIPProvider(ips []string, refresh time.Duration) (ip.Provider, error) {
 	if len(ips) == 0 {
 		return nil, errors.New("must have at least one ip")
 	} else if len(ips) > 2 {
 		return nil, errors.New("too many ips supplied")
 	}
 
+	dynamic, ok, err := parseIPDynamic(ips[0])
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if len(ips) != 1 {
+			return nil, errors.New("invalid ips: a dynamic ip provider must be the only external ip")
+		}
+		return &ip.Cached{Provider: dynamic, Refresh: refresh}, nil
+	}
+
 	static, err := parseIPStatic(ips)
 	if err != nil {
 		return nil, err
@@ -20,9 +33,38 @@ func parseIPProvider(ips []string) (ip.Provider, error) {
 	return static, nil
 }
 
+// parseIPDynamic parses a dynamic ip provider, which is one of
+//   - dns:<domain> resolves the domain name
+//   - iface:<interface> reads the addresses of the network interface
+//   - http://<endpoint> or https://<endpoint> requests the endpoint
+//
+// If the value is not a dynamic provider, false will be returned.
+func parseIPDynamic(value string) (ip.Provider, bool, error) {
+	switch {
+	case strings.HasPrefix(value, "dns:"):
+		domain := strings.TrimPrefix(value, "dns:")
+		if domain == "" {
+			return nil, false, errors.New("invalid ip provider: missing domain in " + value)
+		}
+		return &ip.DNS{Domain: domain}, true, nil
+	case strings.HasPrefix(value, "iface:"):
+		name := strings.TrimPrefix(value, "iface:")
+		if name == "" {
+			return nil, false, errors.New("invalid ip provider: missing interface in " + value)
+		}
+		return &ip.Interface{Name: name}, true, nil
+	case strings.HasPrefix(value, "http://"), strings.HasPrefix(value, "https://"):
+		return &ip.HTTP{URL: value}, true, nil
+	}
+	return nil, false, nil
+}
+
 func parseIPStatic(ips []string) (*ip.Static, error) {
 	static := &ip.Static{}
 	firstIP := net.ParseIP(ips[0])
+	if firstIP == nil {
+		return nil, errors.New("invalid ip: " + ips[0])
+	}
 	isV4 := firstIP.To4() != nil
 	if isV4 {
 		static.V4 = firstIP
@@ -35,6 +77,9 @@ func parseIPStatic(ips []string) (*ip.Static, error) {
 	}
 
 	secondIP := net.ParseIP(ips[1])
+	if secondIP == nil {
+		return nil, errors.New("invalid ip: " + ips[1])
+	}
 	isV6 := secondIP.To4() == nil
 	if isV4 != isV6 {
 		return nil, errors.New("invalid ips: the ips must be of different type ipv4/ipv6")
@@ -0,0 +1,80 @@
+package ip
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Cached caches the ips of a dynamic provider and refreshes them after Refresh. Only the first lookup
+// waits for the provider, afterwards the cached ips are returned and refreshed in the background. If
+// refreshing fails, the last known ips are returned until the next refresh.
+type Cached struct {
+	Provider Provider
+	Refresh  time.Duration
+
+	fetch      sync.Mutex // Serializes the provider lookups
+	lock       sync.Mutex
+	v4         net.IP
+	v6         net.IP
+	fetched    time.Time
+	refreshing bool
+}
+
+func (c *Cached) Get() (net.IP, net.IP, error) {
+	c.lock.Lock()
+	if !c.fetched.IsZero() {
+		if time.Since(c.fetched) >= c.Refresh && !c.refreshing {
+			c.refreshing = true
+			go c.refresh()
+		}
+		v4, v6 := c.v4, c.v6
+		c.lock.Unlock()
+		return v4, v6, nil
+	}
+	c.lock.Unlock()
+
+	c.fetch.Lock()
+	defer c.fetch.Unlock()
+	c.lock.Lock()
+	if !c.fetched.IsZero() {
+		defer c.lock.Unlock()
+		return c.v4, c.v6, nil
+	}
+	c.lock.Unlock()
+
+	v4, v6, err := c.Provider.Get()
+	if err != nil {
+		return nil, nil, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.update(v4, v6)
+	return v4, v6, nil
+}
+
+func (c *Cached) refresh() {
+	c.fetch.Lock()
+	defer c.fetch.Unlock()
+	v4, v6, err := c.Provider.Get()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.refreshing = false
+	if err != nil {
+		log.Warn().Err(err).IPAddr("v4", c.v4).IPAddr("v6", c.v6).Msg("Failed to refresh external ip, using the last known")
+		c.fetched = time.Now()
+		return
+	}
+	c.update(v4, v6)
+}
+
+// update stores the fetched ips, the lock must be held.
+func (c *Cached) update(v4, v6 net.IP) {
+	if !v4.Equal(c.v4) || !v6.Equal(c.v6) {
+		log.Info().IPAddr("v4", v4).IPAddr("v6", v6).Msg("External ip changed")
+	}
+	c.v4, c.v6, c.fetched = v4, v6, time.Now()
+}
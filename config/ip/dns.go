@@ -0,0 +1,50 @@
+package ip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// DNS resolves the ips of a domain name.
+type DNS struct {
+	Domain   string
+	Resolver *net.Resolver
+}
+
+func (d *DNS) Get() (net.IP, net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, d.Domain)
+	if err != nil {
+		return nil, nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	v4, v6 := split(ips)
+	if v4 == nil && v6 == nil {
+		return nil, nil, errors.New("no ip found for " + d.Domain)
+	}
+	return v4, v6, nil
+}
+
+// split returns the first ipv4 and the first ipv6 of the ips.
+func split(ips []net.IP) (v4, v6 net.IP) {
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			if v4 == nil {
+				v4 = ip.To4()
+			}
+		} else if v6 == nil {
+			v6 = ip
+		}
+	}
+	return v4, v6
+}
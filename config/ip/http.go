@@ -0,0 +1,47 @@
+package ip
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HTTP requests the ips from an http endpoint. The response body must contain one ip per line.
+type HTTP struct {
+	URL    string
+	Client *http.Client
+}
+
+func (h *HTTP) Get() (net.IP, net.IP, error) {
+	client := h.Client
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	resp, err := client.Get(h.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, h.URL)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return nil, nil, err
+	}
+	var ips []net.IP
+	for _, line := range strings.Fields(string(body)) {
+		if parsed := net.ParseIP(line); parsed != nil {
+			ips = append(ips, parsed)
+		}
+	}
+	v4, v6 := split(ips)
+	if v4 == nil && v6 == nil {
+		return nil, nil, errors.New("no ip found in response of " + h.URL)
+	}
+	return v4, v6, nil
+}
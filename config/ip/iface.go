@@ -0,0 +1,34 @@
+package ip
+
+import (
+	"errors"
+	"net"
+)
+
+// Interface reads the global unicast ips of a network interface.
+type Interface struct {
+	Name string
+}
+
+func (i *Interface) Get() (net.IP, net.IP, error) {
+	iface, err := net.InterfaceByName(i.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, nil, err
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if ok && ipNet.IP.IsGlobalUnicast() {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	v4, v6 := split(ips)
+	if v4 == nil && v6 == nil {
+		return nil, nil, errors.New("no global unicast ip found on " + i.Name)
+	}
+	return v4, v6, nil
+}
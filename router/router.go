@@ -16,37 +16,73 @@ import "github.com/gorilla/mux"
 
 // UIConfig represents the configuration for the front UI.
 type UIConfig struct {
-	AuthMode                 string `json:"authMode"`
-	User                     string `json:"user"`
-	LoggedIn                 bool   `json:"loggedIn"`
-	RoomName                 string `json:"roomName"`
-	CloseRoomWhenOwnerLeaves bool   `json:"closeRoomWhenOwnerLeaves"`
-	Version                  string `json:"version"`
+	AuthMode                 string            `json:"authMode"`
+	User                     string            `json:"user"`
+	LoggedIn                 bool              `json:"loggedIn"`
+	OIDC                     bool              `json:"oidc"`
+	Roles                    []string          `json:"roles"`
+	Permissions              []auth.Permission `json:"permissions"`
+	CSRFToken                string            `json:"csrfToken"`
+	RoomName                 string            `json:"roomName"`
+	CloseRoomWhenOwnerLeaves bool              `json:"closeRoomWhenOwnerLeaves"`
+	Version                  string            `json:"version"`
 }
 
 func responseLogger(r *http.Request, status, size int, duration time.Duration) {
 	log.Info().Str("host", r.Host).Str("method", r.Method).Str("path", r.URL.Path).Str("ip", r.RemoteAddr).Int("status", status).Int("size", size).Dur("duration", duration).Msg("response")
 }
 
-// Router return a mux.Router, which implements http.Handler.
-func Router(config config.Config, rooms *ws.Rooms, users *auth.Users) *mux.Router {
+// Router return a mux.Router, which implements http.Handler. The OpenID Connect routes are only
+// registered if oidc is not nil.
+func Router(config config.Config, rooms *ws.Rooms, users *auth.Users, oidc *auth.OIDC) *mux.Router {
 	router := mux.NewRouter()
 	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		responseLogger(r, http.StatusNotFound, 0, 0)
 	})
 
-	router.Use(handlers.CORS(handlers.AllowedMethods([]string{"GET", "POST"}), handlers.AllowedOriginValidator(config.CheckOrigin)))
+	router.Use(handlers.CORS(
+		handlers.AllowedMethods([]string{"GET", "POST", "DELETE"}),
+		handlers.AllowedHeaders([]string{"X-CSRF-Token"}),
+		handlers.AllowedOriginValidator(config.CheckOrigin),
+	))
 	router.Use(hlog.AccessHandler(responseLogger))
 
+	// The handlers which change the login session or act on behalf of it need the csrf token of /config.
+	csrf := auth.NewCSRF(config)
 	router.HandleFunc("/stream", rooms.Upgrade)
-	router.Methods("POST").Path("/login").HandlerFunc(users.Authenticate)
-	router.Methods("POST").Path("/logout").HandlerFunc(users.Logout)
+	router.Methods("POST").Path("/login").Handler(csrf.Protect(http.HandlerFunc(users.Authenticate)))
+	router.Methods("POST").Path("/logout").Handler(csrf.Protect(http.HandlerFunc(users.Logout)))
+	router.Methods("GET").Path("/sessions").HandlerFunc(users.ListSessions)
+	router.Methods("DELETE").Path("/sessions/{id}").Handler(csrf.Protect(http.HandlerFunc(users.RevokeSession)))
+	if users.Tokens != nil {
+		router.Methods("GET").Path("/tokens").HandlerFunc(users.ListTokens)
+		router.Methods("POST").Path("/tokens").Handler(csrf.Protect(http.HandlerFunc(users.CreateToken)))
+		router.Methods("DELETE").Path("/tokens/{id}").Handler(csrf.Protect(http.HandlerFunc(users.RevokeToken)))
+	}
+	if oidc != nil {
+		router.Methods("GET").Path("/login/oidc").HandlerFunc(oidc.Login)
+		router.Methods("GET").Path("/login/oidc/callback").HandlerFunc(oidc.Callback)
+	}
 	router.Methods("GET").Path("/config").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := csrf.Token(w, r)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to create csrf token")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
 		user, loggedIn := users.CurrentUser(r)
+		var roles []string
+		if loggedIn {
+			roles = users.Roles(user)
+		}
 		_ = json.NewEncoder(w).Encode(&UIConfig{
 			AuthMode:                 config.AuthMode,
 			User:                     user,
 			LoggedIn:                 loggedIn,
+			OIDC:                     oidc != nil,
+			Roles:                    roles,
+			Permissions:              auth.Permissions(config.AuthMode, loggedIn, roles),
+			CSRFToken:                token,
 			RoomName:                 rooms.RandRoomName(),
 			CloseRoomWhenOwnerLeaves: config.CloseRoomWhenOwnerLeaves,
 			Version:                  config.Version,
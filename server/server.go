@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"github.com/gorilla/mux"
 	"github.com/rs/zerolog/log"
@@ -12,11 +13,12 @@ import (
 	"time"
 )
 
-// Start starts the http/https server.
-func Start(mux *mux.Router, address, cert, key string) error {
+// Start starts the http/https server. The tlsConfig is optional, e.g. to verify client certificates.
+func Start(mux *mux.Router, address, cert, key string, tlsConfig *tls.Config) error {
 	srv := &http.Server{
-		Addr:    address,
-		Handler: mux,
+		Addr:      address,
+		Handler:   mux,
+		TLSConfig: tlsConfig,
 	}
 
 	shutdown := make(chan error)
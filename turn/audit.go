@@ -0,0 +1,102 @@
+package turn
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// AllocationRecord is the usage of a single TURN allocation. BytesIn were received from peers, BytesOut were
+// sent to peers. Rejected is set for allocations which were refused, they have no traffic.
+type AllocationRecord struct {
+	Username      string    `json:"username"`
+	Session       string    `json:"session,omitempty"`
+	Room          string    `json:"room,omitempty"`
+	User          string    `json:"user,omitempty"`
+	Authenticated bool      `json:"authenticated"`
+	ClientAddress string    `json:"clientAddress,omitempty"`
+	RelayAddress  string    `json:"relayAddress"`
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	BytesIn       int64     `json:"bytesIn"`
+	BytesOut      int64     `json:"bytesOut"`
+	Rejected      string    `json:"rejected,omitempty"`
+}
+
+// AuditLog writes an AllocationRecord as a JSON line when an allocation is closed.
+type AuditLog struct {
+	lock    sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// OpenAuditLog opens the audit log file for appending, the file will be created if it does not exist.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+// Write appends the record to the audit log.
+func (a *AuditLog) Write(record AllocationRecord) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if err := a.encoder.Encode(record); err != nil {
+		log.Error().Err(err).Str("username", record.Username).Msg("Failed to write TURN audit record")
+	}
+}
+
+// Close closes the audit log file.
+func (a *AuditLog) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.file.Close()
+}
+
+// start starts counting the traffic of an allocation, the record is written when the entry is finished.
+func (a *AuditLog) start(record AllocationRecord) *auditEntry {
+	record.Start = time.Now()
+	return &auditEntry{audit: a, record: record}
+}
+
+// reject writes the record of an allocation which was refused.
+func (a *AuditLog) reject(record AllocationRecord, reason error) {
+	record.Start = time.Now()
+	record.End = record.Start
+	record.Rejected = reason.Error()
+	a.Write(record)
+}
+
+// auditEntry counts the traffic of an allocation.
+type auditEntry struct {
+	audit    *AuditLog
+	record   AllocationRecord
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	once     sync.Once
+}
+
+func (e *auditEntry) in(n int) {
+	e.bytesIn.Add(int64(n))
+}
+
+func (e *auditEntry) out(n int) {
+	e.bytesOut.Add(int64(n))
+}
+
+// finish writes the record of the allocation, it may be called more than once.
+func (e *auditEntry) finish() {
+	e.once.Do(func() {
+		record := e.record
+		record.End = time.Now()
+		record.BytesIn = e.bytesIn.Load()
+		record.BytesOut = e.bytesOut.Load()
+		e.audit.Write(record)
+	})
+}
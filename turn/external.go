@@ -0,0 +1,26 @@
+package turn
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// ExternalServer only issues credentials for an external TURN server, e.g. coturn configured with
+// use-auth-secret and static-auth-secret. The external server validates the credentials itself.
+type ExternalServer struct {
+	Secret []byte
+	TTL    time.Duration
+}
+
+// Credentials generates a username which expires after TTL and the password derived from the shared secret.
+func (s *ExternalServer) Credentials(id string, addr net.IP) (string, string) {
+	username := fmt.Sprintf("%d:%s", time.Now().Add(s.TTL).Unix(), id)
+	return username, hmacPassword(s.Secret, username)
+}
+
+// Track does nothing, the relay usage is not visible to ezshare.
+func (s *ExternalServer) Track(id string, owner Owner) {}
+
+// Ban does nothing, the external server rejects the credentials once they expired.
+func (s *ExternalServer) Ban(username string) {}
@@ -0,0 +1,32 @@
+package turn
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExternalServerCredentials(t *testing.T) {
+	// echo -n "1700000000:sessionhost" | openssl dgst -sha1 -hmac coturn-secret -binary | base64
+	if password := hmacPassword([]byte("coturn-secret"), "1700000000:sessionhost"); password != "RiOTeR0A57QMo786W6UtG833FVA=" {
+		t.Fatalf("unexpected password %q", password)
+	}
+
+	srv := &ExternalServer{Secret: []byte("coturn-secret"), TTL: time.Hour}
+	username, password := srv.Credentials("sessionhost", nil)
+	expiry, id, ok := strings.Cut(username, ":")
+	if !ok || id != "sessionhost" {
+		t.Fatalf("unexpected username %q", username)
+	}
+	timestamp, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		t.Fatalf("unexpected expiry %q", expiry)
+	}
+	if diff := time.Until(time.Unix(timestamp, 0)) - time.Hour; diff < -5*time.Second || diff > 5*time.Second {
+		t.Fatalf("expiry %s is not one ttl ahead", time.Unix(timestamp, 0))
+	}
+	if password != hmacPassword([]byte("coturn-secret"), username) {
+		t.Fatal("password is not the HMAC of the username")
+	}
+}
@@ -0,0 +1,68 @@
+package turn
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/turn/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// HMACServer is an internal TURN server which issues time-limited credentials in the style of the TURN REST API.
+// The username is "expiry:id" and the password is the base64 encoded HMAC-SHA1 of the username keyed with Secret,
+// so no user information needs to be stored and the credentials stay valid across restarts as long as the secret
+// does not change.
+type HMACServer struct {
+	Secret []byte
+	TTL    time.Duration
+	Quotas *Quotas
+}
+
+// Credentials generates a username which expires after TTL and the password derived from it.
+func (s *HMACServer) Credentials(id string, addr net.IP) (string, string) {
+	username := fmt.Sprintf("%d:%s", time.Now().Add(s.TTL).Unix(), id)
+	return username, hmacPassword(s.Secret, username)
+}
+
+// Track remembers who the credentials of the id were issued for.
+func (s *HMACServer) Track(id string, owner Owner) {
+	s.Quotas.Track(id, owner)
+}
+
+// Ban forgets the owner of the credentials, the credentials themselves cannot be revoked and will be
+// rejected once they expired.
+func (s *HMACServer) Ban(username string) {
+	s.Quotas.Untrack(username)
+}
+
+// authenticate recomputes the password of the given username and rejects expired or malformed usernames.
+func (s *HMACServer) authenticate(username, realm string, addr net.Addr) ([]byte, bool) {
+	expiry, _, ok := strings.Cut(username, ":")
+	if !ok {
+		log.Debug().Str("username", username).Str("address", addr.String()).Msg("Malformed username")
+		return nil, false
+	}
+	timestamp, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		log.Debug().Str("username", username).Str("address", addr.String()).Msg("Malformed username")
+		return nil, false
+	}
+	if time.Now().Unix() > timestamp {
+		log.Debug().Str("username", username).Str("address", addr.String()).Msg("Credentials expired")
+		return nil, false
+	}
+	return turn.GenerateAuthKey(username, realm, hmacPassword(s.Secret, username)), true
+}
+
+// hmacPassword returns the base64 encoded HMAC-SHA1 of the username keyed with the secret.
+func hmacPassword(secret []byte, username string) string {
+	mac := hmac.New(sha1.New, secret)
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,110 @@
+package turn
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ezshare/server/config"
+	"github.com/pion/turn/v2"
+)
+
+func TestHMACServerAuthenticate(t *testing.T) {
+	srv := &HMACServer{Secret: []byte("secret"), TTL: time.Hour, Quotas: NewQuotas(config.Config{})}
+	addr := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 50000}
+
+	username, password := srv.Credentials("sessionhost", addr.IP)
+	expiry, id, ok := strings.Cut(username, ":")
+	if !ok || id != "sessionhost" {
+		t.Fatalf("unexpected username %q", username)
+	}
+	if timestamp, err := strconv.ParseInt(expiry, 10, 64); err != nil || timestamp < time.Now().Add(59*time.Minute).Unix() {
+		t.Fatalf("unexpected expiry %q", expiry)
+	}
+	key, ok := srv.authenticate(username, "ezshare", addr)
+	if !ok {
+		t.Fatal("valid credentials rejected")
+	}
+	if string(key) != string(turn.GenerateAuthKey(username, "ezshare", password)) {
+		t.Fatal("key does not match the issued password")
+	}
+
+	for _, username := range []string{
+		fmt.Sprintf("%d:sessionhost", time.Now().Add(-time.Minute).Unix()),
+		"sessionhost",
+		"tomorrow:sessionhost",
+		":sessionhost",
+	} {
+		if _, ok := srv.authenticate(username, "ezshare", addr); ok {
+			t.Errorf("username %q accepted", username)
+		}
+	}
+}
+
+func TestHMACServerAllocate(t *testing.T) {
+	conf := testConfig()
+	conf.TurnMode = config.TurnModeHMAC
+	conf.Secret = []byte("secret")
+	conf.TurnCredentialTTLSeconds = 3600
+	srv := startTestServerConfig(t, conf, Limits{}, nil)
+
+	for _, network := range []string{"udp", "tcp"} {
+		addr := srv.udp
+		if network == "tcp" {
+			addr = srv.tcp
+		}
+		username, password := srv.Credentials("sessionhost", net.ParseIP("127.0.0.1"))
+		client, _ := dialTestClient(t, network, addr, username, password)
+		relayConn, err := client.Allocate()
+		if err != nil {
+			t.Fatalf("allocate over %s: %s", network, err)
+		}
+		_ = relayConn.Close()
+	}
+
+	expired := fmt.Sprintf("%d:sessionhost", time.Now().Add(-time.Minute).Unix())
+	other := &HMACServer{Secret: []byte("other"), TTL: time.Hour}
+	otherUsername, otherPassword := other.Credentials("sessionhost", nil)
+	for name, credentials := range map[string][2]string{
+		"expired":      {expired, hmacPassword(conf.Secret, expired)},
+		"wrong secret": {otherUsername, otherPassword},
+	} {
+		client, _ := dialTestClient(t, "udp", srv.udp, credentials[0], credentials[1])
+		if _, err := client.Allocate(); err == nil {
+			t.Errorf("allocation with %s credentials succeeded", name)
+		}
+	}
+}
+
+func TestHMACServerCredentialID(t *testing.T) {
+	quotas := NewQuotas(config.Config{})
+	quotas.UsernameLimits = Limits{Allocations: 1}
+	srv := &HMACServer{Secret: []byte("secret"), TTL: time.Hour, Quotas: quotas}
+
+	srv.Track("sessionhost", Owner{Session: "session"})
+	username, _ := srv.Credentials("sessionhost", nil)
+	if owner, ok := quotas.Owner(username); !ok || owner.Session != "session" {
+		t.Fatalf("owner of %q not found", username)
+	}
+
+	quota, err := quotas.allocate(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewed := fmt.Sprintf("%d:sessionhost", time.Now().Add(2*time.Hour).Unix())
+	if _, err := quotas.allocate(renewed); err != ErrAllocationQuota {
+		t.Fatalf("renewed credentials of the id escaped the allocation quota: %v", err)
+	}
+	quota.release()
+	if _, err := quotas.allocate(renewed); err != nil {
+		t.Fatalf("allocation after release: %s", err)
+	}
+
+	srv.Ban("sessionhost")
+	if _, ok := quotas.Owner(username); ok {
+		t.Fatal("owner still tracked after ban")
+	}
+}
@@ -1,7 +1,6 @@
 package turn
 
 import (
-	"errors"
 	"net"
 	"strconv"
 )
@@ -22,6 +21,15 @@ func (r *RelayAddressGeneratorNone) AllocatePacketConn(network string, requested
 	return packetConn, relayAddr, nil
 }
 
+func (r *RelayAddressGeneratorNone) AllocateListener(network string, requestedPort int) (net.Listener, net.Addr, error) {
+	listener, err := listenTCP(":" + strconv.Itoa(requestedPort))
+	if err != nil {
+		return nil, nil, err
+	}
+	return listener, listener.Addr(), nil
+}
+
+// AllocateConn is not used, see errConnNotSupported.
 func (r *RelayAddressGeneratorNone) AllocateConn(network string, requestedPort int) (net.Conn, net.Addr, error) {
-	return nil, nil, errors.New("tcp not supported by none relay address generator")
+	return nil, nil, errConnNotSupported
 }
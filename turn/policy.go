@@ -0,0 +1,172 @@
+package turn
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/ezshare/server/config"
+	"github.com/ezshare/server/config/ip"
+	"github.com/rs/zerolog/log"
+)
+
+// privateNetworks are the loopback, private, link-local (including cloud metadata services),
+// shared and reserved networks which are denied by default.
+var privateNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// PeerPolicy decides which peer addresses the TURN server relays to. Allowed networks take precedence over
+// denied networks. Permissions for the own addresses of the TURN server are always allowed, so that two clients
+// can relay through the same server, but traffic to the own addresses is only relayed to the ports of active
+// allocations and not to other services of the server.
+type PeerPolicy struct {
+	Allow      []*net.IPNet
+	Deny       []*net.IPNet
+	IPProvider ip.Provider
+	Own        []net.IP // The own addresses besides the external ips, e.g. the static relay address
+
+	lock   sync.Mutex
+	relays map[relayPort]struct{}
+}
+
+// relayPort is the port of an active allocation.
+type relayPort struct {
+	network string
+	port    int
+}
+
+// newPeerPolicy creates the PeerPolicy from the config.
+func newPeerPolicy(conf config.Config) (*PeerPolicy, error) {
+	allow, err := parseNetworks(conf.TurnPeerAllow)
+	if err != nil {
+		return nil, err
+	}
+	denied := conf.TurnPeerDeny
+	if conf.TurnPeerDenyPrivate {
+		denied = append(denied, privateNetworks...)
+	}
+	deny, err := parseNetworks(denied)
+	if err != nil {
+		return nil, err
+	}
+	policy := &PeerPolicy{Allow: allow, Deny: deny, IPProvider: conf.TurnIPProvider, relays: map[relayPort]struct{}{}}
+	for _, address := range []string{conf.TurnRelayAddress, conf.TurnRelayBindAddress} {
+		if parsed := net.ParseIP(address); parsed != nil && !parsed.IsUnspecified() {
+			policy.Own = append(policy.Own, parsed)
+		}
+	}
+	return policy, nil
+}
+
+// Permit checks if the client is allowed to create a permission or bind a channel to the peer.
+func (p *PeerPolicy) Permit(clientAddr net.Addr, peerIP net.IP) bool {
+	for _, network := range p.Allow {
+		if network.Contains(peerIP) {
+			return true
+		}
+	}
+	if p.own(peerIP) {
+		return true
+	}
+	for _, network := range p.Deny {
+		if network.Contains(peerIP) {
+			log.Warn().Str("address", clientAddr.String()).IPAddr("peer", peerIP).Str("network", network.String()).Msg("Denied relay to peer")
+			return false
+		}
+	}
+	return true
+}
+
+// Relayable checks if traffic may be relayed to or from the peer, which is only denied for the own addresses
+// of the server on ports without an active allocation.
+func (p *PeerPolicy) Relayable(network string, peer net.Addr) bool {
+	peerIP, port := addrIP(peer), addrPort(peer)
+	if !p.own(peerIP) {
+		return true
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_, ok := p.relays[relayPort{network: network, port: port}]
+	return ok
+}
+
+// addRelay registers the port of an active allocation, it returns false if the port is registered already.
+func (p *PeerPolicy) addRelay(network string, port int) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	key := relayPort{network: network, port: port}
+	if _, ok := p.relays[key]; ok {
+		return false
+	}
+	p.relays[key] = struct{}{}
+	return true
+}
+
+// removeRelay removes the port of a closed allocation.
+func (p *PeerPolicy) removeRelay(network string, port int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.relays, relayPort{network: network, port: port})
+}
+
+// own checks if the ip is an address of the TURN server.
+func (p *PeerPolicy) own(peerIP net.IP) bool {
+	for _, address := range p.Own {
+		if peerIP.Equal(address) {
+			return true
+		}
+	}
+	if p.IPProvider == nil {
+		return false
+	}
+	v4, v6, err := p.IPProvider.Get()
+	return err == nil && (peerIP.Equal(v4) || peerIP.Equal(v6))
+}
+
+// parseNetworks parses CIDRs, a single IP is treated as a network containing only this IP.
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			parsed := net.ParseIP(value)
+			if parsed == nil {
+				return nil, fmt.Errorf("invalid peer ip %s", value)
+			}
+			bits := 128
+			if parsed.To4() != nil {
+				parsed = parsed.To4()
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: parsed, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer network %s: %s", value, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
@@ -0,0 +1,73 @@
+package turn
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ezshare/server/config"
+	"github.com/ezshare/server/config/ip"
+)
+
+func TestPeerPolicy(t *testing.T) {
+	policy, err := newPeerPolicy(config.Config{
+		TurnPeerAllow:       []string{"10.1.0.0/16"},
+		TurnPeerDeny:        []string{"203.0.113.7"},
+		TurnPeerDenyPrivate: true,
+		TurnIPProvider:      &ip.Static{V4: net.ParseIP("192.168.1.10")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 50000}
+	for peer, expected := range map[string]bool{
+		"8.8.8.8":          true,
+		"127.0.0.1":        false,
+		"169.254.169.254":  false,
+		"10.0.0.1":         false,
+		"10.1.2.3":         true,
+		"192.168.1.10":     true,
+		"192.168.1.11":     false,
+		"203.0.113.7":      false,
+		"::1":              false,
+		"::ffff:127.0.0.1": false,
+		"fd00:ec2::254":    false,
+		"2001:db8::1":      true,
+	} {
+		if actual := policy.Permit(client, net.ParseIP(peer)); actual != expected {
+			t.Errorf("peer %s: expected %t, got %t", peer, expected, actual)
+		}
+	}
+}
+
+func TestPeerPolicyRelayable(t *testing.T) {
+	policy, err := newPeerPolicy(config.Config{
+		TurnRelayAddress: "203.0.113.20",
+		TurnIPProvider:   &ip.Static{V4: net.ParseIP("203.0.113.10")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.addRelay("udp", 45000)
+
+	for peer, expected := range map[string]bool{
+		"203.0.113.10:45000": true,
+		"203.0.113.10:6379":  false,
+		"203.0.113.20:45000": true,
+		"203.0.113.20:22":    false,
+		"198.51.100.1:6379":  true,
+	} {
+		addr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := policy.Relayable("udp", addr); actual != expected {
+			t.Errorf("peer %s: expected %t, got %t", peer, expected, actual)
+		}
+	}
+
+	policy.removeRelay("udp", 45000)
+	if policy.Relayable("udp", &net.UDPAddr{IP: net.ParseIP("203.0.113.10"), Port: 45000}) {
+		t.Error("closed relay port is still relayable")
+	}
+}
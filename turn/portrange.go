@@ -8,6 +8,10 @@ import (
 	"github.com/pion/randutil"
 )
 
+// errConnNotSupported is returned by AllocateConn, which pion never calls. TCP allocations are served by the
+// relay with AllocateListener instead.
+var errConnNotSupported = errors.New("tcp relays are allocated with AllocateListener")
+
 type RelayAddressGeneratorPortRange struct {
 	MinPort uint16
 	MaxPort uint16
@@ -47,7 +51,29 @@ func (r *RelayAddressGeneratorPortRange) AllocatePacketConn(network string, requ
 	return nil, nil, errors.New("could not find free port: max retries exceeded")
 }
 
-// AllocateConn allocates a Conn (TCP) RelayAddress
+// AllocateListener allocates a Listener (TCP) RelayAddress in the port range.
+func (r *RelayAddressGeneratorPortRange) AllocateListener(network string, requestedPort int) (net.Listener, net.Addr, error) {
+	if requestedPort != 0 {
+		listener, err := listenTCP(fmt.Sprintf(":%d", requestedPort))
+		if err != nil {
+			return nil, nil, err
+		}
+		return listener, listener.Addr(), nil
+	}
+
+	for try := 0; try < 10; try++ {
+		port := r.MinPort + uint16(r.Rand.Intn(int((r.MaxPort+1)-r.MinPort)))
+		listener, err := listenTCP(fmt.Sprintf(":%d", port))
+		if err != nil {
+			continue
+		}
+		return listener, listener.Addr(), nil
+	}
+
+	return nil, nil, errors.New("could not find free port: max retries exceeded")
+}
+
+// AllocateConn is not used, see errConnNotSupported.
 func (r *RelayAddressGeneratorPortRange) AllocateConn(network string, requestedPort int) (net.Conn, net.Addr, error) {
-	return nil, nil, errors.New("tcp not supported by port range relay address generator")
+	return nil, nil, errConnNotSupported
 }
@@ -0,0 +1,274 @@
+package turn
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ezshare/server/config"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrAllocationQuota is returned when an allocation would exceed the allowed concurrent allocations.
+var ErrAllocationQuota = errors.New("allocation quota reached")
+
+// Limits are the relay limits of a TURN username, an ezshare user or the whole server. Zero means unlimited.
+type Limits struct {
+	BytesPerSecond int64
+	TotalBytes     int64
+	Allocations    int
+}
+
+// Owner describes who a TURN credential was issued for.
+type Owner struct {
+	Room          string
+	Session       string
+	User          string
+	Authenticated bool
+	// Exceeded is called when a quota of the owner was exceeded. It is called from the relay
+	// goroutines and must not block.
+	Exceeded func(username, reason string)
+}
+
+// usage is the relay usage of a TURN username, an ezshare user or the whole server.
+type usage struct {
+	name        string
+	limits      Limits
+	limiter     *limiter
+	bytes       int64
+	allocations int
+}
+
+// Quotas tracks the relay usage and enforces the limits per TURN username, per authenticated ezshare
+// user and for the whole server.
+type Quotas struct {
+	lock      sync.Mutex
+	owners    map[string]Owner
+	usernames map[string]*usage
+	users     map[string]*usage
+	global    *usage
+
+	UsernameLimits Limits
+	UserLimits     Limits
+	GlobalLimits   Limits
+}
+
+// NewQuotas creates the Quotas from the config.
+func NewQuotas(conf config.Config) *Quotas {
+	q := &Quotas{
+		owners:    map[string]Owner{},
+		usernames: map[string]*usage{},
+		users:     map[string]*usage{},
+		UsernameLimits: Limits{
+			BytesPerSecond: conf.TurnQuotaBytesPerSecond,
+			TotalBytes:     conf.TurnQuotaTotalBytes,
+			Allocations:    conf.TurnQuotaAllocations,
+		},
+		UserLimits: Limits{
+			BytesPerSecond: conf.TurnUserQuotaBytesPerSecond,
+			TotalBytes:     conf.TurnUserQuotaTotalBytes,
+			Allocations:    conf.TurnUserQuotaAllocations,
+		},
+		GlobalLimits: Limits{
+			BytesPerSecond: conf.TurnGlobalQuotaBytesPerSecond,
+			Allocations:    conf.TurnGlobalQuotaAllocations,
+		},
+	}
+	q.global = newUsage("global", q.GlobalLimits)
+	return q
+}
+
+// Track remembers the owner of the credentials issued for the id.
+func (q *Quotas) Track(id string, owner Owner) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.owners[id] = owner
+}
+
+// Untrack forgets the owner of the credentials issued for the id. Running allocations keep their usage.
+func (q *Quotas) Untrack(id string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	delete(q.owners, credentialID(id))
+}
+
+// Owner returns the owner of the credentials of the TURN username.
+func (q *Quotas) Owner(username string) (Owner, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	owner, ok := q.owners[credentialID(username)]
+	return owner, ok
+}
+
+// allocate reserves an allocation for the username, the returned quota counts and limits its traffic.
+// If an allocation limit is reached, ErrAllocationQuota is returned.
+func (q *Quotas) allocate(username string) (*allocationQuota, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	owner, tracked := q.owners[credentialID(username)]
+	usages := []*usage{q.global, q.usage(q.usernames, credentialID(username), q.UsernameLimits)}
+	if tracked && owner.Authenticated {
+		usages = append(usages, q.usage(q.users, owner.User, q.UserLimits))
+	}
+	for _, u := range usages {
+		if u.limits.Allocations > 0 && u.allocations >= u.limits.Allocations {
+			log.Warn().Str("username", username).Str("quota", u.name).Int("allocations", u.allocations).Msg("Allocation quota reached")
+			if tracked && owner.Exceeded != nil {
+				owner.Exceeded(username, fmt.Sprintf("allocation quota of %s reached", u.name))
+			}
+			return nil, ErrAllocationQuota
+		}
+	}
+	for _, u := range usages {
+		u.allocations++
+	}
+	return &allocationQuota{quotas: q, username: username, owner: owner, tracked: tracked, usages: usages}, nil
+}
+
+// usage returns the usage of the key and creates it if needed.
+func (q *Quotas) usage(usages map[string]*usage, key string, limits Limits) *usage {
+	u, ok := usages[key]
+	if !ok {
+		u = newUsage(key, limits)
+		usages[key] = u
+	}
+	return u
+}
+
+// count counts n relayed bytes and decides if the packet may be relayed. Packets exceeding a bandwidth
+// limit are dropped, and the allocation must be closed if a total bytes limit is exceeded. The reason is
+// only returned when the owner should be notified, i.e. once per throttling period.
+func (q *Quotas) count(c *allocationQuota, n int) (relay, exhausted bool, reason string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, u := range c.usages {
+		if u.limiter != nil && !u.limiter.allow(n) {
+			if c.throttled {
+				return false, false, ""
+			}
+			c.throttled = true
+			return false, false, fmt.Sprintf("bandwidth quota of %s exceeded", u.name)
+		}
+	}
+	c.throttled = false
+	for _, u := range c.usages {
+		u.bytes += int64(n)
+	}
+	for _, u := range c.usages {
+		if u.limits.TotalBytes > 0 && u.bytes > u.limits.TotalBytes {
+			return false, true, fmt.Sprintf("traffic quota of %s exceeded", u.name)
+		}
+	}
+	return true, false, ""
+}
+
+// release frees the allocation of the connection, and removes the usage of the TURN username when it has
+// no allocation left. Usernames are counted by the id of their credentials, so that renewed time-limited
+// credentials share the usage. The usage of the ezshare user is kept, so that its total bytes limit stays in effect.
+func (q *Quotas) release(c *allocationQuota) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, u := range c.usages {
+		u.allocations--
+	}
+	if u, ok := q.usernames[credentialID(c.username)]; ok && u.allocations == 0 {
+		delete(q.usernames, credentialID(c.username))
+	}
+}
+
+func newUsage(name string, limits Limits) *usage {
+	u := &usage{name: name, limits: limits}
+	if limits.BytesPerSecond > 0 {
+		u.limiter = newLimiter(limits.BytesPerSecond)
+	}
+	return u
+}
+
+// allocationQuota counts and limits the traffic of an allocation.
+type allocationQuota struct {
+	quotas   *Quotas
+	username string
+	owner    Owner
+	tracked  bool
+	usages   []*usage
+
+	once      sync.Once
+	throttled bool // Protected by the lock of quotas
+}
+
+// allow counts the packet and decides if it may be relayed. Packets exceeding the bandwidth limit are
+// dropped, and the allocation must be closed when it is exhausted.
+func (c *allocationQuota) allow(n int) (relay, exhausted bool) {
+	relay, exhausted, reason := c.quotas.count(c, n)
+	if relay {
+		return true, false
+	}
+	if exhausted {
+		log.Warn().Str("username", c.username).Str("reason", reason).Msg("Closing TURN allocation")
+		c.exceeded(reason)
+	} else if reason != "" {
+		log.Warn().Str("username", c.username).Str("reason", reason).Msg("Throttling TURN allocation")
+		c.exceeded(reason)
+	}
+	return false, exhausted
+}
+
+// burst returns the most bytes the bandwidth limits allow at once, or zero if the bandwidth is unlimited.
+func (c *allocationQuota) burst() int {
+	burst := 0
+	for _, u := range c.usages {
+		if rate := int(u.limits.BytesPerSecond); rate > 0 && (burst == 0 || rate < burst) {
+			burst = rate
+		}
+	}
+	return burst
+}
+
+// release frees the allocation, it may be called more than once.
+func (c *allocationQuota) release() {
+	c.once.Do(func() { c.quotas.release(c) })
+}
+
+func (c *allocationQuota) exceeded(reason string) {
+	if c.tracked && c.owner.Exceeded != nil {
+		c.owner.Exceeded(c.username, reason)
+	}
+}
+
+// limiter is a token bucket allowing rate bytes per second with a burst of one second.
+type limiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate int64) *limiter {
+	return &limiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (l *limiter) allow(n int) bool {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	if l.tokens < float64(n) {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+// credentialID returns the id the credentials of the username were issued for, the expiry of time-limited
+// usernames is removed.
+func credentialID(username string) string {
+	expiry, id, ok := strings.Cut(username, ":")
+	if !ok || strings.Trim(expiry, "0123456789") != "" {
+		return username
+	}
+	return id
+}
@@ -0,0 +1,252 @@
+package turn
+
+import (
+	"net"
+	"sync"
+
+	"github.com/ezshare/server/config"
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// relay serves the TURN listeners. Every client, a UDP client address or a TCP or TLS connection, is served by
+// its own pion server with its own generator, so that allocations are attributed to the client which requested
+// them without relying on the order in which pion handles requests. TCP allocations are served by the relay
+// itself, see tcpAllocation.
+type relay struct {
+	config    *config.Config
+	auth      turn.AuthHandler
+	policy    *PeerPolicy
+	quotas    *Quotas
+	audit     *AuditLog
+	generator turn.RelayAddressGenerator
+	nonces    *nonces
+
+	lock      sync.Mutex
+	udp       *udpMux
+	listeners []net.Listener
+	conns     map[net.Conn]struct{}
+	peers     map[uint32]*peerConn // The peer connections of TCP allocations by connection id
+}
+
+// client is the transport address of a client together with the username of its last authenticated allocate
+// request and its allocation. There is at most one allocation per client, see RFC 5766 section 2.2.
+type client struct {
+	addr net.Addr
+
+	lock     sync.Mutex
+	username string
+	relays   int // The UDP allocations pion holds for the client
+	tcp      *tcpAllocation
+}
+
+func (c *client) setUsername(username string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.username = username
+}
+
+func (c *client) authenticated() (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.username, c.username != ""
+}
+
+// allocated checks if the client has an allocation.
+func (c *client) allocated() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.relays > 0 || c.tcp != nil
+}
+
+func (c *client) addRelay(delta int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.relays += delta
+}
+
+func (c *client) tcpAllocation() *tcpAllocation {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.tcp
+}
+
+func (c *client) setTCPAllocation(a *tcpAllocation) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tcp = a
+}
+
+// clearTCPAllocation forgets the TCP allocation if it is still the allocation of the client.
+func (c *client) clearTCPAllocation(a *tcpAllocation) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.tcp == a {
+		c.tcp = nil
+	}
+}
+
+// serve starts serving the given listeners. Clients may reach the server over UDP, TCP or TLS, clients reaching
+// it over TCP or TLS may allocate TCP relays as well. It returns the Server issuing the credentials and the relay,
+// which must be closed to stop serving. The audit log is optional.
+func serve(config *config.Config, quotas *Quotas, audit *AuditLog, udpListener net.PacketConn, listeners ...net.Listener) (Server, *relay, error) {
+	srv, authHandler := server(*config, quotas)
+	policy, err := newPeerPolicy(*config)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := &relay{
+		config:    config,
+		auth:      authHandler,
+		policy:    policy,
+		quotas:    quotas,
+		audit:     audit,
+		generator: generator(*config),
+		nonces:    newNonces(),
+		listeners: listeners,
+		conns:     map[net.Conn]struct{}{},
+		peers:     map[uint32]*peerConn{},
+	}
+	if err := r.generator.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	r.udp = newUDPMux(r, udpListener)
+	go r.udp.serve()
+	for _, listener := range listeners {
+		go r.accept(listener)
+	}
+	return srv, r, nil
+}
+
+// newServer creates a pion server which handles the requests of the client received on the conn.
+func (r *relay) newServer(conn net.PacketConn, c *client) (*turn.Server, error) {
+	return turn.NewServer(turn.ServerConfig{
+		Realm:       r.config.TurnRealm,
+		AuthHandler: r.auth,
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{PacketConn: conn, RelayAddressGenerator: r.newGenerator(c), PermissionHandler: r.policy.Permit},
+		},
+	})
+}
+
+// newGenerator creates the generator of the allocations of the client.
+func (r *relay) newGenerator(c *client) *Generator {
+	return &Generator{
+		RelayAddressGenerator: r.generator,
+		IPProvider:            r.config.TurnIPProvider,
+		Quotas:                r.quotas,
+		Audit:                 r.audit,
+		Policy:                r.policy,
+		client:                c,
+	}
+}
+
+// inspect remembers the username of an allocate request of the client before pion handles it. The message
+// integrity is checked, so that only a client holding the credentials of the username can set it.
+func (r *relay) inspect(c *client, m *stun.Message) {
+	if m == nil || m.Type != allocateRequest {
+		return
+	}
+	var username stun.Username
+	var realm stun.Realm
+	if username.GetFrom(m) != nil || realm.GetFrom(m) != nil {
+		return
+	}
+	key, ok := r.auth(username.String(), realm.String(), c.addr)
+	if !ok || stun.MessageIntegrity(key).Check(m) != nil {
+		return
+	}
+	c.setUsername(username.String())
+}
+
+// accept accepts the TCP or TLS connections of the listener until it is closed.
+func (r *relay) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Debug().Err(err).Str("address", listener.Addr().String()).Msg("Stop accepting TURN connections")
+			return
+		}
+		go r.serveConn(conn)
+	}
+}
+
+// serveConn serves a TCP or TLS connection. A connection starting with a connection bind request is a data
+// connection of a TCP allocation, the others are control connections. The allocations of a control connection
+// are closed when the connection is closed.
+func (r *relay) serveConn(conn net.Conn) {
+	r.lock.Lock()
+	r.conns[conn] = struct{}{}
+	r.lock.Unlock()
+
+	replayed, bind, err := readFirstMessage(conn)
+	if err != nil {
+		log.Debug().Err(err).Str("address", conn.RemoteAddr().String()).Msg("Failed to read first TURN message")
+		r.closeConn(conn)
+		return
+	}
+	if bind != nil {
+		r.bind(conn, bind)
+		return
+	}
+
+	c := &client{addr: conn.RemoteAddr()}
+	_, err = r.newServer(&streamConn{STUNConn: turn.NewSTUNConn(replayed), relay: r, conn: conn, client: c}, c)
+	if err != nil {
+		log.Error().Err(err).Str("address", conn.RemoteAddr().String()).Msg("Failed to serve TURN connection")
+		r.closeConn(conn)
+	}
+}
+
+// closeConn closes a TCP or TLS connection.
+func (r *relay) closeConn(conn net.Conn) {
+	r.lock.Lock()
+	delete(r.conns, conn)
+	r.lock.Unlock()
+	_ = conn.Close()
+}
+
+// Close stops serving and closes all connections.
+func (r *relay) Close() error {
+	for _, listener := range r.listeners {
+		_ = listener.Close()
+	}
+	r.lock.Lock()
+	conns := r.conns
+	r.conns = map[net.Conn]struct{}{}
+	r.lock.Unlock()
+	for conn := range conns {
+		_ = conn.Close()
+	}
+	return r.udp.Close()
+}
+
+// streamConn closes the TCP or TLS connection when reading fails, pion stops handling the connection then.
+// The requests of TCP allocations are handled by the relay and not passed to pion.
+type streamConn struct {
+	*turn.STUNConn
+	relay  *relay
+	conn   net.Conn
+	client *client
+}
+
+func (c *streamConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.STUNConn.ReadFrom(p)
+		if err != nil {
+			c.relay.closeConn(c.conn)
+			if allocation := c.client.tcpAllocation(); allocation != nil {
+				allocation.close()
+			}
+			return n, addr, err
+		}
+		m := decodeMessage(p[:n])
+		if m != nil && c.relay.handleStream(c, m) {
+			continue
+		}
+		c.relay.inspect(c.client, m)
+		return n, addr, err
+	}
+}
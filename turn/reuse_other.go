@@ -0,0 +1,19 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package turn
+
+import (
+	"net"
+)
+
+// listenTCP listens for the peers of a TCP allocation.
+func listenTCP(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+// dialTCP connects to a peer from the ip of a TCP allocation. The port of the allocation cannot be reused on
+// this platform, so the connection uses an ephemeral port.
+func dialTCP(local, peer *net.TCPAddr) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: tcpConnectTimeout, LocalAddr: &net.TCPAddr{IP: local.IP}}
+	return dialer.Dial("tcp", peer.String())
+}
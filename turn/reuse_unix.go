@@ -0,0 +1,36 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package turn
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenTCP listens for the peers of a TCP allocation. The port may be reused, so that the connections to
+// peers originate from the relayed transport address, see RFC 6062 section 5.2.
+func listenTCP(address string) (net.Listener, error) {
+	config := net.ListenConfig{Control: reusePort}
+	return config.Listen(context.Background(), "tcp", address)
+}
+
+// dialTCP connects to a peer from the local address of a TCP allocation.
+func dialTCP(local, peer *net.TCPAddr) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: tcpConnectTimeout, LocalAddr: local, Control: reusePort}
+	return dialer.Dial("tcp", peer.String())
+}
+
+func reusePort(network, address string, conn syscall.RawConn) error {
+	var err error
+	if controlErr := conn.Control(func(fd uintptr) {
+		if err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err == nil {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}
+	}); controlErr != nil {
+		return controlErr
+	}
+	return err
+}
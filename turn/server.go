@@ -1,18 +1,27 @@
 package turn
 
 import (
+	"crypto/tls"
+	"errors"
 	"github.com/ezshare/server/config"
 	"github.com/ezshare/server/config/ip"
+	"github.com/ezshare/server/util"
 	"github.com/pion/turn/v2"
 	"github.com/rs/zerolog/log"
 	"net"
+	"strconv"
 	"sync"
+	"time"
 )
 
+// passwordLength is the length of the random password generated for each TURN user.
+const passwordLength = 24
+
 // Server defines the interface for managing TURN servers, mainly for managing the permissions of users accessing
 // the TURN server.
 type Server interface {
 	Credentials(id string, addr net.IP) (string, string)
+	Track(id string, owner Owner)
 	Ban(username string)
 }
 
@@ -20,6 +29,7 @@ type Server interface {
 type InternalServer struct {
 	lock   sync.RWMutex
 	Lookup map[string]User
+	Quotas *Quotas
 }
 
 // User is the user information for accessing the TURN server.
@@ -29,9 +39,15 @@ type User struct {
 }
 
 // Generator is a customer relay address generator, which can generate relay addresses based on the IP address.
+// The relay connections are wrapped to enforce the quotas of the TURN username which allocates them.
 type Generator struct {
 	turn.RelayAddressGenerator
 	IPProvider ip.Provider
+	Quotas     *Quotas
+	Audit      *AuditLog
+	Policy     *PeerPolicy
+
+	client *client // The only client the generator allocates for, see relay.newServer
 }
 
 // AllocatePacketConn allocates a PacketConn (UDP) RelayAddress.
@@ -41,23 +57,176 @@ func (r *Generator) AllocatePacketConn(network string, requestedPort int) (net.P
 		return conn, addr, err
 	}
 	relayAddr := *addr.(*net.UDPAddr)
-
-	v4, v6, err := r.IPProvider.Get()
-	if err != nil {
-		return conn, addr, err
+	if relayAddr.IP, err = r.advertised(relayAddr.IP); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
 	}
 
-	if v6 == nil || (relayAddr.IP.To4() != nil && v4 != nil) {
-		relayAddr.IP = v4
-	} else {
-		relayAddr.IP = v6
+	username, _ := r.client.authenticated()
+	quota, entry, err := r.account(username, &relayAddr)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
 	}
 
 	log.Debug().
 		Str("addr", addr.String()).
 		Str("relayaddr", relayAddr.String()).
+		Str("username", username).
 		Msg("TURN allocated")
-	return conn, &relayAddr, err
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	r.Policy.addRelay("udp", port)
+	r.client.addRelay(1)
+	return &relayConn{PacketConn: conn, quota: quota, audit: entry, policy: r.Policy, client: r.client, port: port}, &relayAddr, nil
+}
+
+// AllocateListener allocates the listener of a TCP allocation, and returns it with the relayed address
+// advertised to the client. The listeners allow their port to be reused for the connections to peers, so
+// ports of other TCP allocations are skipped.
+func (r *Generator) AllocateListener() (net.Listener, *net.TCPAddr, error) {
+	generator, ok := r.RelayAddressGenerator.(listenerGenerator)
+	if !ok {
+		return nil, nil, errNoListener
+	}
+	for try := 0; try < 10; try++ {
+		listener, addr, err := generator.AllocateListener("tcp", 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		port := listener.Addr().(*net.TCPAddr).Port
+		if !r.Policy.addRelay("tcp", port) {
+			_ = listener.Close()
+			continue
+		}
+		relayAddr := *addr.(*net.TCPAddr)
+		if relayAddr.IP, err = r.advertised(relayAddr.IP); err != nil {
+			_ = listener.Close()
+			r.Policy.removeRelay("tcp", port)
+			return nil, nil, err
+		}
+		return listener, &relayAddr, nil
+	}
+	return nil, nil, errors.New("could not find free port: max retries exceeded")
+}
+
+// advertised returns the relay ip advertised to the client. Relay connections listening on all interfaces are
+// advertised with the external ip, generators binding to a specific address already return the address to
+// advertise.
+func (r *Generator) advertised(relayIP net.IP) (net.IP, error) {
+	if relayIP != nil && !relayIP.IsUnspecified() {
+		return relayIP, nil
+	}
+	v4, v6, err := r.IPProvider.Get()
+	if err != nil {
+		return nil, err
+	}
+	if v6 == nil || (relayIP.To4() != nil && v4 != nil) {
+		return v4, nil
+	}
+	return v6, nil
+}
+
+// account reserves the quota of an allocation of the username and starts its audit record, both are optional.
+// An allocation rejected by the quota is written to the audit log with the reason.
+func (r *Generator) account(username string, relayAddr net.Addr) (*allocationQuota, *auditEntry, error) {
+	record := AllocationRecord{Username: username, RelayAddress: relayAddr.String(), ClientAddress: r.client.addr.String()}
+	if r.Quotas != nil {
+		if owner, ok := r.Quotas.Owner(username); ok {
+			record.Session = owner.Session
+			record.Room = owner.Room
+			record.User = owner.User
+			record.Authenticated = owner.Authenticated
+		}
+	}
+	var quota *allocationQuota
+	if r.Quotas != nil {
+		var err error
+		if quota, err = r.Quotas.allocate(username); err != nil {
+			if r.Audit != nil {
+				r.Audit.reject(record, err)
+			}
+			return nil, nil, err
+		}
+	}
+	var entry *auditEntry
+	if r.Audit != nil {
+		entry = r.Audit.start(record)
+	}
+	return quota, entry, nil
+}
+
+// relayConn is the relay connection of an allocation. It enforces the peer policy and the quota, and counts
+// the relayed traffic for the audit log, the quota and the audit log are optional. Dropped packets are not
+// counted.
+type relayConn struct {
+	net.PacketConn
+	quota  *allocationQuota
+	audit  *auditEntry
+	policy *PeerPolicy
+	client *client
+	port   int // The local port, registered at the policy while the allocation is active
+	once   sync.Once
+}
+
+// ReadFrom reads the traffic from the peers.
+func (c *relayConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		if !c.policy.Relayable("udp", addr) || !c.allow(n) {
+			continue
+		}
+		if c.audit != nil {
+			c.audit.in(n)
+		}
+		return n, addr, nil
+	}
+}
+
+// WriteTo writes the traffic to a peer.
+func (c *relayConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if !c.policy.Relayable("udp", addr) {
+		log.Debug().Str("peer", addr.String()).Msg("Dropped relay to a port of the server without allocation")
+		return len(p), nil
+	}
+	if !c.allow(len(p)) {
+		return len(p), nil
+	}
+	n, err := c.PacketConn.WriteTo(p, addr)
+	if c.audit != nil {
+		c.audit.out(n)
+	}
+	return n, err
+}
+
+// Close closes the relay connection, frees its quota and writes its audit record.
+func (c *relayConn) Close() error {
+	err := c.PacketConn.Close()
+	c.once.Do(func() {
+		c.policy.removeRelay("udp", c.port)
+		c.client.addRelay(-1)
+		if c.quota != nil {
+			c.quota.release()
+		}
+		if c.audit != nil {
+			c.audit.finish()
+		}
+	})
+	return err
+}
+
+// allow decides if a packet may be relayed, the connection is closed when its quota is exhausted.
+func (c *relayConn) allow(n int) bool {
+	if c.quota == nil {
+		return true
+	}
+	relay, exhausted := c.quota.allow(n)
+	if exhausted {
+		_ = c.Close()
+	}
+	return relay
 }
 
 // Start starts a TURN server.
@@ -71,32 +240,72 @@ func Start(config *config.Config) (Server, error) {
 		return nil, err
 	}
 
-	srv := &InternalServer{Lookup: map[string]User{}}
-	gen := &Generator{
-		RelayAddressGenerator: generator(*config),
-		IPProvider:            config.TurnIPProvider,
+	listeners := []net.Listener{tcpListener}
+	if config.TurnTLS() {
+		tlsListener, err := listenTLS(config)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, tlsListener)
+		log.Debug().Str("address", config.TurnTLSAddress).Msg("Started TURN TLS listener")
 	}
 
-	_, err = turn.NewServer(turn.ServerConfig{
-		Realm:       config.TurnRealm,
-		AuthHandler: srv.authenticate,
-		ListenerConfigs: []turn.ListenerConfig{
-			{Listener: tcpListener, RelayAddressGenerator: gen},
-		},
-		PacketConnConfigs: []turn.PacketConnConfig{
-			{PacketConn: udpListener, RelayAddressGenerator: gen},
-		},
-	})
+	var audit *AuditLog
+	if config.TurnAuditLog != "" {
+		audit, err = OpenAuditLog(config.TurnAuditLog)
+		if err != nil {
+			return nil, err
+		}
+		log.Debug().Str("file", config.TurnAuditLog).Msg("Writing TURN audit log")
+	}
+
+	srv, _, err := serve(config, NewQuotas(*config), audit, udpListener, listeners...)
 	if err != nil {
 		return nil, err
 	}
-	log.Debug().Str("address", config.TurnAddress).Msg("Started TURN server")
+	log.Debug().Str("address", config.TurnAddress).Str("mode", config.TurnMode).Msg("Started TURN server")
 
 	return srv, nil
 }
 
+// listenTLS starts the TURNS listener with the configured certificate.
+func listenTLS(config *config.Config) (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(config.TurnTLSCertFile, config.TurnTLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", config.TurnTLSAddress, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+}
+
+// server returns the Server which issues the credentials according to the turn mode, and the
+// handler which authenticates them.
+func server(conf config.Config, quotas *Quotas) (Server, turn.AuthHandler) {
+	if conf.TurnMode == config.TurnModeHMAC {
+		log.Debug().Int("ttl", conf.TurnCredentialTTLSeconds).Msg("Using HMAC credentials")
+		srv := &HMACServer{
+			Secret: conf.Secret,
+			TTL:    time.Duration(conf.TurnCredentialTTLSeconds) * time.Second,
+			Quotas: quotas,
+		}
+		return srv, srv.authenticate
+	}
+	log.Debug().Msg("Using internal credentials")
+	srv := &InternalServer{Lookup: map[string]User{}, Quotas: quotas}
+	return srv, srv.authenticate
+}
+
 // generator returns a RelayAddressGenerator.
 func generator(conf config.Config) turn.RelayAddressGenerator {
+	if conf.TurnRelayBindAddress != "" {
+		log.Debug().Str("address", conf.TurnRelayBindAddress).Str("relay", conf.TurnRelayAddress).Msg("Using Static Relay Address")
+		return &DelayAddressGeneratorStatic{
+			RelayAddress: net.ParseIP(conf.TurnRelayAddress),
+			Address:      conf.TurnRelayBindAddress,
+		}
+	}
 	minport, maxport, ok := conf.PortRange()
 	if ok {
 		log.Debug().Uint16("min", minport).Uint16("max", maxport).Msg("Using Port Range")
@@ -109,30 +318,74 @@ func generator(conf config.Config) turn.RelayAddressGenerator {
 // Credentials registers a user with a random password for the given
 // username and address, and returns the username and password.
 func (s *InternalServer) Credentials(id string, addr net.IP) (string, string) {
-	pass := "password" // TODO random password
+	pass := util.RandString(passwordLength)
 	s.lock.Lock()
-	defer s.lock.Lock()
+	defer s.lock.Unlock()
 	s.Lookup[id] = User{Addr: addr, Password: []byte(pass)}
 
 	return id, pass
 }
 
+// Track remembers who the credentials of the id were issued for.
+func (s *InternalServer) Track(id string, owner Owner) {
+	s.Quotas.Track(id, owner)
+}
+
 // Ban bans a user from using the TURN server.
 func (s *InternalServer) Ban(username string) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	delete(s.Lookup, username)
+	s.Quotas.Untrack(username)
 }
 
 // authenticate according to the given username and address to check if the user is allowed to access the TURN server.
-// If the user is allowed, return the password; otherwise, return false.
+// The connecting address must match the address the credentials were issued for. If the user is allowed, return the
+// long-term credential key; otherwise, return false.
 func (s *InternalServer) authenticate(username, realm string, addr net.Addr) ([]byte, bool) {
 	s.lock.RLock()
-	defer s.lock.RLock()
+	defer s.lock.RUnlock()
 	entry, ok := s.Lookup[username]
 	if !ok {
 		log.Debug().Str("username", username).Str("address", addr.String()).Msg("Unauthorized")
 		return nil, false
 	}
-	return entry.Password, true
+	if !entry.Addr.Equal(addrIP(addr)) {
+		log.Debug().Str("username", username).Str("address", addr.String()).IPAddr("expected", entry.Addr).Msg("Address mismatch")
+		return nil, false
+	}
+	return turn.GenerateAuthKey(username, realm, string(entry.Password)), true
+}
+
+// addrIP extracts the IP address of a UDP or TCP address.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return nil
+		}
+		return net.ParseIP(host)
+	}
+}
+
+// addrPort extracts the port of a UDP or TCP address.
+func addrPort(addr net.Addr) int {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.Port
+	case *net.TCPAddr:
+		return a.Port
+	default:
+		_, port, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return 0
+		}
+		parsed, _ := strconv.Atoi(port)
+		return parsed
+	}
 }
@@ -0,0 +1,619 @@
+package turn
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ezshare/server/config"
+	"github.com/ezshare/server/config/ip"
+	"github.com/pion/turn/v2"
+)
+
+// testServer is a TURN server on random local ports.
+type testServer struct {
+	Server
+	udp net.Addr
+	tcp net.Addr
+}
+
+// startTestServer starts a TURN server on random local ports and relays in the port range 45000:45100. The
+// external ip of the server is 127.0.0.2, the peers of the tests listen on 127.0.0.1. The limits are applied
+// per TURN username, the audit log is optional.
+func startTestServer(t *testing.T, limits Limits, audit *AuditLog) *testServer {
+	return startTestServerConfig(t, testConfig(), limits, audit)
+}
+
+// testConfig returns the config of startTestServer, which uses internal credentials.
+func testConfig() *config.Config {
+	return &config.Config{
+		TurnRealm:      "ezshare",
+		TurnMode:       config.TurnModeInternal,
+		TurnPortRange:  "45000:45100",
+		TurnIPProvider: &ip.Static{V4: net.ParseIP("127.0.0.2")},
+	}
+}
+
+// startTestServerConfig starts a TURN server like startTestServer with the given config.
+func startTestServerConfig(t *testing.T, conf *config.Config, limits Limits, audit *AuditLog) *testServer {
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpListener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	quotas := NewQuotas(*conf)
+	quotas.UsernameLimits = limits
+	srv, relay, err := serve(conf, quotas, audit, udpListener, tcpListener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = relay.Close() })
+	return &testServer{Server: srv, udp: udpListener.LocalAddr(), tcp: tcpListener.Addr()}
+}
+
+// dialTestClient connects a TURN client to the server over udp or tcp, and returns it with its local address.
+func dialTestClient(t *testing.T, network string, addr net.Addr, username, password string) (*turn.Client, net.Addr) {
+	var conn net.PacketConn
+	if network == "udp" {
+		udpConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn = udpConn
+	} else {
+		tcpConn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn = turn.NewSTUNConn(tcpConn)
+	}
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: addr.String(),
+		TURNServerAddr: addr.String(),
+		Conn:           conn,
+		Username:       username,
+		Password:       password,
+		Realm:          "ezshare",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	return client, conn.LocalAddr()
+}
+
+// newTCPClient connects a TURN client to the server over TCP.
+func newTCPClient(t *testing.T, addr net.Addr, username, password string) *turn.Client {
+	client, _ := dialTestClient(t, "tcp", addr, username, password)
+	return client
+}
+
+// readAuditRecords waits until the audit log contains count records and returns them.
+func readAuditRecords(t *testing.T, path string, count int) []AllocationRecord {
+	t.Helper()
+	var records []AllocationRecord
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = nil
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		for decoder.More() {
+			var record AllocationRecord
+			if err := decoder.Decode(&record); err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, record)
+		}
+		if len(records) >= count {
+			return records
+		}
+	}
+	t.Fatalf("expected %d audit records, got %d", count, len(records))
+	return nil
+}
+
+func TestRelayOverTCP(t *testing.T) {
+	srv := startTestServer(t, Limits{}, nil)
+	username, password := srv.Credentials("sessionhost", net.ParseIP("127.0.0.1"))
+	client := newTCPClient(t, srv.tcp, username, password)
+
+	relayConn, err := client.Allocate()
+	if err != nil {
+		t.Fatalf("allocate: %s", err)
+	}
+	defer relayConn.Close()
+	relayAddr := relayConn.LocalAddr().(*net.UDPAddr)
+	if relayAddr.Port < 45000 || relayAddr.Port > 45100 {
+		t.Fatalf("relay port %d not in port range", relayAddr.Port)
+	}
+
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if _, err := relayConn.WriteTo([]byte("hello peer"), peer.LocalAddr()); err != nil {
+		t.Fatalf("write to peer: %s", err)
+	}
+
+	buf := make([]byte, 64)
+	_ = peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := peer.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("peer read: %s", err)
+	}
+	if string(buf[:n]) != "hello peer" || from.(*net.UDPAddr).Port != relayAddr.Port {
+		t.Fatalf("unexpected message %q from %s", buf[:n], from)
+	}
+
+	if _, err := peer.WriteTo([]byte("hello client"), from); err != nil {
+		t.Fatal(err)
+	}
+	_ = relayConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err = relayConn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("relay read: %s", err)
+	}
+	if string(buf[:n]) != "hello client" {
+		t.Fatalf("unexpected message %q", buf[:n])
+	}
+}
+
+func TestTCPAllocation(t *testing.T) {
+	srv := startTestServer(t, Limits{}, nil)
+	username, password := srv.Credentials("sessionhost", net.ParseIP("127.0.0.1"))
+	client := newTCPClient(t, srv.tcp, username, password)
+
+	allocation, err := client.AllocateTCP()
+	if err != nil {
+		t.Fatalf("allocate: %s", err)
+	}
+	defer allocation.Close()
+	relayAddr := allocation.Addr().(*net.TCPAddr)
+	if relayAddr.Port < 45000 || relayAddr.Port > 45100 {
+		t.Fatalf("relay port %d not in port range", relayAddr.Port)
+	}
+
+	peer, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	dataConn, err := net.Dial("tcp", srv.tcp.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := allocation.DialTCPWithConn(dataConn, "tcp", peer.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatalf("connect peer: %s", err)
+	}
+	defer conn.Close()
+	peerConn, err := peer.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConn.Close()
+	if port := peerConn.RemoteAddr().(*net.TCPAddr).Port; port != relayAddr.Port {
+		t.Errorf("peer connection from port %d instead of the relay port %d", port, relayAddr.Port)
+	}
+	expectEcho(t, conn, peerConn, "hello peer")
+	expectEcho(t, peerConn, conn, "hello client")
+
+	// A peer connecting to the relayed address, the permission of the first peer covers its ip
+	go func() {
+		incoming, err := net.Dial("tcp", relayAddr.String())
+		if err != nil {
+			return
+		}
+		defer incoming.Close()
+		buf := make([]byte, 64)
+		n, err := incoming.Read(buf)
+		if err != nil {
+			return
+		}
+		_, _ = incoming.Write(buf[:n])
+	}()
+	_ = allocation.SetDeadline(time.Now().Add(5 * time.Second))
+	accepted, err := allocation.Accept()
+	if err != nil {
+		t.Fatalf("accept peer: %s", err)
+	}
+	defer accepted.Close()
+	if _, err := accepted.Write([]byte("echo")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	_ = accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := accepted.Read(buf); err != nil || string(buf[:n]) != "echo" {
+		t.Fatalf("unexpected echo %q: %v", buf[:n], err)
+	}
+
+	// Other services on the external ip of the server are refused
+	service, err := net.Listen("tcp4", "127.0.0.2:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	dataConn, err = net.Dial("tcp", srv.tcp.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dataConn.Close()
+	if _, err := allocation.DialTCPWithConn(dataConn, "tcp", service.Addr().(*net.TCPAddr)); err == nil {
+		t.Fatal("connected to a service on the external ip of the server")
+	}
+}
+
+// expectEcho writes the message to one connection and expects to read it from the other.
+func expectEcho(t *testing.T, from, to net.Conn, message string) {
+	t.Helper()
+	if _, err := from.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(message))
+	_ = to.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(to, buf); err != nil {
+		t.Fatalf("read %q: %s", message, err)
+	}
+	if string(buf) != message {
+		t.Fatalf("unexpected message %q", buf)
+	}
+}
+
+func TestRelayOverTLS(t *testing.T) {
+	conf := testConfig()
+	conf.TurnTLSAddress = "127.0.0.1:0"
+	conf.TurnTLSCertFile, conf.TurnTLSKeyFile = writeTestCertificate(t)
+	tlsListener, err := listenTLS(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, relay, err := serve(conf, NewQuotas(*conf), nil, udpListener, tlsListener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+
+	tlsConn, err := tls.Dial("tcp", tlsListener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	username, password := srv.Credentials("sessionhost", net.ParseIP("127.0.0.1"))
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: tlsListener.Addr().String(),
+		TURNServerAddr: tlsListener.Addr().String(),
+		Conn:           turn.NewSTUNConn(tlsConn),
+		Username:       username,
+		Password:       password,
+		Realm:          "ezshare",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	relayConn, err := client.Allocate()
+	if err != nil {
+		t.Fatalf("allocate over tls: %s", err)
+	}
+	defer relayConn.Close()
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if _, err := relayConn.WriteTo([]byte("hello peer"), peer.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	_ = peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, _, err := peer.ReadFrom(buf); err != nil || string(buf[:n]) != "hello peer" {
+		t.Fatalf("unexpected message %q: %v", buf[:n], err)
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and returns the certificate and key file.
+func writeTestCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ezshare"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestRelayRejectsOtherAddress(t *testing.T) {
+	srv := startTestServer(t, Limits{}, nil)
+	username, password := srv.Credentials("sessionclient", net.ParseIP("192.0.2.1"))
+	client := newTCPClient(t, srv.tcp, username, password)
+
+	if _, err := client.Allocate(); err == nil {
+		t.Fatal("allocation with credentials of another address succeeded")
+	}
+}
+
+func TestRelayToServerAddress(t *testing.T) {
+	srv := startTestServer(t, Limits{}, nil)
+	username, password := srv.Credentials("sessionhost", net.ParseIP("127.0.0.1"))
+	host := newTCPClient(t, srv.tcp, username, password)
+	username, password = srv.Credentials("sessionclient", net.ParseIP("127.0.0.1"))
+	guest := newTCPClient(t, srv.tcp, username, password)
+
+	hostConn, err := host.Allocate()
+	if err != nil {
+		t.Fatalf("allocate: %s", err)
+	}
+	defer hostConn.Close()
+	guestConn, err := guest.Allocate()
+	if err != nil {
+		t.Fatalf("allocate: %s", err)
+	}
+	defer guestConn.Close()
+
+	// Another service on the external ip of the server
+	service, err := net.ListenPacket("udp4", "127.0.0.2:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	if _, err := hostConn.WriteTo([]byte("hello service"), service.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The relay of the guest on the external ip is reachable, the permissions of the guest cover the
+	// source address the kernel picks for the relay of the host.
+	hostPort := hostConn.LocalAddr().(*net.UDPAddr).Port
+	for _, peer := range []string{"127.0.0.1", "127.0.0.2"} {
+		if _, err := guestConn.WriteTo([]byte("ping"), &net.UDPAddr{IP: net.ParseIP(peer), Port: hostPort}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := hostConn.WriteTo([]byte("hello guest"), guestConn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	_ = guestConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := guestConn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("guest read: %s", err)
+	}
+	if string(buf[:n]) != "hello guest" {
+		t.Fatalf("unexpected message %q", buf[:n])
+	}
+
+	_ = service.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, from, err := service.ReadFrom(buf); err == nil {
+		t.Fatalf("service received %q from %s", buf[:n], from)
+	}
+}
+
+func TestAllocationQuota(t *testing.T) {
+	srv := startTestServer(t, Limits{Allocations: 1}, nil)
+	username, password := srv.Credentials("sessionhost", net.ParseIP("127.0.0.1"))
+
+	relayConn, err := newTCPClient(t, srv.tcp, username, password).Allocate()
+	if err != nil {
+		t.Fatalf("allocate: %s", err)
+	}
+	defer relayConn.Close()
+
+	if _, err := newTCPClient(t, srv.tcp, username, password).Allocate(); err == nil {
+		t.Fatal("second allocation exceeding the quota succeeded")
+	}
+}
+
+func TestTrafficQuota(t *testing.T) {
+	srv := startTestServer(t, Limits{TotalBytes: 32}, nil)
+	exceeded := make(chan string, 1)
+	srv.Track("sessionhost", Owner{Room: "room", User: "admin", Exceeded: func(username, reason string) {
+		exceeded <- reason
+	}})
+	username, password := srv.Credentials("sessionhost", net.ParseIP("127.0.0.1"))
+	relayConn, err := newTCPClient(t, srv.tcp, username, password).Allocate()
+	if err != nil {
+		t.Fatalf("allocate: %s", err)
+	}
+	defer relayConn.Close()
+
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := relayConn.WriteTo([]byte("sixteen bytes!!!"), peer.LocalAddr()); err != nil {
+			t.Fatalf("write to peer: %s", err)
+		}
+	}
+
+	select {
+	case reason := <-exceeded:
+		t.Log(reason)
+	case <-time.After(5 * time.Second):
+		t.Fatal("owner was not notified")
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	srv := startTestServer(t, Limits{}, audit)
+	srv.Track("sessionhost", Owner{Room: "room", Session: "session", User: "admin", Authenticated: true})
+	username, password := srv.Credentials("sessionhost", net.ParseIP("127.0.0.1"))
+	relayConn, err := newTCPClient(t, srv.tcp, username, password).Allocate()
+	if err != nil {
+		t.Fatalf("allocate: %s", err)
+	}
+
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if _, err := relayConn.WriteTo([]byte("sixteen bytes!!!"), peer.LocalAddr()); err != nil {
+		t.Fatalf("write to peer: %s", err)
+	}
+	_ = peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := peer.ReadFrom(make([]byte, 64)); err != nil {
+		t.Fatalf("peer read: %s", err)
+	}
+	_ = relayConn.Close()
+
+	record := readAuditRecords(t, path, 1)[0]
+	if record.Username != "sessionhost" || record.Room != "room" || record.User != "admin" || record.BytesOut != 16 {
+		t.Fatalf("unexpected record %+v", record)
+	}
+}
+
+func TestConcurrentAllocations(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.jsonl")
+			audit, err := OpenAuditLog(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer audit.Close()
+			srv := startTestServer(t, Limits{}, audit)
+			addr := srv.udp
+			if network == "tcp" {
+				addr = srv.tcp
+			}
+
+			const rounds = 5
+			expected := map[string]string{} // client address to username
+			var lock sync.Mutex
+			for i := 0; i < rounds; i++ {
+				var wg sync.WaitGroup
+				for _, id := range []string{fmt.Sprint("sessiona", i), fmt.Sprint("sessionb", i)} {
+					srv.Track(id, Owner{Session: id})
+					username, password := srv.Credentials(id, net.ParseIP("127.0.0.1"))
+					client, local := dialTestClient(t, network, addr, username, password)
+					lock.Lock()
+					expected[local.String()] = username
+					lock.Unlock()
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						relayConn, err := client.Allocate()
+						if err != nil {
+							t.Errorf("allocate: %s", err)
+							return
+						}
+						_ = relayConn.Close()
+					}()
+				}
+				wg.Wait()
+			}
+
+			for _, record := range readAuditRecords(t, path, 2*rounds) {
+				if username := expected[record.ClientAddress]; record.Username != username || record.Session != username {
+					t.Errorf("allocation of %s (%s) attributed to %s (%s)", record.ClientAddress, username, record.Username, record.Session)
+				}
+			}
+		})
+	}
+}
+
+func TestAuditLogQuota(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	// The burst of the bandwidth limit is used up by the first packet to the peer.
+	srv := startTestServer(t, Limits{BytesPerSecond: 16, Allocations: 1}, audit)
+	username, password := srv.Credentials("sessionhost", net.ParseIP("127.0.0.1"))
+	relayConn, err := newTCPClient(t, srv.tcp, username, password).Allocate()
+	if err != nil {
+		t.Fatalf("allocate: %s", err)
+	}
+	if _, err := newTCPClient(t, srv.tcp, username, password).Allocate(); err == nil {
+		t.Fatal("second allocation exceeding the quota succeeded")
+	}
+	if record := readAuditRecords(t, path, 1)[0]; record.Rejected != ErrAllocationQuota.Error() || record.Username != "sessionhost" {
+		t.Fatalf("unexpected record of the rejected allocation %+v", record)
+	}
+
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	if _, err := relayConn.WriteTo([]byte("sixteen bytes!!!"), peer.LocalAddr()); err != nil {
+		t.Fatalf("write to peer: %s", err)
+	}
+	_ = peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, from, err := peer.ReadFrom(make([]byte, 64))
+	if err != nil {
+		t.Fatalf("peer read: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := peer.WriteTo([]byte("sixteen bytes!!!"), from); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	_ = relayConn.Close()
+
+	if record := readAuditRecords(t, path, 2)[1]; record.Rejected != "" || record.BytesOut != 16 || record.BytesIn != 0 {
+		t.Fatalf("dropped packets counted %+v", record)
+	}
+}
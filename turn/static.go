@@ -1,26 +1,74 @@
 package turn
 
 import (
-	"github.com/pion/transport/v2"
+	"errors"
+	"fmt"
 	"net"
+	"strconv"
+
+	"github.com/pion/transport/v2"
+	"github.com/pion/transport/v2/stdnet"
 )
 
+// DelayAddressGeneratorStatic binds the relay connections to a specific local Address and advertises a
+// fixed RelayAddress, e.g. the public ip of a 1:1 NAT.
 type DelayAddressGeneratorStatic struct {
+	// RelayAddress is the ip advertised to the clients
 	RelayAddress net.IP
 
+	// Address is the local ip the relay connections are bound to
 	Address string
 
 	Net transport.Net
 }
 
+// Validate confirms that the generator is properly initialized.
 func (g *DelayAddressGeneratorStatic) Validate() error {
-	return nil
+	if g.Net == nil {
+		var err error
+		g.Net, err = stdnet.NewNet()
+		if err != nil {
+			return fmt.Errorf("failed to create network: %w", err)
+		}
+	}
+
+	switch {
+	case g.RelayAddress == nil:
+		return errors.New("relay address of static relay address generator not set")
+	case g.Address == "":
+		return errors.New("listening address of static relay address generator not set")
+	default:
+		return nil
+	}
 }
 
+// AllocatePacketConn allocates a PacketConn (UDP) on the local Address and returns the RelayAddress with
+// the allocated port.
 func (g *DelayAddressGeneratorStatic) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
-	return nil, nil, nil
+	conn, err := g.Net.ListenPacket(network, net.JoinHostPort(g.Address, strconv.Itoa(requestedPort)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	localAddr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		_ = conn.Close()
+		return nil, nil, errors.New("relay connection has no udp address")
+	}
+	return conn, &net.UDPAddr{IP: g.RelayAddress, Port: localAddr.Port}, nil
+}
+
+// AllocateListener allocates a Listener (TCP) on the local Address and returns the RelayAddress with the
+// allocated port.
+func (g *DelayAddressGeneratorStatic) AllocateListener(network string, requestedPort int) (net.Listener, net.Addr, error) {
+	listener, err := listenTCP(net.JoinHostPort(g.Address, strconv.Itoa(requestedPort)))
+	if err != nil {
+		return nil, nil, err
+	}
+	return listener, &net.TCPAddr{IP: g.RelayAddress, Port: listener.Addr().(*net.TCPAddr).Port}, nil
 }
 
+// AllocateConn is not used, see errConnNotSupported.
 func (g *DelayAddressGeneratorStatic) AllocateConn(network string, requestedPort int) (net.Conn, net.Addr, error) {
-	return nil, nil, nil
+	return nil, nil, errConnNotSupported
 }
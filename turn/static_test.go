@@ -0,0 +1,30 @@
+package turn
+
+import (
+	"net"
+	"testing"
+)
+
+func TestStaticGenerator(t *testing.T) {
+	gen := &DelayAddressGeneratorStatic{RelayAddress: net.ParseIP("203.0.113.1"), Address: "127.0.0.1"}
+	if err := gen.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	conn, addr, err := gen.AllocatePacketConn("udp4", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	local := conn.LocalAddr().(*net.UDPAddr)
+	relay := addr.(*net.UDPAddr)
+	if !local.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("relay bound to %s", local)
+	}
+	if !relay.IP.Equal(gen.RelayAddress) || relay.Port != local.Port {
+		t.Fatalf("unexpected relay address %s for %s", relay, local)
+	}
+	if err := (&DelayAddressGeneratorStatic{Address: "127.0.0.1"}).Validate(); err == nil {
+		t.Fatal("generator without relay address is valid")
+	}
+}
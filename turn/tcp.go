@@ -0,0 +1,710 @@
+package turn
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// tcpHandshakeTimeout closes TCP and TLS connections which do not send their first message in time.
+	tcpHandshakeTimeout = time.Minute
+	// tcpConnectTimeout is the time the relay waits for the connection to a peer, see RFC 6062 section 5.2.
+	tcpConnectTimeout = 30 * time.Second
+	// tcpBindTimeout closes peer connections which are not bound by the client in time, see RFC 6062 section 5.3.
+	tcpBindTimeout = 30 * time.Second
+	// tcpBufferSize is the most bytes relayed at once between a peer and the client.
+	tcpBufferSize = 16 * 1024
+	// tcpThrottleDelay is the time a throttled TCP connection waits before relaying again.
+	tcpThrottleDelay = 20 * time.Millisecond
+	// permissionLifetime is the lifetime of a permission, see RFC 5766 section 8.
+	permissionLifetime = 5 * time.Minute
+	// defaultLifetime and maxLifetime bound the lifetime of allocations like pion, see RFC 5766 section 6.2.
+	defaultLifetime = 10 * time.Minute
+	maxLifetime     = time.Hour
+	// nonceLifetime is the time a nonce stays valid.
+	nonceLifetime = time.Hour
+	// protoTCP is the REQUESTED-TRANSPORT of TCP allocations.
+	protoTCP = 6
+	// stunHeaderSize is the size of the STUN message header.
+	stunHeaderSize = 20
+)
+
+// errNoListener is returned when the relay address generator cannot allocate TCP relays.
+var errNoListener = errors.New("relay address generator does not allocate tcp relays")
+
+var (
+	allocateRequest         = stun.NewType(stun.MethodAllocate, stun.ClassRequest)
+	refreshRequest          = stun.NewType(stun.MethodRefresh, stun.ClassRequest)
+	createPermissionRequest = stun.NewType(stun.MethodCreatePermission, stun.ClassRequest)
+	channelBindRequest      = stun.NewType(stun.MethodChannelBind, stun.ClassRequest)
+	sendIndication          = stun.NewType(stun.MethodSend, stun.ClassIndication)
+	connectRequest          = stun.NewType(stun.MethodConnect, stun.ClassRequest)
+	connectionBindRequest   = stun.NewType(stun.MethodConnectionBind, stun.ClassRequest)
+	connectionAttempt       = stun.NewType(stun.MethodConnectionAttempt, stun.ClassIndication)
+)
+
+// listenerGenerator is implemented by the relay address generators which allocate the listeners of TCP
+// allocations.
+type listenerGenerator interface {
+	AllocateListener(network string, requestedPort int) (net.Listener, net.Addr, error)
+}
+
+// tcpAllocation is a TCP allocation of RFC 6062, which pion does not support. Its requests are answered by
+// the relay on the control connection of the client. Every connection to a peer gets a connection id, and is
+// relayed once the client binds it on a new data connection.
+type tcpAllocation struct {
+	relay    *relay
+	client   *client
+	control  net.Conn
+	username string
+	listener net.Listener
+	addr     *net.TCPAddr // The relayed transport address advertised to the client
+	quota    *allocationQuota
+	audit    *auditEntry
+
+	lock        sync.Mutex
+	timer       *time.Timer
+	permissions map[string]time.Time
+	conns       map[uint32]*peerConn
+	closed      bool
+}
+
+// peerConn is a connection of a TCP allocation to a peer.
+type peerConn struct {
+	id         uint32
+	allocation *tcpAllocation
+	addr       *net.TCPAddr
+	conn       net.Conn // Nil while connecting to the peer
+	timer      *time.Timer
+	bound      bool // Protected by the lock of relay
+}
+
+// handleDatagram rejects the requests of RFC 6062 received over UDP. It returns false for the messages pion
+// handles.
+func (r *relay) handleDatagram(c *udpConn, m *stun.Message) bool {
+	if (m.Type != allocateRequest || requestedTransport(m) != protoTCP) && m.Type != connectRequest && m.Type != connectionBindRequest {
+		return false
+	}
+	_, _ = c.WriteTo(response(m, nil, stun.CodeBadRequest), c.client.addr)
+	return true
+}
+
+// handleStream handles the requests of TCP allocations received on the control connection of a TCP or TLS
+// client. It returns false for the messages pion handles.
+func (r *relay) handleStream(c *streamConn, m *stun.Message) bool {
+	allocation := c.client.tcpAllocation()
+	switch {
+	case m.Type == allocateRequest && (allocation != nil || requestedTransport(m) == protoTCP):
+	case m.Type == connectRequest:
+	case allocation != nil && (m.Type == refreshRequest || m.Type == createPermissionRequest || m.Type == channelBindRequest):
+	case allocation != nil && m.Type == sendIndication:
+		return true
+	default:
+		return false
+	}
+
+	username, key, reject := r.authenticateRequest(m, c.client.addr)
+	if reject != nil {
+		_, _ = c.conn.Write(reject)
+		return true
+	}
+	var reply []byte
+	switch {
+	case m.Type == allocateRequest:
+		reply = r.allocateTCP(c, m, username, key)
+	case allocation == nil:
+		reply = response(m, key, stun.CodeAllocMismatch)
+	case allocation.username != username:
+		reply = response(m, key, stun.CodeWrongCredentials)
+	case m.Type == refreshRequest:
+		reply = allocation.refresh(m, key)
+	case m.Type == createPermissionRequest:
+		reply = allocation.createPermissions(m, key)
+	case m.Type == connectRequest:
+		reply = allocation.connect(m, key)
+	default:
+		reply = response(m, key, stun.CodeBadRequest)
+	}
+	if reply != nil {
+		_, _ = c.conn.Write(reply)
+	}
+	return true
+}
+
+// authenticateRequest checks the long-term credentials of a request, see RFC 5389 section 10.2.2. It returns
+// the username and key of the request, or the error response to send.
+func (r *relay) authenticateRequest(m *stun.Message, addr net.Addr) (string, []byte, []byte) {
+	realm := stun.NewRealm(r.config.TurnRealm)
+	if !m.Contains(stun.AttrMessageIntegrity) {
+		return "", nil, response(m, nil, stun.CodeUnauthorized, realm, stun.NewNonce(r.nonces.next()))
+	}
+	var username stun.Username
+	var requestRealm stun.Realm
+	var nonce stun.Nonce
+	if username.GetFrom(m) != nil || requestRealm.GetFrom(m) != nil || nonce.GetFrom(m) != nil {
+		return "", nil, response(m, nil, stun.CodeBadRequest)
+	}
+	if !r.nonces.valid(nonce.String()) {
+		return "", nil, response(m, nil, stun.CodeStaleNonce, realm, stun.NewNonce(r.nonces.next()))
+	}
+	key, ok := r.auth(username.String(), requestRealm.String(), addr)
+	if !ok || stun.MessageIntegrity(key).Check(m) != nil {
+		return "", nil, response(m, nil, stun.CodeUnauthorized, realm, stun.NewNonce(r.nonces.next()))
+	}
+	return username.String(), key, nil
+}
+
+// allocateTCP creates the TCP allocation of the client, and returns the response to the allocate request.
+func (r *relay) allocateTCP(c *streamConn, m *stun.Message, username string, key []byte) []byte {
+	if c.client.allocated() {
+		return response(m, key, stun.CodeAllocMismatch)
+	}
+	if m.Contains(stun.AttrDontFragment) || m.Contains(stun.AttrEvenPort) || m.Contains(stun.AttrReservationToken) {
+		return response(m, key, stun.CodeBadRequest)
+	}
+
+	gen := r.newGenerator(c.client)
+	listener, relayAddr, err := gen.AllocateListener()
+	if err != nil {
+		log.Warn().Err(err).Str("username", username).Msg("Failed to allocate TCP relay")
+		return response(m, key, stun.CodeInsufficientCapacity)
+	}
+	quota, entry, err := gen.account(username, relayAddr)
+	if err != nil {
+		_ = listener.Close()
+		r.policy.removeRelay("tcp", listener.Addr().(*net.TCPAddr).Port)
+		return response(m, key, stun.CodeAllocQuotaReached)
+	}
+
+	lifetime := requestedLifetime(m)
+	if lifetime == 0 {
+		lifetime = defaultLifetime
+	}
+	a := &tcpAllocation{
+		relay:       r,
+		client:      c.client,
+		control:     c.conn,
+		username:    username,
+		listener:    listener,
+		addr:        relayAddr,
+		quota:       quota,
+		audit:       entry,
+		permissions: map[string]time.Time{},
+		conns:       map[uint32]*peerConn{},
+	}
+	a.timer = time.AfterFunc(lifetime, a.close)
+	c.client.setTCPAllocation(a)
+	go a.accept()
+
+	log.Debug().
+		Str("addr", listener.Addr().String()).
+		Str("relayaddr", relayAddr.String()).
+		Str("username", username).
+		Msg("TURN TCP allocated")
+	return response(m, key, 0,
+		xorAddress{attr: stun.AttrXORRelayedAddress, addr: relayAddr},
+		lifetimeAttr(lifetime),
+		xorAddress{attr: stun.AttrXORMappedAddress, addr: c.client.addr})
+}
+
+// bind binds a new data connection of a client to a peer connection, and relays between them until either
+// is closed. The connection is closed when the connection bind request is rejected.
+func (r *relay) bind(conn net.Conn, m *stun.Message) {
+	username, key, reject := r.authenticateRequest(m, conn.RemoteAddr())
+	if reject != nil {
+		_, _ = conn.Write(reject)
+		r.closeConn(conn)
+		return
+	}
+	var id connectionID
+	if id.GetFrom(m) != nil {
+		_, _ = conn.Write(response(m, key, stun.CodeBadRequest))
+		r.closeConn(conn)
+		return
+	}
+
+	r.lock.Lock()
+	pc, ok := r.peers[uint32(id)]
+	ok = ok && !pc.bound && pc.conn != nil && pc.allocation.username == username
+	if ok {
+		pc.bound = true
+	}
+	r.lock.Unlock()
+	if !ok {
+		_, _ = conn.Write(response(m, key, stun.CodeBadRequest))
+		r.closeConn(conn)
+		return
+	}
+	pc.timer.Stop()
+	if _, err := conn.Write(response(m, key, 0)); err != nil {
+		r.closeConn(conn)
+		pc.allocation.remove(pc)
+		return
+	}
+	pc.allocation.pipe(pc, conn)
+}
+
+// accept accepts the connections of peers until the allocation is closed. Connections of peers without
+// permission are closed, the client is notified of the others with a connection attempt indication.
+func (a *tcpAllocation) accept() {
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			return
+		}
+		peer := conn.RemoteAddr().(*net.TCPAddr)
+		if !a.permitted(peer.IP) || !a.relay.policy.Relayable("tcp", peer) {
+			log.Debug().Str("peer", peer.String()).Str("username", a.username).Msg("Rejected TCP peer without permission")
+			_ = conn.Close()
+			continue
+		}
+		pc := a.add(peer)
+		if pc == nil || !a.connected(pc, conn) {
+			_ = conn.Close()
+			continue
+		}
+		indication, err := stun.Build(connectionAttempt, stun.TransactionID,
+			xorAddress{attr: stun.AttrXORPeerAddress, addr: peer}, connectionID(pc.id), stun.Fingerprint)
+		if err != nil {
+			a.remove(pc)
+			continue
+		}
+		if _, err := a.control.Write(indication.Raw); err != nil {
+			a.remove(pc)
+		}
+	}
+}
+
+// connect connects to a peer, the response is sent when the connection is established or failed.
+func (a *tcpAllocation) connect(m *stun.Message, key []byte) []byte {
+	peers := peerAddresses(m)
+	if len(peers) != 1 {
+		return response(m, key, stun.CodeBadRequest)
+	}
+	peer := peers[0]
+	if !a.permitted(peer.IP) || !a.relay.policy.Relayable("tcp", peer) {
+		return response(m, key, stun.CodeForbidden)
+	}
+	pc := a.add(peer)
+	if pc == nil {
+		return response(m, key, stun.CodeConnAlreadyExists)
+	}
+	go func() {
+		conn, err := dialTCP(a.listener.Addr().(*net.TCPAddr), peer)
+		if err != nil {
+			log.Debug().Err(err).Str("peer", peer.String()).Str("username", a.username).Msg("Failed to connect TCP peer")
+			a.remove(pc)
+			_, _ = a.control.Write(response(m, key, stun.CodeConnTimeoutOrFailure))
+			return
+		}
+		if !a.connected(pc, conn) {
+			_ = conn.Close()
+			_, _ = a.control.Write(response(m, key, stun.CodeConnTimeoutOrFailure))
+			return
+		}
+		_, _ = a.control.Write(response(m, key, 0, connectionID(pc.id)))
+	}()
+	return nil
+}
+
+// add registers a connection to the peer with a new connection id. It returns nil when the allocation is
+// closed, or when a connection to the peer exists already.
+func (a *tcpAllocation) add(peer *net.TCPAddr) *peerConn {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.closed {
+		return nil
+	}
+	for _, existing := range a.conns {
+		if existing.addr.String() == peer.String() {
+			return nil
+		}
+	}
+
+	pc := &peerConn{allocation: a, addr: peer}
+	a.relay.lock.Lock()
+	for pc.id == 0 || a.relay.peers[pc.id] != nil {
+		var b [4]byte
+		_, _ = rand.Read(b[:])
+		pc.id = binary.BigEndian.Uint32(b[:])
+	}
+	a.relay.peers[pc.id] = pc
+	a.relay.lock.Unlock()
+	a.conns[pc.id] = pc
+	return pc
+}
+
+// connected sets the connection to the peer and starts waiting for the bind of the client. It returns false
+// when the allocation was closed meanwhile.
+func (a *tcpAllocation) connected(pc *peerConn, conn net.Conn) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.closed {
+		return false
+	}
+	a.relay.lock.Lock()
+	pc.conn = conn
+	a.relay.lock.Unlock()
+	pc.timer = time.AfterFunc(tcpBindTimeout, func() {
+		a.relay.lock.Lock()
+		bound := pc.bound
+		a.relay.lock.Unlock()
+		if !bound {
+			log.Debug().Str("peer", pc.addr.String()).Str("username", a.username).Msg("TCP peer connection was not bound")
+			a.remove(pc)
+		}
+	})
+	return true
+}
+
+// remove closes a peer connection and forgets its connection id.
+func (a *tcpAllocation) remove(pc *peerConn) {
+	a.lock.Lock()
+	delete(a.conns, pc.id)
+	a.lock.Unlock()
+	a.relay.lock.Lock()
+	delete(a.relay.peers, pc.id)
+	conn := pc.conn
+	a.relay.lock.Unlock()
+	if pc.timer != nil {
+		pc.timer.Stop()
+	}
+	if conn != nil {
+		_ = conn.Close()
+	}
+}
+
+// pipe relays between the peer connection and the data connection of the client until either is closed.
+func (a *tcpAllocation) pipe(pc *peerConn, conn net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		_ = a.copy(pc.conn, conn, func(n int) {
+			if a.audit != nil {
+				a.audit.out(n)
+			}
+		})
+		a.remove(pc)
+		a.relay.closeConn(conn)
+		close(done)
+	}()
+	_ = a.copy(conn, pc.conn, func(n int) {
+		if a.audit != nil {
+			a.audit.in(n)
+		}
+	})
+	a.remove(pc)
+	a.relay.closeConn(conn)
+	<-done
+}
+
+// copy copies from src to dst. Reading is paused while the quota throttles the allocation, and stopped when
+// the quota is exhausted.
+func (a *tcpAllocation) copy(dst, src net.Conn, count func(int)) error {
+	size := tcpBufferSize
+	if a.quota != nil {
+		if burst := a.quota.burst(); burst > 0 && burst < size {
+			size = burst
+		}
+	}
+	buf := make([]byte, size)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if !a.allow(n) {
+				return ErrAllocationQuota
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+			count(n)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// allow waits until the quota allows relaying n bytes, the allocation is closed when its quota is exhausted.
+func (a *tcpAllocation) allow(n int) bool {
+	if a.quota == nil {
+		return true
+	}
+	for {
+		relay, exhausted := a.quota.allow(n)
+		if exhausted {
+			a.close()
+			return false
+		}
+		if relay {
+			return true
+		}
+		time.Sleep(tcpThrottleDelay)
+	}
+}
+
+// refresh refreshes or deletes the allocation.
+func (a *tcpAllocation) refresh(m *stun.Message, key []byte) []byte {
+	lifetime := requestedLifetime(m)
+	if lifetime == 0 {
+		a.close()
+	} else {
+		a.lock.Lock()
+		a.timer.Reset(lifetime)
+		a.lock.Unlock()
+	}
+	return response(m, key, 0, lifetimeAttr(lifetime))
+}
+
+// createPermissions installs or refreshes the permissions of the peers of the request.
+func (a *tcpAllocation) createPermissions(m *stun.Message, key []byte) []byte {
+	peers := peerAddresses(m)
+	if len(peers) == 0 {
+		return response(m, key, stun.CodeBadRequest)
+	}
+	for _, peer := range peers {
+		if !a.relay.policy.Permit(a.client.addr, peer.IP) {
+			return response(m, key, stun.CodeForbidden)
+		}
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, peer := range peers {
+		a.permissions[peer.IP.String()] = time.Now().Add(permissionLifetime)
+	}
+	return response(m, key, 0)
+}
+
+// permitted checks if the allocation has a permission for the peer ip.
+func (a *tcpAllocation) permitted(peerIP net.IP) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	expiry, ok := a.permissions[peerIP.String()]
+	return ok && time.Now().Before(expiry)
+}
+
+// close closes the allocation with its peer connections, frees its quota and writes its audit record.
+func (a *tcpAllocation) close() {
+	a.lock.Lock()
+	if a.closed {
+		a.lock.Unlock()
+		return
+	}
+	a.closed = true
+	a.timer.Stop()
+	conns := a.conns
+	a.conns = map[uint32]*peerConn{}
+	a.lock.Unlock()
+
+	_ = a.listener.Close()
+	for _, pc := range conns {
+		a.remove(pc)
+	}
+	a.relay.policy.removeRelay("tcp", a.listener.Addr().(*net.TCPAddr).Port)
+	if a.quota != nil {
+		a.quota.release()
+	}
+	if a.audit != nil {
+		a.audit.finish()
+	}
+	a.client.clearTCPAllocation(a)
+	log.Debug().Str("relayaddr", a.addr.String()).Str("username", a.username).Msg("TURN TCP allocation closed")
+}
+
+// readFirstMessage reads the first message of a new TCP or TLS connection. A connection bind request is
+// returned decoded, other connections are returned with the read bytes replayed, so that pion can serve them.
+func readFirstMessage(conn net.Conn) (net.Conn, *stun.Message, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(tcpHandshakeTimeout))
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+	header := make([]byte, stunHeaderSize)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, nil, err
+	}
+	if !stun.IsMessage(header) || binary.BigEndian.Uint16(header[0:2]) != connectionBindRequest.Value() {
+		return &prefixConn{Conn: conn, prefix: header}, nil, nil
+	}
+	raw := make([]byte, stunHeaderSize+int(binary.BigEndian.Uint16(header[2:4])))
+	copy(raw, header)
+	if _, err := io.ReadFull(conn, raw[stunHeaderSize:]); err != nil {
+		return nil, nil, err
+	}
+	m := &stun.Message{Raw: raw}
+	if err := m.Decode(); err != nil {
+		return nil, nil, err
+	}
+	return conn, m, nil
+}
+
+// prefixConn replays the bytes read from a connection before reading from it again.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// decodeMessage decodes a STUN message, it returns nil for other data like channel data.
+func decodeMessage(p []byte) *stun.Message {
+	if !stun.IsMessage(p) {
+		return nil
+	}
+	m := &stun.Message{Raw: append([]byte(nil), p...)}
+	if err := m.Decode(); err != nil {
+		return nil
+	}
+	return m
+}
+
+// response builds a response to the request, a success response if the code is zero. Responses to
+// authenticated requests carry the message integrity of the key.
+func response(m *stun.Message, key []byte, code stun.ErrorCode, attrs ...stun.Setter) []byte {
+	class := stun.ClassSuccessResponse
+	if code != 0 {
+		class = stun.ClassErrorResponse
+	}
+	setters := []stun.Setter{stun.NewType(m.Type.Method, class), stun.NewTransactionIDSetter(m.TransactionID)}
+	if code != 0 {
+		setters = append(setters, code)
+	}
+	setters = append(setters, attrs...)
+	if key != nil {
+		setters = append(setters, stun.MessageIntegrity(key))
+	}
+	res, err := stun.Build(append(setters, stun.Fingerprint)...)
+	if err != nil {
+		log.Error().Err(err).Str("method", m.Type.Method.String()).Msg("Failed to build TURN response")
+		return nil
+	}
+	return res.Raw
+}
+
+// requestedTransport returns the protocol of the REQUESTED-TRANSPORT attribute, or zero if it is missing.
+func requestedTransport(m *stun.Message) byte {
+	v, err := m.Get(stun.AttrRequestedTransport)
+	if err != nil || len(v) == 0 {
+		return 0
+	}
+	return v[0]
+}
+
+// requestedLifetime returns the lifetime requested with the LIFETIME attribute, bounded like pion does.
+func requestedLifetime(m *stun.Message) time.Duration {
+	v, err := m.Get(stun.AttrLifetime)
+	if err != nil || len(v) != 4 {
+		return defaultLifetime
+	}
+	lifetime := time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+	if lifetime > maxLifetime {
+		return maxLifetime
+	}
+	return lifetime
+}
+
+// peerAddresses returns the XOR-PEER-ADDRESS attributes of the message.
+func peerAddresses(m *stun.Message) []*net.TCPAddr {
+	var peers []*net.TCPAddr
+	for _, attr := range m.Attributes {
+		if attr.Type != stun.AttrXORPeerAddress {
+			continue
+		}
+		single := &stun.Message{TransactionID: m.TransactionID}
+		single.Add(attr.Type, attr.Value)
+		var addr stun.XORMappedAddress
+		if addr.GetFromAs(single, stun.AttrXORPeerAddress) != nil {
+			return nil
+		}
+		peers = append(peers, &net.TCPAddr{IP: addr.IP, Port: addr.Port})
+	}
+	return peers
+}
+
+// connectionID is the CONNECTION-ID attribute, see RFC 6062 section 6.2.1.
+type connectionID uint32
+
+func (id connectionID) AddTo(m *stun.Message) error {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(id))
+	m.Add(stun.AttrConnectionID, v)
+	return nil
+}
+
+func (id *connectionID) GetFrom(m *stun.Message) error {
+	v, err := m.Get(stun.AttrConnectionID)
+	if err != nil {
+		return err
+	}
+	if len(v) != 4 {
+		return stun.ErrAttributeSizeInvalid
+	}
+	*id = connectionID(binary.BigEndian.Uint32(v))
+	return nil
+}
+
+// lifetimeAttr is the LIFETIME attribute, see RFC 5766 section 14.2.
+type lifetimeAttr time.Duration
+
+func (l lifetimeAttr) AddTo(m *stun.Message) error {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(time.Duration(l)/time.Second))
+	m.Add(stun.AttrLifetime, v)
+	return nil
+}
+
+// xorAddress is an attribute in the format of XOR-MAPPED-ADDRESS, e.g. XOR-RELAYED-ADDRESS.
+type xorAddress struct {
+	attr stun.AttrType
+	addr net.Addr
+}
+
+func (a xorAddress) AddTo(m *stun.Message) error {
+	return stun.XORMappedAddress{IP: addrIP(a.addr), Port: addrPort(a.addr)}.AddToAs(m, a.attr)
+}
+
+// nonces issues stateless nonces, which stay valid across the connections of a client as needed for the
+// connection bind requests. A nonce is its issue time and the HMAC of it.
+type nonces struct {
+	key []byte
+}
+
+func newNonces() *nonces {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return &nonces{key: key}
+}
+
+func (n *nonces) next() string {
+	issued := make([]byte, 8)
+	binary.BigEndian.PutUint64(issued, uint64(time.Now().Unix()))
+	return hex.EncodeToString(append(issued, n.mac(issued)...))
+}
+
+func (n *nonces) valid(nonce string) bool {
+	b, err := hex.DecodeString(nonce)
+	if err != nil || len(b) != 8+16 || !hmac.Equal(b[8:], n.mac(b[:8])) {
+		return false
+	}
+	return time.Since(time.Unix(int64(binary.BigEndian.Uint64(b[:8])), 0)) <= nonceLifetime
+}
+
+func (n *nonces) mac(issued []byte) []byte {
+	mac := hmac.New(sha256.New, n.key)
+	mac.Write(issued)
+	return mac.Sum(nil)[:16]
+}
@@ -0,0 +1,187 @@
+package turn
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// udpIdleTimeout closes UDP clients which have not sent a packet for longer than the maximum allocation
+	// lifetime, their allocations expired already.
+	udpIdleTimeout = time.Hour + time.Minute
+	// udpHandshakeTimeout closes UDP clients which never sent an authenticated allocate request, e.g. clients
+	// only using STUN binding requests.
+	udpHandshakeTimeout = time.Minute
+	// udpQueueSize is the number of packets queued per UDP client, further packets are dropped.
+	udpQueueSize = 64
+)
+
+// udpMux reads the packets of the UDP listener and hands them to the connection of the sending client, every
+// client address is served by its own pion server like a TCP connection.
+type udpMux struct {
+	relay    *relay
+	listener net.PacketConn
+
+	lock    sync.Mutex
+	clients map[string]*udpConn
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newUDPMux(r *relay, listener net.PacketConn) *udpMux {
+	return &udpMux{relay: r, listener: listener, clients: map[string]*udpConn{}, closed: make(chan struct{})}
+}
+
+// serve reads the packets of the listener until it is closed.
+func (m *udpMux) serve() {
+	go m.expire()
+	buf := make([]byte, 1600)
+	for {
+		n, addr, err := m.listener.ReadFrom(buf)
+		if err != nil {
+			log.Debug().Err(err).Str("address", m.listener.LocalAddr().String()).Msg("Stop reading TURN packets")
+			_ = m.Close()
+			return
+		}
+		conn := m.conn(addr)
+		if conn == nil {
+			continue
+		}
+		select {
+		case conn.packets <- append([]byte(nil), buf[:n]...):
+		default:
+			log.Debug().Str("address", addr.String()).Msg("Dropped TURN packet, client queue is full")
+		}
+	}
+}
+
+// conn returns the connection of the client address, a new client gets its own pion server.
+func (m *udpMux) conn(addr net.Addr) *udpConn {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if conn, ok := m.clients[addr.String()]; ok {
+		conn.seen = time.Now()
+		return conn
+	}
+	conn := &udpConn{
+		mux:     m,
+		client:  &client{addr: addr},
+		packets: make(chan []byte, udpQueueSize),
+		closed:  make(chan struct{}),
+		seen:    time.Now(),
+	}
+	if _, err := m.relay.newServer(conn, conn.client); err != nil {
+		log.Error().Err(err).Str("address", addr.String()).Msg("Failed to serve TURN client")
+		return nil
+	}
+	m.clients[addr.String()] = conn
+	return conn
+}
+
+// expire closes idle clients, pion closes their allocations then.
+func (m *udpMux) expire() {
+	ticker := time.NewTicker(udpHandshakeTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.closed:
+			return
+		case now := <-ticker.C:
+			m.lock.Lock()
+			var idle []*udpConn
+			for _, conn := range m.clients {
+				timeout := udpHandshakeTimeout
+				if _, ok := conn.client.authenticated(); ok {
+					timeout = udpIdleTimeout
+				}
+				if now.Sub(conn.seen) > timeout {
+					idle = append(idle, conn)
+				}
+			}
+			m.lock.Unlock()
+			for _, conn := range idle {
+				_ = conn.Close()
+			}
+		}
+	}
+}
+
+// Close closes the listener and all client connections.
+func (m *udpMux) Close() error {
+	m.once.Do(func() { close(m.closed) })
+	err := m.listener.Close()
+	m.lock.Lock()
+	conns := make([]*udpConn, 0, len(m.clients))
+	for _, conn := range m.clients {
+		conns = append(conns, conn)
+	}
+	m.lock.Unlock()
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+	return err
+}
+
+// udpConn is the connection of a single UDP client, it reads the packets the mux received from the client and
+// writes to the listener.
+type udpConn struct {
+	mux     *udpMux
+	client  *client
+	packets chan []byte
+	closed  chan struct{}
+	once    sync.Once
+	seen    time.Time // Protected by the lock of mux
+}
+
+func (c *udpConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		select {
+		case packet := <-c.packets:
+			n := copy(p, packet)
+			m := decodeMessage(p[:n])
+			if m != nil && c.mux.relay.handleDatagram(c, m) {
+				continue
+			}
+			c.mux.relay.inspect(c.client, m)
+			return n, c.client.addr, nil
+		case <-c.closed:
+			return 0, nil, net.ErrClosed
+		}
+	}
+}
+
+func (c *udpConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.mux.listener.WriteTo(p, addr)
+}
+
+// Close removes the client from the mux, the listener stays open.
+func (c *udpConn) Close() error {
+	c.once.Do(func() {
+		c.mux.lock.Lock()
+		if c.mux.clients[c.client.addr.String()] == c {
+			delete(c.mux.clients, c.client.addr.String())
+		}
+		c.mux.lock.Unlock()
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *udpConn) LocalAddr() net.Addr {
+	return c.mux.listener.LocalAddr()
+}
+
+func (c *udpConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (c *udpConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (c *udpConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
@@ -1,4 +1,5 @@
 import {UseConfig} from './useConfig';
+import {urlWithSlash} from './url';
 import React from 'react';
 import {
     Box,
@@ -12,15 +13,24 @@ import {
 import makeStyles from '@mui/styles/makeStyles';
 import {green} from '@mui/material/colors';
 
-export const LoginForm = ({config: {login}, hide}: {config: UseConfig; hide?: () => void}) => {
+export const LoginForm = ({
+    config: {login, oidc},
+    hide,
+}: {
+    config: UseConfig;
+    hide?: () => void;
+}) => {
     const [user, setUser] = React.useState('');
     const [pass, setPass] = React.useState('');
+    const [code, setCode] = React.useState('');
+    const [codeRequired, setCodeRequired] = React.useState(false);
     const [loading, setLoading] = React.useState(false);
     const submit = async (event: {preventDefault: () => void}) => {
         event.preventDefault();
         setLoading(true);
-        login(user, pass)
-            .then(() => {
+        login(user, pass, code)
+            .then((required) => {
+                setCodeRequired(required || codeRequired);
                 setLoading(false);
             })
             .catch(() => setLoading(false));
@@ -54,6 +64,18 @@ export const LoginForm = ({config: {login}, hide}: {config: UseConfig; hide?: ()
                         size="small"
                         margin="dense"
                     />
+                    {codeRequired ? (
+                        <TextField
+                            fullWidth
+                            autoFocus
+                            value={code}
+                            onChange={(e) => setCode(e.target.value)}
+                            label="Two-factor code"
+                            size="small"
+                            margin="dense"
+                            inputProps={{inputMode: 'numeric', autoComplete: 'one-time-code'}}
+                        />
+                    ) : undefined}
                     <Box marginTop={1}>
                         <LoadingButton
                             type="submit"
@@ -65,6 +87,13 @@ export const LoginForm = ({config: {login}, hide}: {config: UseConfig; hide?: ()
                             Login
                         </LoadingButton>
                     </Box>
+                    {oidc ? (
+                        <Box marginTop={1}>
+                            <Button href={`${urlWithSlash}login/oidc`} fullWidth variant="outlined">
+                                Sign in with SSO
+                            </Button>
+                        </Box>
+                    ) : undefined}
                 </form>
             </FormControl>
         </div>
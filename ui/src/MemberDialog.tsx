@@ -0,0 +1,176 @@
+import React from 'react';
+import {
+    Box,
+    Button,
+    Dialog,
+    DialogActions,
+    DialogContent,
+    DialogTitle,
+    Menu,
+    MenuItem,
+    TextField,
+    Typography,
+} from '@mui/material';
+import {RoomUser, UIConfig} from './message';
+import {ConnectedRoom} from './useRoom';
+import {can} from './useConfig';
+
+export interface MemberDialogProps {
+    open: boolean;
+    setOpen: (open: boolean) => void;
+    state: ConnectedRoom;
+    config: UIConfig;
+    setPassword: (password: string) => void;
+    admit: (id: string) => void;
+    deny: (id: string) => void;
+    kick: (id: string) => void;
+    ban: (id: string, ip: boolean) => void;
+    stopUserShare: (id: string) => void;
+}
+
+export const flags = (user: RoomUser) => {
+    const result: string[] = [];
+    if (user.you) {
+        result.push('You');
+    }
+    if (user.owner) {
+        result.push('Owner');
+    }
+    if (user.streaming) {
+        result.push('Streaming');
+    }
+    if (!result.length) {
+        return '';
+    }
+    return ` (${result.join(', ')})`;
+};
+
+// BanButton bans the user, or the user and its address from the menu.
+const BanButton = ({id, ban}: {id: string; ban: (id: string, ip: boolean) => void}) => {
+    const [anchor, setAnchor] = React.useState<HTMLElement | null>(null);
+    const doBan = (ip: boolean) => {
+        setAnchor(null);
+        ban(id, ip);
+    };
+    return (
+        <>
+            <Button size="small" color="error" onClick={(e) => setAnchor(e.currentTarget)}>
+                Ban
+            </Button>
+            <Menu anchorEl={anchor} open={!!anchor} onClose={() => setAnchor(null)}>
+                <MenuItem onClick={() => doBan(false)}>Ban User</MenuItem>
+                <MenuItem onClick={() => doBan(true)}>Ban User and IP Address</MenuItem>
+            </Menu>
+        </>
+    );
+};
+
+export const MemberDialog = ({
+    open,
+    setOpen,
+    state,
+    config,
+    setPassword,
+    admit,
+    deny,
+    kick,
+    ban,
+    stopUserShare,
+}: MemberDialogProps) => {
+    const [password, setPasswordInput] = React.useState('');
+    // Only users who may create rooms own them, the owner moderates the room.
+    const owner = can(config, 'create') && state.users.some((user) => user.you && user.owner);
+
+    const changePassword = (value: string) => {
+        setPassword(value);
+        setPasswordInput('');
+    };
+
+    return (
+        <Dialog open={open} onClose={() => setOpen(false)} maxWidth={'sm'} fullWidth>
+            <DialogTitle>Member List</DialogTitle>
+            <DialogContent>
+                {state.users.map((user) => (
+                    <Box key={user.id} display="flex" alignItems="center">
+                        <Typography style={{flex: 1}}>
+                            {user.name} {flags(user)}
+                        </Typography>
+                        {owner && !user.you ? (
+                            <>
+                                {user.streaming ? (
+                                    <Button size="small" onClick={() => stopUserShare(user.id)}>
+                                        Stop Share
+                                    </Button>
+                                ) : undefined}
+                                <Button size="small" onClick={() => kick(user.id)}>
+                                    Kick
+                                </Button>
+                                <BanButton id={user.id} ban={ban} />
+                            </>
+                        ) : undefined}
+                    </Box>
+                ))}
+                {owner && state.waiting ? (
+                    <Box paddingTop={2}>
+                        <Typography variant="h6">Waiting Room</Typography>
+                        {state.joinRequests.length ? undefined : (
+                            <Typography variant="body2">Nobody is waiting.</Typography>
+                        )}
+                        {state.joinRequests.map((request) => (
+                            <Box key={request.id} display="flex" alignItems="center">
+                                <Typography style={{flex: 1}}>
+                                    {request.name}
+                                    {request.authenticated ? '' : ' (Guest)'}
+                                </Typography>
+                                <Button size="small" onClick={() => admit(request.id)}>
+                                    Admit
+                                </Button>
+                                <Button size="small" onClick={() => deny(request.id)}>
+                                    Deny
+                                </Button>
+                                <BanButton id={request.id} ban={ban} />
+                            </Box>
+                        ))}
+                    </Box>
+                ) : undefined}
+                {owner ? (
+                    <Box paddingTop={2}>
+                        <Typography variant="h6">Room Password</Typography>
+                        <Typography variant="body2">
+                            {state.protected
+                                ? 'Joining requires the password.'
+                                : 'Everyone with the link can join.'}
+                        </Typography>
+                        <form
+                            onSubmit={(e) => {
+                                e.preventDefault();
+                                changePassword(password);
+                            }}
+                            style={{display: 'flex', alignItems: 'center'}}
+                        >
+                            <TextField
+                                type="password"
+                                margin="dense"
+                                label="New Password"
+                                value={password}
+                                onChange={(e) => setPasswordInput(e.target.value)}
+                                style={{flex: 1}}
+                            />
+                            <Button type="submit" disabled={!password}>
+                                Set
+                            </Button>
+                            <Button onClick={() => changePassword('')} disabled={!state.protected}>
+                                Clear
+                            </Button>
+                        </form>
+                    </Box>
+                ) : undefined}
+            </DialogContent>
+            <DialogActions>
+                <Button onClick={() => setOpen(false)} color="primary">
+                    Close
+                </Button>
+            </DialogActions>
+        </Dialog>
+    );
+};
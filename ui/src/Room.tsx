@@ -3,6 +3,7 @@ import {Badge, IconButton, Paper, Theme, Tooltip, Typography} from '@mui/materia
 import CancelPresentationIcon from '@mui/icons-material/CancelPresentation';
 import PresentToAllIcon from '@mui/icons-material/PresentToAll';
 import FullScreenIcon from '@mui/icons-material/Fullscreen';
+import LockIcon from '@mui/icons-material/Lock';
 import PeopleIcon from '@mui/icons-material/People';
 import SettingsIcon from '@mui/icons-material/Settings';
 import {useHotkeys} from 'react-hotkeys-hook';
@@ -10,29 +11,14 @@ import {Video} from './Video';
 import makeStyles from '@mui/styles/makeStyles';
 import {ConnectedRoom} from './useRoom';
 import {useSnackbar} from 'notistack';
-import {RoomUser} from './message';
 import {useSettings, VideoDisplayMode} from './settings';
 import {SettingDialog} from './SettingDialog';
+import {flags, MemberDialog} from './MemberDialog';
+import {UIConfig} from './message';
+import {can} from './useConfig';
 
 const HostStream: unique symbol = Symbol('mystream');
 
-const flags = (user: RoomUser) => {
-    const result: string[] = [];
-    if (user.you) {
-        result.push('You');
-    }
-    if (user.owner) {
-        result.push('Owner');
-    }
-    if (user.streaming) {
-        result.push('Streaming');
-    }
-    if (!result.length) {
-        return '';
-    }
-    return ` (${result.join(', ')})`;
-};
-
 interface FullScreenHTMLVideoElement extends HTMLVideoElement {
     msRequestFullscreen?: () => void;
     mozRequestFullScreen?: () => void;
@@ -53,17 +39,32 @@ const requestFullscreen = (element: FullScreenHTMLVideoElement | null) => {
 
 export const Room = ({
     state,
+    config,
     share,
     stopShare,
     setName,
+    setPassword,
+    admit,
+    deny,
+    kick,
+    ban,
+    stopUserShare,
 }: {
     state: ConnectedRoom;
+    config: UIConfig;
     share: () => void;
     stopShare: () => void;
     setName: (name: string) => void;
+    setPassword: (password: string) => void;
+    admit: (id: string) => void;
+    deny: (id: string) => void;
+    kick: (id: string) => void;
+    ban: (id: string, ip: boolean) => void;
+    stopUserShare: (id: string) => void;
 }) => {
     const classes = useStyles();
     const [open, setOpen] = React.useState(false);
+    const [membersOpen, setMembersOpen] = React.useState(false);
     const {enqueueSnackbar} = useSnackbar();
     const [settings, setSettings] = useSettings();
     const [showControl, setShowControl] = React.useState(true);
@@ -116,9 +117,21 @@ export const Room = ({
         [setHoverControl]
     );
 
-    const controlVisible = showControl || open || hoverControl;
+    const controlVisible = showControl || open || membersOpen || hoverControl;
+
+    const canShare = can(config, 'share');
 
-    useHotkeys('s', () => (state.hostStream ? stopShare() : share()), [state.hostStream]);
+    useHotkeys(
+        's',
+        () => {
+            if (state.hostStream) {
+                stopShare();
+            } else if (canShare) {
+                share();
+            }
+        },
+        [state.hostStream, canShare]
+    );
     useHotkeys(
         'f',
         () => {
@@ -183,10 +196,15 @@ export const Room = ({
                         <Typography
                             variant="h4"
                             component="h4"
-                            style={{cursor: 'pointer'}}
+                            style={{cursor: 'pointer', display: 'flex', alignItems: 'center'}}
                             onClick={copyLink}
                         >
                             {state.id}
+                            {state.protected && (
+                                <Tooltip title="Password Protected">
+                                    <LockIcon style={{marginLeft: 10}} />
+                                </Tooltip>
+                            )}
                         </Typography>
                     </Tooltip>
                 </Paper>
@@ -223,13 +241,13 @@ export const Room = ({
                                 <CancelPresentationIcon fontSize="large" />
                             </IconButton>
                         </Tooltip>
-                    ) : (
+                    ) : canShare ? (
                         <Tooltip title="Start Presentation" arrow>
                             <IconButton onClick={share} size="large">
                                 <PresentToAllIcon fontSize="large" />
                             </IconButton>
                         </Tooltip>
-                    )}
+                    ) : null}
 
                     <Tooltip
                         classes={{tooltip: classes.noMaxWidth}}
@@ -245,9 +263,14 @@ export const Room = ({
                         }
                         arrow
                     >
-                        <Badge badgeContent={state.users.length} color="primary">
-                            <PeopleIcon fontSize="large" />
-                        </Badge>
+                        <IconButton onClick={() => setMembersOpen(true)} size="large">
+                            <Badge
+                                badgeContent={state.users.length}
+                                color={state.joinRequests.length ? 'secondary' : 'primary'}
+                            >
+                                <PeopleIcon fontSize="large" />
+                            </Badge>
+                        </IconButton>
                     </Tooltip>
                     <Tooltip title="Fullscreen" arrow>
                         <IconButton
@@ -318,6 +341,18 @@ export const Room = ({
                     updateName={setName}
                     saveSettings={setSettings}
                 />
+                <MemberDialog
+                    open={membersOpen}
+                    setOpen={setMembersOpen}
+                    state={state}
+                    config={config}
+                    setPassword={setPassword}
+                    admit={admit}
+                    deny={deny}
+                    kick={kick}
+                    ban={ban}
+                    stopUserShare={stopUserShare}
+                />
             </div>
         </div>
     );
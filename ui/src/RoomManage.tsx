@@ -2,6 +2,10 @@ import React from 'react';
 import {
     Button,
     Checkbox,
+    Dialog,
+    DialogActions,
+    DialogContent,
+    DialogTitle,
     FormControl,
     FormControlLabel,
     Grid,
@@ -10,26 +14,33 @@ import {
     Typography,
     Link,
 } from '@mui/material';
-import {FCreateRoom, UseRoom} from './useRoom';
+import {UseRoom} from './useRoom';
 import {UIConfig} from './message';
 import {getRoomFromURL} from './useRoomID';
-import {authModeToRoomMode, UseConfig} from './useConfig';
+import {can, roomMode, UseConfig} from './useConfig';
 import {LoginForm} from './LoginForm';
 
 const CreateRoom = ({room, config}: Pick<UseRoom, 'room'> & {config: UIConfig}) => {
     const [id, setId] = React.useState(() => getRoomFromURL() ?? config.roomName);
-    const mode = authModeToRoomMode(config.authMode, config.loggedIn);
+    const mode = roomMode(config);
+    const create = can(config, 'create');
     const [ownerLeave, setOwnerLeave] = React.useState(config.closeRoomWhenOwnerLeaves);
+    const [password, setPassword] = React.useState('');
+    const [waitingRoom, setWaitingRoom] = React.useState(false);
     const submit = () =>
-        room({
-            type: 'create',
-            payload: {
-                mode,
-                closeOnOwnerLeave: ownerLeave,
-                joinIfExist: true,
-                id: id || undefined,
-            },
-        });
+        create
+            ? room({
+                  type: 'create',
+                  payload: {
+                      mode,
+                      closeOnOwnerLeave: ownerLeave,
+                      joinIfExist: true,
+                      id: id || undefined,
+                      password: password || undefined,
+                      waitingRoom,
+                  },
+              })
+            : room({type: 'join', payload: {id, password: password || undefined}});
     return (
         <div>
             <FormControl fullWidth>
@@ -40,27 +51,119 @@ const CreateRoom = ({room, config}: Pick<UseRoom, 'room'> & {config: UIConfig})
                     label="id"
                     margin="dense"
                 />
-                <FormControlLabel
-                    control={
-                        <Checkbox
-                            checked={ownerLeave}
-                            onChange={(_, checked) => setOwnerLeave(checked)}
-                        />
+                <TextField
+                    fullWidth
+                    type="password"
+                    value={password}
+                    onChange={(e) => setPassword(e.target.value)}
+                    label="Password (optional)"
+                    helperText={
+                        create
+                            ? 'Protects a new room or joins a protected one'
+                            : 'Joins a protected room'
                     }
-                    label="Close Room after you leave"
+                    margin="dense"
                 />
+                {create && (
+                    <>
+                        <FormControlLabel
+                            control={
+                                <Checkbox
+                                    checked={ownerLeave}
+                                    onChange={(_, checked) => setOwnerLeave(checked)}
+                                />
+                            }
+                            label="Close Room after you leave"
+                        />
+                        <FormControlLabel
+                            control={
+                                <Checkbox
+                                    checked={waitingRoom}
+                                    onChange={(_, checked) => setWaitingRoom(checked)}
+                                />
+                            }
+                            label="Admit users from a waiting room"
+                        />
+                    </>
+                )}
                 <Button onClick={submit} fullWidth variant="contained">
-                    Create or Join a Room
+                    {create ? 'Create or Join a Room' : 'Join a Room'}
                 </Button>
             </FormControl>
         </div>
     );
 };
 
-export const RoomManage = ({room, config}: {room: FCreateRoom; config: UseConfig}) => {
+const JoinPrompt = ({
+    join,
+    submitPassword,
+    cancelJoin,
+}: Pick<UseRoom, 'join' | 'submitPassword' | 'cancelJoin'>) => {
+    const [password, setPassword] = React.useState('');
+    const submit = () => {
+        submitPassword(password);
+        setPassword('');
+    };
+    if (join && join.type === 'waiting') {
+        return (
+            <Dialog open onClose={cancelJoin} maxWidth={'xs'} fullWidth>
+                <DialogTitle>Waiting Room</DialogTitle>
+                <DialogContent>
+                    <Typography>Waiting for the owner to admit you.</Typography>
+                </DialogContent>
+                <DialogActions>
+                    <Button onClick={cancelJoin} color="primary">
+                        Cancel
+                    </Button>
+                </DialogActions>
+            </Dialog>
+        );
+    }
+    return (
+        <Dialog open={!!join} onClose={cancelJoin} maxWidth={'xs'} fullWidth>
+            <DialogTitle>Room Password</DialogTitle>
+            <DialogContent>
+                <form
+                    onSubmit={(e) => {
+                        e.preventDefault();
+                        submit();
+                    }}
+                >
+                    <TextField
+                        autoFocus
+                        fullWidth
+                        type="password"
+                        margin="dense"
+                        label="Password"
+                        value={password}
+                        onChange={(e) => setPassword(e.target.value)}
+                        error={join && join.wrong}
+                        helperText={join && join.wrong ? 'Wrong password' : undefined}
+                    />
+                </form>
+            </DialogContent>
+            <DialogActions>
+                <Button onClick={cancelJoin} color="primary">
+                    Cancel
+                </Button>
+                <Button onClick={submit} color="primary">
+                    Join
+                </Button>
+            </DialogActions>
+        </Dialog>
+    );
+};
+
+export const RoomManage = ({
+    room,
+    config,
+    join,
+    submitPassword,
+    cancelJoin,
+}: Pick<UseRoom, 'room' | 'join' | 'submitPassword' | 'cancelJoin'> & {config: UseConfig}) => {
     const [showLogin, setShowLogin] = React.useState(false);
 
-    const canCreateRoom = config.authMode !== 'all';
+    const canCreateRoom = can(config, 'create');
     const loginVisible = !config.loggedIn && (showLogin || !canCreateRoom);
 
     return (
@@ -100,6 +203,11 @@ export const RoomManage = ({room, config}: {room: FCreateRoom; config: UseConfig
                             </Typography>
 
                             <CreateRoom room={room} config={config} />
+                            <JoinPrompt
+                                join={join}
+                                submitPassword={submitPassword}
+                                cancelJoin={cancelJoin}
+                            />
                         </>
                     )}
                 </Paper>
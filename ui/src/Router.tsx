@@ -14,11 +14,19 @@ export const Router = () => {
 };
 
 const RouterLoadedConfig = ({config}: {config: UseConfig}) => {
-    const {room, state, ...other} = useRoom(config);
+    const {room, state, join, submitPassword, cancelJoin, ...other} = useRoom(config);
 
     if (state) {
-        return <Room state={state} {...other} />;
+        return <Room state={state} config={config} {...other} />;
     }
 
-    return <RoomManage room={room} config={config} />;
+    return (
+        <RoomManage
+            room={room}
+            config={config}
+            join={join}
+            submitPassword={submitPassword}
+            cancelJoin={cancelJoin}
+        />
+    );
 };
@@ -5,6 +5,8 @@ export enum ShareMode {
 
 type Typed<Base, Type extends string> = {type: Type; payload: Base};
 
+export type Permission = 'create' | 'turn' | 'share' | 'join';
+
 export interface UIConfig {
     authMode: 'turn' | 'none' | 'all';
     user: string;
@@ -12,6 +14,10 @@ export interface UIConfig {
     version: string;
     roomName: string;
     closeRoomWhenOwnerLeaves: boolean;
+    csrfToken: string;
+    oidc: boolean; // Users may sign in with the OpenID Connect provider
+    roles: string[] | null;
+    permissions: Permission[] | null;
 }
 
 export interface RoomConfiguration {
@@ -19,6 +25,8 @@ export interface RoomConfiguration {
     closeOnOwnerLeave?: boolean;
     mode: RoomMode;
     username?: string;
+    password?: string;
+    waitingRoom?: boolean;
 }
 
 export enum RoomMode {
@@ -33,10 +41,14 @@ export interface JoinConfiguration {
     username?: string;
 }
 
-export interface StringMessage {
+export interface ErrorMessage {
+    code: string;
     message: string;
 }
 
+export const ErrorPasswordRequired = 'password_required';
+export const ErrorWrongPassword = 'wrong_password';
+
 export interface P2PSession {
     id: string;
     peer: string;
@@ -54,6 +66,14 @@ export interface RoomInfo {
     share: ShareMode; // TODO: remove
     mode: RoomMode;
     users: RoomUser[];
+    protected: boolean; // Joining requires the room password
+    waiting: boolean; // Joining requires the approval of the owner
+}
+
+export interface JoinRequestInfo {
+    id: string;
+    name: string;
+    authenticated: boolean;
 }
 
 export interface RoomUser {
@@ -64,13 +84,19 @@ export interface RoomUser {
     owner: boolean;
 }
 
+export interface TurnQuotaInfo {
+    session: string;
+    user: string;
+    reason: string; // e.g. the bandwidth quota of the user was exceeded
+}
+
 export interface P2PMessage<T> {
     sid: string;
     value: T;
 }
 
 export type Room = Typed<RoomInfo, 'room'>;
-export type Error = Typed<StringMessage, 'Error'>;
+export type Error = Typed<ErrorMessage, 'error'>;
 export type HostSession = Typed<P2PSession, 'hostsession'>;
 export type Name = Typed<{username: string}, 'name'>;
 export type ClientSession = Typed<P2PSession, 'clientsession'>;
@@ -83,6 +109,16 @@ export type StopShare = Typed<{}, 'stopshare'>;
 export type RoomCreate = Typed<RoomConfiguration & {joinIfExist?: boolean}, 'create'>;
 export type JoinRoom = Typed<JoinConfiguration, 'join'>;
 export type EndShare = Typed<string, 'endshare'>;
+export type RoomPassword = Typed<{password: string}, 'roompassword'>;
+export type JoinRequest = Typed<JoinRequestInfo, 'joinrequest'>;
+export type JoinRequestClosed = Typed<string, 'joinrequestclosed'>;
+export type JoinPending = Typed<{id: string}, 'joinpending'>;
+export type Admit = Typed<{id: string}, 'admit'>;
+export type Deny = Typed<{id: string}, 'deny'>;
+export type Kick = Typed<{id: string}, 'kick'>;
+export type Ban = Typed<{id: string; ip?: boolean}, 'ban'>;
+export type StopUserShare = Typed<{id: string}, 'stopusershare'>;
+export type TurnQuota = Typed<TurnQuotaInfo, 'turnquota'>;
 
 export type IncomingMessage =
     | Room
@@ -93,7 +129,11 @@ export type IncomingMessage =
     | ClientICECandidate
     | HostOffer
     | EndShare
-    | ClientAnswer;
+    | ClientAnswer
+    | JoinRequest
+    | JoinRequestClosed
+    | JoinPending
+    | TurnQuota;
 
 export type OutgoingMessage =
     | RoomCreate
@@ -104,4 +144,10 @@ export type OutgoingMessage =
     | HostOffer
     | StopShare
     | ClientAnswer
-    | StartSharing;
+    | StartSharing
+    | RoomPassword
+    | Admit
+    | Deny
+    | Kick
+    | Ban
+    | StopUserShare;
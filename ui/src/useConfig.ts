@@ -1,10 +1,10 @@
-import {RoomMode, UIConfig} from './message';
+import {Permission, RoomMode, UIConfig} from './message';
 import {useSnackbar} from 'notistack';
 import React from 'react';
 import {urlWithSlash} from './url';
 
 export interface UseConfig extends UIConfig {
-    login: (username: string, password: string) => Promise<void>;
+    login: (username: string, password: string, code: string) => Promise<boolean>;
     refetch: () => void;
     logout: () => Promise<void>;
     loading: boolean;
@@ -20,6 +20,10 @@ export const useConfig = (): UseConfig => {
         version: 'unknown',
         roomName: 'unknown',
         closeRoomWhenOwnerLeaves: true,
+        csrfToken: '',
+        oidc: false,
+        roles: [],
+        permissions: [],
     });
 
     const refetch = React.useCallback(async () => {
@@ -28,22 +32,35 @@ export const useConfig = (): UseConfig => {
             .then(setConfig);
     }, [setConfig]);
 
-    const login = async (username: string, password: string) => {
+    // login resolves to true if the user has two-factor authentication and the code is missing.
+    const login = async (username: string, password: string, code: string) => {
         const body = new FormData();
         body.set('user', username);
         body.set('pass', password);
-        const result = await fetch(`${urlWithSlash}login`, {method: 'POST', body});
+        body.set('code', code);
+        const result = await fetch(`${urlWithSlash}login`, {
+            method: 'POST',
+            body,
+            headers: {'X-CSRF-Token': config.csrfToken},
+        });
         const json = await result.json();
         if (result.status !== 200) {
+            if (json.totpRequired && !code) {
+                return true;
+            }
             enqueueSnackbar('Login Failed: ' + json.message, {variant: 'error'});
         } else {
             await refetch();
             enqueueSnackbar('Logged in!', {variant: 'success'});
         }
+        return false;
     };
 
     const logout = async () => {
-        const result = await fetch(`${urlWithSlash}logout`, {method: 'POST'});
+        const result = await fetch(`${urlWithSlash}logout`, {
+            method: 'POST',
+            headers: {'X-CSRF-Token': config.csrfToken},
+        });
         if (result.status !== 200) {
             enqueueSnackbar('Logout Failed: ' + (await result.text()), {variant: 'error'});
         } else {
@@ -74,3 +91,13 @@ export const authModeToRoomMode = (authMode: UIConfig['authMode'], loggedIn: boo
             return RoomMode.Turn;
     }
 };
+
+// can checks if the user has the permission, the server rejects actions which are not permitted.
+export const can = (config: Pick<UIConfig, 'permissions'>, permission: Permission): boolean =>
+    !!config.permissions?.includes(permission);
+
+// roomMode is the mode of the rooms the user creates, relaying requires the turn permission.
+export const roomMode = (config: UIConfig): RoomMode => {
+    const mode = authModeToRoomMode(config.authMode, config.loggedIn);
+    return mode === RoomMode.Turn && !can(config, 'turn') ? RoomMode.Stun : mode;
+};
@@ -2,8 +2,11 @@ import {useSnackbar} from 'notistack';
 import React from 'react';
 
 import {
+    ErrorPasswordRequired,
+    ErrorWrongPassword,
     ICEServer,
     IncomingMessage,
+    JoinRequestInfo,
     JoinRoom,
     OutgoingMessage,
     RoomCreate,
@@ -12,7 +15,7 @@ import {
 } from './message';
 import {loadSettings, resolveCodecPlaceholder} from './settings';
 import {urlWithSlash} from './url';
-import {authModeToRoomMode} from './useConfig';
+import {can, roomMode} from './useConfig';
 import {getFromURL, useRoomID} from './useRoomID';
 
 export type RoomState = false | ConnectedRoom;
@@ -20,6 +23,7 @@ export type ConnectedRoom = {
     ws: WebSocket;
     hostStream?: MediaStream;
     clientStreams: ClientStream[];
+    joinRequests: JoinRequestInfo[]; // The users in the waiting room, only sent to the owner
 } & RoomInfo;
 
 interface ClientStream {
@@ -28,11 +32,23 @@ interface ClientStream {
     stream: MediaStream;
 }
 
+// JoinState is the state of a join which waits for the user before the room is entered.
+export type JoinState = false | {type: 'password'; wrong: boolean} | {type: 'waiting'};
+
 export interface UseRoom {
     state: RoomState;
+    join: JoinState;
     room: FCreateRoom;
+    submitPassword: (password: string) => void;
+    cancelJoin: () => void;
     share: () => void;
     setName: (name: string) => void;
+    setPassword: (password: string) => void;
+    admit: (id: string) => void;
+    deny: (id: string) => void;
+    kick: (id: string) => void;
+    ban: (id: string, ip: boolean) => void;
+    stopUserShare: (id: string) => void;
     stopShare: () => void;
 }
 
@@ -159,8 +175,23 @@ export const useRoom = (config: UIConfig): UseRoom => {
     const host = React.useRef<Record<string, RTCPeerConnection>>({});
     const client = React.useRef<Record<string, RTCPeerConnection>>({});
     const stream = React.useRef<MediaStream>();
+    const retryJoin = React.useRef<(password: string) => void>();
 
     const [state, setState] = React.useState<RoomState>(false);
+    const [join, setJoin] = React.useState<JoinState>(false);
+
+    const removeJoinRequest = React.useCallback(
+        (id: string): void =>
+            setState((current) =>
+                current
+                    ? {
+                          ...current,
+                          joinRequests: current.joinRequests.filter((request) => request.id !== id),
+                      }
+                    : current
+            ),
+        []
+    );
 
     const room: FCreateRoom = React.useCallback(
         (create) => {
@@ -175,20 +206,83 @@ export const useRoom = (config: UIConfig): UseRoom => {
                 ws.onmessage = (data) => {
                     const event: IncomingMessage = JSON.parse(data.data);
                     if (first) {
-                        first = false;
-                        if (event.type === 'room') {
-                            resolve();
-                            setState({ws, ...event.payload, clientStreams: []});
-                            setRoomID(event.payload.id);
-                        } else {
-                            resolve();
-                            enqueueSnackbar('Unknown Event: ' + event.type, {variant: 'error'});
-                            ws.close(1000, 'received unknown event');
+                        resolve();
+                        switch (event.type) {
+                            case 'room':
+                                first = false;
+                                setJoin(false);
+                                setState({
+                                    ws,
+                                    ...event.payload,
+                                    clientStreams: [],
+                                    joinRequests: [],
+                                });
+                                setRoomID(event.payload.id);
+                                return;
+                            case 'joinpending':
+                                setJoin({type: 'waiting'});
+                                return;
+                            case 'error':
+                                if (
+                                    event.payload.code === ErrorPasswordRequired ||
+                                    event.payload.code === ErrorWrongPassword
+                                ) {
+                                    // The join is retried on the open connection.
+                                    retryJoin.current = (password) =>
+                                        send({
+                                            type: 'join',
+                                            payload: {
+                                                id: create.payload.id ?? '',
+                                                password,
+                                                username: loadSettings().name,
+                                            },
+                                        });
+                                    setJoin({
+                                        type: 'password',
+                                        wrong: event.payload.code === ErrorWrongPassword,
+                                    });
+                                    return;
+                                }
+                                first = false;
+                                setJoin(false);
+                                ws.close(1000, event.payload.message);
+                                return;
+                            default:
+                                first = false;
+                                enqueueSnackbar('Unknown Event: ' + event.type, {
+                                    variant: 'error',
+                                });
+                                ws.close(1000, 'received unknown event');
+                                return;
                         }
-                        return;
                     }
 
                     switch (event.type) {
+                        case 'error':
+                            enqueueSnackbar(event.payload.message, {variant: 'error'});
+                            return;
+                        case 'joinrequest':
+                            enqueueSnackbar(event.payload.name + ' wants to join', {
+                                variant: 'info',
+                            });
+                            setState((current) =>
+                                current
+                                    ? {
+                                          ...current,
+                                          joinRequests: [...current.joinRequests, event.payload],
+                                      }
+                                    : current
+                            );
+                            return;
+                        case 'joinrequestclosed':
+                            removeJoinRequest(event.payload);
+                            return;
+                        case 'turnquota':
+                            // Only the owner is told that the TURN relay of a user was limited.
+                            enqueueSnackbar('TURN relay limited: ' + event.payload.reason, {
+                                variant: 'warning',
+                            });
+                            return;
                         case 'room':
                             setState((current) =>
                                 current ? {...current, ...event.payload} : current
@@ -293,6 +387,7 @@ export const useRoom = (config: UIConfig): UseRoom => {
                         first = false;
                     }
                     enqueueSnackbar(event.reason, {variant: 'error', persist: true});
+                    setJoin(false);
                     setState(false);
                 };
                 ws.onerror = (err) => {
@@ -301,6 +396,7 @@ export const useRoom = (config: UIConfig): UseRoom => {
                         first = false;
                     }
                     enqueueSnackbar(err?.toString(), {variant: 'error', persist: true});
+                    setJoin(false);
                     setState(false);
                 };
                 ws.onopen = () => {
@@ -309,7 +405,7 @@ export const useRoom = (config: UIConfig): UseRoom => {
                 };
             });
         },
-        [setState, enqueueSnackbar, setRoomID]
+        [setState, enqueueSnackbar, setRoomID, removeJoinRequest]
     );
 
     const share = async () => {
@@ -347,9 +443,48 @@ export const useRoom = (config: UIConfig): UseRoom => {
         conn.current?.send(JSON.stringify({type: 'name', payload: {username: name}}));
     };
 
+    // setPassword changes the password of the own room, an empty password clears it.
+    const setPassword = (password: string): void => {
+        conn.current?.send(JSON.stringify({type: 'roompassword', payload: {password}}));
+    };
+
+    const submitPassword = (password: string): void => {
+        setJoin(false);
+        retryJoin.current?.(password);
+    };
+
+    const admit = (id: string): void => {
+        conn.current?.send(JSON.stringify({type: 'admit', payload: {id}}));
+        removeJoinRequest(id);
+    };
+
+    const deny = (id: string): void => {
+        conn.current?.send(JSON.stringify({type: 'deny', payload: {id}}));
+        removeJoinRequest(id);
+    };
+
+    const kick = (id: string): void => {
+        conn.current?.send(JSON.stringify({type: 'kick', payload: {id}}));
+    };
+
+    // ban rejects the user for the rest of the room's life, with ip also its address.
+    const ban = (id: string, ip: boolean): void => {
+        conn.current?.send(JSON.stringify({type: 'ban', payload: {id, ip}}));
+        removeJoinRequest(id);
+    };
+
+    const stopUserShare = (id: string): void => {
+        conn.current?.send(JSON.stringify({type: 'stopusershare', payload: {id}}));
+    };
+
+    const cancelJoin = (): void => {
+        conn.current?.close(1000, 'Join cancelled');
+    };
+
     React.useEffect(() => {
         if (roomID) {
-            const create = getFromURL('create') === 'true';
+            // Users who may not create rooms join the room instead.
+            const create = getFromURL('create') === 'true' && can(config, 'create');
             if (create) {
                 const closeOnOwnerLeaveString = getFromURL('closeOnOwnerLeave');
                 const closeOnOwnerLeave =
@@ -362,7 +497,7 @@ export const useRoom = (config: UIConfig): UseRoom => {
                         joinIfExist: true,
                         closeOnOwnerLeave,
                         id: roomID,
-                        mode: authModeToRoomMode(config.authMode, config.loggedIn),
+                        mode: roomMode(config),
                     },
                 });
             } else {
@@ -372,5 +507,20 @@ export const useRoom = (config: UIConfig): UseRoom => {
         // eslint-disable-next-line react-hooks/exhaustive-deps
     }, []);
 
-    return {state, room, share, stopShare, setName};
+    return {
+        state,
+        join,
+        room,
+        submitPassword,
+        cancelJoin,
+        share,
+        stopShare,
+        setName,
+        setPassword,
+        admit,
+        deny,
+        kick,
+        ban,
+        stopUserShare,
+    };
 };
@@ -2,6 +2,7 @@ package ws
 
 import (
 	"fmt"
+	"github.com/ezshare/server/auth"
 	"github.com/ezshare/server/ws/outgoing"
 	"github.com/gorilla/websocket"
 	"github.com/rs/xid"
@@ -23,10 +24,14 @@ type Client struct {
 
 // ClientInfo contains the information of a client.
 type ClientInfo struct {
-	ID                xid.ID // A unique ID for the client
-	RoomID            string // The room which the client is in
-	Authenticated     bool   // The creator of the client is authenticated or not
-	AuthenticatedUser string // If not authenticated, "guest"
+	ID                xid.ID            // A unique ID for the client
+	RoomID            string            // The room which the client is in
+	Authenticated     bool              // The creator of the client is authenticated or not
+	AuthenticatedUser string            // If not authenticated, "guest"
+	Roles             []string          // The roles of the authenticated user
+	Scopes            []auth.Permission // If not nil, the client authenticated with an API token limited to these scopes
+	SessionID         string            // The login session which opened the client, empty for guests and API tokens
+	TokenID           string            // The API token which opened the client, empty if no token was used
 	Write             chan outgoing.Message
 	Close             chan string
 	Addr              net.IP
@@ -40,7 +45,7 @@ type ClientMessage struct {
 
 // newClient creates a new Client to wrap a websocket connection. And set the close handler for the connection.
 // It returns the reference of the created Client object.
-func newClient(conn *websocket.Conn, read chan ClientMessage, authenticatedUser string, authenticated bool) *Client {
+func newClient(conn *websocket.Conn, read chan ClientMessage, authenticatedUser string, authenticated bool, roles []string, scopes []auth.Permission, sessionID, tokenID string) *Client {
 	// 创建一个新的Client对象包装WebSocket连接，并设置其关闭时的回调函数
 	c := &Client{
 		conn: conn, // Websocket connection
@@ -49,6 +54,10 @@ func newClient(conn *websocket.Conn, read chan ClientMessage, authenticatedUser
 			RoomID:            "",                                  // The room which the client is in
 			Authenticated:     authenticated,                       // The creator of the client is authenticated or not
 			AuthenticatedUser: authenticatedUser,                   // If authenticated is false, it is "guest"
+			Roles:             roles,                               // The roles of the authenticated user
+			Scopes:            scopes,                              // The scopes of the API token
+			SessionID:         sessionID,                           // The login session
+			TokenID:           tokenID,                             // The API token
 			Write:             make(chan outgoing.Message, 1),      // The channel to send messages to the websocket
 			Close:             make(chan string, 1),                // The channel to send a clos signal to the websocket
 			Addr:              conn.RemoteAddr().(*net.TCPAddr).IP, // The IP address of the client
@@ -111,6 +120,12 @@ func (c *Client) startReading(pongWait time.Duration) {
 			_ = c.conn.CloseHandler()(websocket.CloseNormalClosure, fmt.Sprintf("Failed to parse message: %s", err))
 			return
 		}
+		if p, ok := event.(preparer); ok {
+			if err := p.prepare(); err != nil {
+				_ = c.conn.CloseHandler()(websocket.CloseInternalServerErr, fmt.Sprintf("Failed to prepare message: %s", err))
+				return
+			}
+		}
 		c.toRooms <- ClientMessage{Info: c.info, Incoming: event}
 	}
 }
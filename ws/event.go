@@ -3,3 +3,14 @@ package ws
 type Event interface {
 	Execute(*Rooms, ClientInfo) error
 }
+
+// preparer is implemented by events with expensive work, e.g. hashing a password, which the reading
+// goroutine of the client does before the event is sent to the Rooms loop.
+type preparer interface {
+	prepare() error
+}
+
+// redactor is implemented by events carrying secrets, which must not be logged.
+type redactor interface {
+	redacted() Event
+}
@@ -0,0 +1,79 @@
+package ws
+
+import (
+	"fmt"
+
+	"github.com/ezshare/server/ws/outgoing"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+func init() {
+	register("admit", func() Event {
+		return &Admit{}
+	})
+	register("deny", func() Event {
+		return &Deny{}
+	})
+}
+
+// Admit lets a user in the waiting room join the room of the owner.
+type Admit struct {
+	ID xid.ID `json:"id"`
+}
+
+func (e *Admit) Execute(rooms *Rooms, current ClientInfo) error {
+	room, err := rooms.ownedRoom(current)
+	if err != nil {
+		return err
+	}
+	pending := room.removePending(rooms, e.ID)
+	if pending == nil {
+		return fmt.Errorf("user %s is not waiting to join", e.ID)
+	}
+	log.Debug().Str("roomId", room.ID).Str("clientId", e.ID.String()).Msg("Join request admitted")
+	return room.addUser(rooms, pending.Info, pending.Name)
+}
+
+// Deny rejects a user in the waiting room.
+type Deny struct {
+	ID xid.ID `json:"id"`
+}
+
+func (e *Deny) Execute(rooms *Rooms, current ClientInfo) error {
+	room, err := rooms.ownedRoom(current)
+	if err != nil {
+		return err
+	}
+	pending := room.removePending(rooms, e.ID)
+	if pending == nil {
+		return fmt.Errorf("user %s is not waiting to join", e.ID)
+	}
+	log.Debug().Str("roomId", room.ID).Str("clientId", e.ID.String()).Msg("Join request denied")
+	pending.Info.Write <- outgoing.Error{Code: outgoing.ErrorJoinDenied, Message: "the owner denied your request to join"}
+	return nil
+}
+
+// JoinRequestExpired is sent when a join request was not answered within the join request timeout.
+type JoinRequestExpired struct {
+	RoomID   string
+	ClientID xid.ID
+}
+
+// Execute rejects the user if it is still waiting, the owner may have answered in the meantime.
+func (e *JoinRequestExpired) Execute(rooms *Rooms, current ClientInfo) error {
+	room, ok := rooms.Rooms[e.RoomID]
+	if !ok {
+		return nil
+	}
+	pending := room.removePending(rooms, e.ClientID)
+	if pending == nil {
+		return nil
+	}
+	log.Debug().Str("roomId", room.ID).Str("clientId", e.ClientID.String()).Msg("Join request expired")
+	pending.Info.Write <- outgoing.Error{Code: outgoing.ErrorJoinTimeout, Message: "the owner did not answer your request to join"}
+	if owner := room.owner(); owner != nil {
+		owner.Write <- outgoing.JoinRequestClosed(e.ClientID)
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+package ws
+
+// Connected is sent when a client connected, so that its connection can be closed before it joins a room.
+type Connected struct{}
+
+func (e *Connected) Execute(rooms *Rooms, current ClientInfo) error {
+	rooms.clients[current.ID] = current
+	return nil
+}
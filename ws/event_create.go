@@ -3,7 +3,7 @@ package ws
 import (
 	"errors"
 	"fmt"
-	"github.com/ezshare/server/config"
+	"github.com/ezshare/server/auth"
 
 	"github.com/rs/xid"
 )
@@ -20,6 +20,26 @@ type Create struct {
 	ConnectionMode    ConnectionMode `json:"mode"`
 	UserName          string         `json:"username"`
 	JoinIfExist       bool           `json:"joinIfExist,omitempty"`
+	Password          string         `json:"password,omitempty"` // Optional, protects the room
+	WaitingRoom       bool           `json:"waitingRoom,omitempty"`
+
+	hash string // The hash of Password, see prepare
+}
+
+// prepare hashes the password outside of the Rooms loop.
+func (e *Create) prepare() (err error) {
+	if e.Password != "" {
+		e.hash, err = auth.HashPassword(e.Password)
+	}
+	return err
+}
+
+func (e *Create) redacted() Event {
+	redacted := *e
+	if redacted.Password != "" {
+		redacted.Password = "***"
+	}
+	return &redacted
 }
 
 func (e *Create) Execute(rooms *Rooms, current ClientInfo) error {
@@ -27,11 +47,17 @@ func (e *Create) Execute(rooms *Rooms, current ClientInfo) error {
 	if current.RoomID != "" {
 		return fmt.Errorf("cannot join room, you are already in one")
 	}
+	if _, ok := rooms.pending[current.ID]; ok {
+		return fmt.Errorf("cannot create room, you are waiting to join one")
+	}
+	if _, ok := rooms.joining[current.ID]; ok {
+		return fmt.Errorf("cannot create room, you are joining one")
+	}
 
 	// Check if the room already exists. If it does, join the existing room if the client wants to.
 	if _, ok := rooms.Rooms[e.RoomId]; ok {
 		if e.JoinIfExist {
-			join := &Join{UserName: e.UserName, RoomID: e.RoomId}
+			join := &Join{UserName: e.UserName, RoomID: e.RoomId, Password: e.Password}
 			return join.Execute(rooms, current)
 		}
 		return fmt.Errorf("room with id %s does already exist", e.RoomId)
@@ -47,38 +73,38 @@ func (e *Create) Execute(rooms *Rooms, current ClientInfo) error {
 		username = rooms.RandUserName()
 	}
 
-	switch rooms.config.AuthMode {
-	case config.AuthModeNone:
-		// Do nothing
-	case config.AuthModeAll:
-		// Always require authentication
+	// Guests are limited by the auth mode: AuthModeAll always requires authentication, AuthModeTurn
+	// only for TURN connections. Authenticated users are limited by their roles.
+	if !rooms.can(current, auth.PermissionCreate) || (e.ConnectionMode == ConnectionTURN && !rooms.can(current, auth.PermissionTurn)) {
 		if !current.Authenticated {
 			return errors.New("you need to login")
 		}
-	case config.AuthModeTurn:
-		// Only require authentication for TURN connections
-		if e.ConnectionMode == ConnectionTURN && !current.Authenticated {
-			return errors.New("you need to login")
-		}
+		return fmt.Errorf("your role does not allow to create %s rooms", e.ConnectionMode)
 	}
 
 	room := &Room{
 		ID:                e.RoomId,
 		CloseOnOwnerLeave: e.CloseOnOwnerLeave,
 		ConnectionMode:    e.ConnectionMode,
+		WaitingRoom:       e.WaitingRoom,
+		Pending:           map[xid.ID]*PendingUser{},
+		Banned:            map[string]bool{},
 		Sessions:          map[xid.ID]*RoomSession{},
 		Users: map[xid.ID]*User{
 			current.ID: {
-				ID:        current.ID,
-				Name:      username,
-				Streaming: false,
-				Owner:     true,
-				Addr:      current.Addr,
-				Write:     current.Write,
-				Close:     current.Close,
+				ID:                current.ID,
+				Name:              username,
+				Authenticated:     current.Authenticated,
+				AuthenticatedUser: current.AuthenticatedUser,
+				Streaming:         false,
+				Owner:             true,
+				Addr:              current.Addr,
+				Write:             current.Write,
+				Close:             current.Close,
 			},
 		},
 	}
+	room.setPassword(e.hash)
 	rooms.Rooms[e.RoomId] = room
 	room.notifyInfoChanged()
 	return nil
@@ -1,15 +1,29 @@
 package ws
 
 import (
-	"bytes"
-
 	"github.com/ezshare/server/ws/outgoing"
 )
 
 type Disconnected struct{}
 
 func (e *Disconnected) Execute(rooms *Rooms, current ClientInfo) error {
+	delete(rooms.clients, current.ID)
+	delete(rooms.joining, current.ID)
+	if roomID, ok := rooms.pending[current.ID]; ok {
+		if room, ok := rooms.Rooms[roomID]; ok {
+			room.removePending(rooms, current.ID)
+			if owner := room.owner(); owner != nil {
+				owner.Write <- outgoing.JoinRequestClosed(current.ID)
+			}
+		}
+		delete(rooms.pending, current.ID)
+	}
 	if current.RoomID == "" {
+		// Clients outside of rooms may have been closed with a reason, let their writer end.
+		select {
+		case current.Close <- CloseDone:
+		default:
+		}
 		return nil
 	}
 
@@ -29,22 +43,7 @@ func (e *Disconnected) Execute(rooms *Rooms, current ClientInfo) error {
 	current.Close <- CloseDone
 	delete(room.Users, current.ID)
 
-	for id, session := range room.Sessions {
-		if bytes.Equal(session.Client.Bytes(), current.ID.Bytes()) {
-			host, ok := room.Users[session.Host]
-			if ok {
-				host.Write <- outgoing.EndShare(id)
-			}
-			room.closeSession(rooms, id)
-		}
-		if bytes.Equal(session.Host.Bytes(), current.ID.Bytes()) {
-			client, ok := room.Users[session.Client]
-			if ok {
-				client.Write <- outgoing.EndShare(id)
-			}
-			room.closeSession(rooms, id)
-		}
-	}
+	room.closeUserSessions(rooms, current.ID)
 
 	if user.Owner && room.CloseOnOwnerLeave {
 		for _, member := range room.Users {
@@ -2,7 +2,8 @@ package ws
 
 import (
 	"fmt"
-	"github.com/rs/zerolog/log"
+	"github.com/ezshare/server/auth"
+	"github.com/ezshare/server/ws/outgoing"
 )
 
 func init() {
@@ -14,16 +15,47 @@ func init() {
 type Join struct {
 	RoomID   string `json:"id"`
 	UserName string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+func (e *Join) redacted() Event {
+	redacted := *e
+	if redacted.Password != "" {
+		redacted.Password = "***"
+	}
+	return &redacted
 }
 
 func (e *Join) Execute(rooms *Rooms, current ClientInfo) error {
 	if current.RoomID != "" {
 		return fmt.Errorf("cannot join room, you are already in one")
 	}
+	if _, ok := rooms.pending[current.ID]; ok {
+		return fmt.Errorf("cannot join room, you are waiting to join one")
+	}
+	if _, ok := rooms.joining[current.ID]; ok {
+		return fmt.Errorf("cannot join room, you are joining one")
+	}
 	room, ok := rooms.Rooms[e.RoomID]
 	if !ok {
 		return fmt.Errorf("room with id %s does not exist", e.RoomID)
 	}
+	if !rooms.can(current, auth.PermissionJoin) {
+		return fmt.Errorf("your role does not allow to join rooms")
+	}
+	if room.banned(current) {
+		current.Write <- outgoing.Error{Code: outgoing.ErrorBanned, Message: "you are banned from this room"}
+		return nil
+	}
+	if room.PasswordHash != "" {
+		room.checkPassword(rooms, current, e.Password)
+		return nil
+	}
+	return enter(rooms, room, current)
+}
+
+// enter adds the client to the room, or to its waiting room.
+func enter(rooms *Rooms, room *Room, current ClientInfo) error {
 	var name string
 	if current.Authenticated {
 		name = current.AuthenticatedUser
@@ -31,29 +63,9 @@ func (e *Join) Execute(rooms *Rooms, current ClientInfo) error {
 		name = rooms.RandUserName()
 	}
 
-	room.Users[current.ID] = &User{
-		ID:        current.ID,
-		Name:      name,
-		Streaming: false,
-		Owner:     false,
-		Addr:      current.Addr,
-		Write:     current.Write,
-		Close:     current.Close,
-	}
-	room.notifyInfoChanged()
-
-	v4, v6, err := rooms.config.TurnIPProvider.Get()
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to get turn ip")
-		return err
+	if room.WaitingRoom {
+		room.requestJoin(rooms, current, name)
+		return nil
 	}
-
-	for _, user := range room.Users {
-		if current.ID == user.ID || !user.Streaming {
-			continue
-		}
-		room.newSession(user.ID, current.ID, rooms, v4, v6)
-	}
-
-	return nil
+	return room.addUser(rooms, current, name)
 }
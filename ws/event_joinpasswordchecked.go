@@ -0,0 +1,47 @@
+package ws
+
+import (
+	"github.com/ezshare/server/ws/outgoing"
+	"github.com/rs/zerolog/log"
+)
+
+// JoinPasswordChecked is sent when the room password of a client who wants to join was verified, see
+// Room.checkPassword.
+type JoinPasswordChecked struct {
+	RoomID string
+	Hash   string // The password hash which was checked
+	OK     bool
+}
+
+func (e *JoinPasswordChecked) redacted() Event {
+	redacted := *e
+	redacted.Hash = "***"
+	return &redacted
+}
+
+// Execute lets the client enter the room if the password was correct. A wrong password is answered with an
+// error event, so that the client can ask the user again.
+func (e *JoinPasswordChecked) Execute(rooms *Rooms, current ClientInfo) error {
+	if roomID, ok := rooms.joining[current.ID]; !ok || roomID != e.RoomID {
+		// The client disconnected in the meantime
+		return nil
+	}
+	delete(rooms.joining, current.ID)
+	room, ok := rooms.Rooms[e.RoomID]
+	if !ok {
+		current.Write <- outgoing.Error{Code: outgoing.ErrorRoomClosed, Message: "the room was closed"}
+		return nil
+	}
+	// The password may have been changed while it was checked.
+	if !e.OK || room.PasswordHash != e.Hash {
+		log.Info().Str("roomId", room.ID).Str("clientId", current.ID.String()).Str("ip", current.Addr.String()).Msg("Wrong room password")
+		current.Write <- outgoing.Error{Code: outgoing.ErrorWrongPassword, Message: "wrong room password"}
+		return nil
+	}
+	room.clearFailures(current)
+	if room.banned(current) {
+		current.Write <- outgoing.Error{Code: outgoing.ErrorBanned, Message: "you are banned from this room"}
+		return nil
+	}
+	return enter(rooms, room, current)
+}
@@ -0,0 +1,119 @@
+package ws
+
+import (
+	"fmt"
+
+	"github.com/ezshare/server/ws/outgoing"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+func init() {
+	register("kick", func() Event {
+		return &Kick{}
+	})
+	register("ban", func() Event {
+		return &Ban{}
+	})
+	register("stopusershare", func() Event {
+		return &StopUserShare{}
+	})
+}
+
+// Kick removes a user from the room of the owner. The user may join again.
+type Kick struct {
+	ID xid.ID `json:"id"`
+}
+
+func (e *Kick) Execute(rooms *Rooms, current ClientInfo) error {
+	room, target, err := moderated(rooms, current, e.ID)
+	if err != nil {
+		return err
+	}
+	log.Info().Str("roomId", room.ID).Str("clientId", e.ID.String()).Msg("User kicked")
+	room.kick(rooms, target, CloseKicked)
+	return nil
+}
+
+// Ban removes a user from the room of the owner and rejects it for the rest of the room's life. The client
+// and, if it is authenticated, the username are banned, with IP set also the address of the client. Users
+// in the waiting room can be banned too.
+type Ban struct {
+	ID xid.ID `json:"id"`
+	IP bool   `json:"ip,omitempty"`
+}
+
+func (e *Ban) Execute(rooms *Rooms, current ClientInfo) error {
+	room, err := rooms.ownedRoom(current)
+	if err != nil {
+		return err
+	}
+	if e.ID == current.ID {
+		return fmt.Errorf("cannot ban yourself")
+	}
+	var authenticated bool
+	var name string
+	var addr string
+	target, inRoom := room.Users[e.ID]
+	pending := room.Pending[e.ID]
+	switch {
+	case inRoom:
+		authenticated, name, addr = target.Authenticated, target.AuthenticatedUser, target.Addr.String()
+	case pending != nil:
+		authenticated, name, addr = pending.Info.Authenticated, pending.Info.AuthenticatedUser, pending.Info.Addr.String()
+	default:
+		return fmt.Errorf("user %s is not in the room", e.ID)
+	}
+
+	room.Banned["id:"+e.ID.String()] = true
+	if authenticated {
+		room.Banned["user:"+name] = true
+	}
+	if e.IP {
+		room.Banned["ip:"+addr] = true
+	}
+	log.Info().Str("roomId", room.ID).Str("clientId", e.ID.String()).Bool("ip", e.IP).Msg("User banned")
+
+	if inRoom {
+		room.kick(rooms, target, CloseBanned)
+	} else {
+		room.removePending(rooms, e.ID)
+		pending.Info.Write <- outgoing.Error{Code: outgoing.ErrorBanned, Message: "you are banned from this room"}
+	}
+	return nil
+}
+
+// StopUserShare stops the screen share of a user in the room of the owner, like StopShare does for the own share.
+type StopUserShare struct {
+	ID xid.ID `json:"id"`
+}
+
+func (e *StopUserShare) Execute(rooms *Rooms, current ClientInfo) error {
+	room, target, err := moderated(rooms, current, e.ID)
+	if err != nil {
+		return err
+	}
+	if !target.Streaming {
+		return nil
+	}
+	log.Info().Str("roomId", room.ID).Str("clientId", e.ID.String()).Msg("Share of user stopped")
+	room.stopShare(rooms, target.ID, true)
+	room.notifyInfoChanged()
+	return nil
+}
+
+// moderated returns the room of the owner and the user the owner acts on, which must be another user in the room.
+func moderated(rooms *Rooms, current ClientInfo, id xid.ID) (*Room, *User, error) {
+	room, err := rooms.ownedRoom(current)
+	if err != nil {
+		return nil, nil, err
+	}
+	if id == current.ID {
+		return nil, nil, fmt.Errorf("cannot moderate yourself")
+	}
+	target, ok := room.Users[id]
+	if !ok {
+		return nil, nil, fmt.Errorf("user %s is not in the room", id)
+	}
+	return room, target, nil
+}
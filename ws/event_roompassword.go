@@ -0,0 +1,46 @@
+package ws
+
+import (
+	"github.com/ezshare/server/auth"
+	"github.com/rs/zerolog/log"
+)
+
+func init() {
+	register("roompassword", func() Event {
+		return &RoomPassword{}
+	})
+}
+
+// RoomPassword changes the password of the room, an empty password clears it. Users in the room stay.
+type RoomPassword struct {
+	Password string `json:"password"`
+
+	hash string // The hash of Password, see prepare
+}
+
+// prepare hashes the password outside of the Rooms loop.
+func (e *RoomPassword) prepare() (err error) {
+	if e.Password != "" {
+		e.hash, err = auth.HashPassword(e.Password)
+	}
+	return err
+}
+
+func (e *RoomPassword) redacted() Event {
+	redacted := *e
+	if redacted.Password != "" {
+		redacted.Password = "***"
+	}
+	return &redacted
+}
+
+func (e *RoomPassword) Execute(rooms *Rooms, current ClientInfo) error {
+	room, err := rooms.ownedRoom(current)
+	if err != nil {
+		return err
+	}
+	room.setPassword(e.hash)
+	log.Info().Str("roomId", room.ID).Bool("protected", e.Password != "").Msg("Room password changed")
+	room.notifyInfoChanged()
+	return nil
+}
@@ -0,0 +1,26 @@
+package ws
+
+import (
+	"github.com/rs/zerolog/log"
+)
+
+// SessionsRevoked is sent when login sessions were revoked or logged out.
+type SessionsRevoked struct {
+	IDs []string
+}
+
+// Execute closes the connections opened by the revoked sessions, the Disconnected events of the closed
+// clients clean up their sessions.
+func (e *SessionsRevoked) Execute(rooms *Rooms, current ClientInfo) error {
+	revoked := map[string]bool{}
+	for _, id := range e.IDs {
+		revoked[id] = true
+	}
+	for _, client := range rooms.clients {
+		if client.SessionID != "" && revoked[client.SessionID] {
+			log.Info().Str("clientId", client.ID.String()).Str("user", client.AuthenticatedUser).Msg("Closing connection of revoked session")
+			client.Close <- CloseRevoked
+		}
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package ws
 
 import (
 	"fmt"
+	"github.com/ezshare/server/auth"
 )
 
 func init() {
@@ -24,6 +25,9 @@ func (e *StartShare) Execute(rooms *Rooms, current ClientInfo) error {
 	if !ok {
 		return fmt.Errorf("room with id %s does not exist", current.RoomID)
 	}
+	if !rooms.can(current, auth.PermissionShare) {
+		return fmt.Errorf("your role does not allow to share")
+	}
 	room.Users[current.ID].Streaming = true
 
 	v4, v6, err := rooms.config.TurnIPProvider.Get()
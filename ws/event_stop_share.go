@@ -1,10 +1,7 @@
 package ws
 
 import (
-	"bytes"
 	"fmt"
-
-	"github.com/ezshare/server/ws/outgoing"
 )
 
 func init() {
@@ -25,18 +22,7 @@ func (e *StopShare) Execute(rooms *Rooms, current ClientInfo) error {
 	if !ok {
 		return fmt.Errorf("room with id %s does not exist", current.RoomID)
 	}
-	room.Users[current.ID].Streaming = false
-
-	for id, session := range room.Sessions {
-		if bytes.Equal(session.Host.Bytes(), current.ID.Bytes()) {
-			client, ok := room.Users[session.Client]
-			if ok {
-				client.Write <- outgoing.EndShare(id)
-			}
-			room.closeSession(rooms, id)
-		}
-	}
-
+	room.stopShare(rooms, current.ID, false)
 	room.notifyInfoChanged()
 	return nil
 }
@@ -0,0 +1,26 @@
+package ws
+
+import (
+	"github.com/rs/zerolog/log"
+)
+
+// TokensRevoked is sent when API tokens were revoked.
+type TokensRevoked struct {
+	IDs []string
+}
+
+// Execute closes the connections opened with the revoked tokens, the Disconnected events of the closed
+// clients clean up their sessions.
+func (e *TokensRevoked) Execute(rooms *Rooms, current ClientInfo) error {
+	revoked := map[string]bool{}
+	for _, id := range e.IDs {
+		revoked[id] = true
+	}
+	for _, client := range rooms.clients {
+		if client.TokenID != "" && revoked[client.TokenID] {
+			log.Info().Str("clientId", client.ID.String()).Str("user", client.AuthenticatedUser).Msg("Closing connection of revoked api token")
+			client.Close <- CloseTokenRevoked
+		}
+	}
+	return nil
+}
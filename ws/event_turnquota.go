@@ -0,0 +1,31 @@
+package ws
+
+import (
+	"github.com/ezshare/server/ws/outgoing"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+// TurnQuotaExceeded is sent by the TURN server when a quota of a user in a room was exceeded.
+type TurnQuotaExceeded struct {
+	RoomID    string
+	SessionID xid.ID
+	UserID    xid.ID
+	Reason    string
+}
+
+// Execute notifies the owner of the room. The room or the session may already be closed, then
+// nothing is sent.
+func (e *TurnQuotaExceeded) Execute(rooms *Rooms, current ClientInfo) error {
+	room, ok := rooms.Rooms[e.RoomID]
+	if !ok {
+		log.Debug().Str("roomId", e.RoomID).Msg("Room of exceeded TURN quota already closed")
+		return nil
+	}
+	for _, user := range room.Users {
+		if user.Owner {
+			user.Write <- outgoing.TurnQuotaExceeded{Session: e.SessionID, User: e.UserID, Reason: e.Reason}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package ws
+
+import (
+	"github.com/rs/zerolog/log"
+)
+
+// UsersRemoved is sent when users were removed from the users file while the server is running.
+type UsersRemoved struct {
+	Names []string
+}
+
+// Execute closes the connections of the removed users, the Disconnected events of the closed clients
+// clean up their sessions.
+func (e *UsersRemoved) Execute(rooms *Rooms, current ClientInfo) error {
+	removed := map[string]bool{}
+	for _, name := range e.Names {
+		removed[name] = true
+	}
+	for _, client := range rooms.clients {
+		if client.Authenticated && removed[client.AuthenticatedUser] {
+			log.Info().Str("clientId", client.ID.String()).Str("user", client.AuthenticatedUser).Msg("Closing connection of removed user")
+			client.Close <- CloseUserRemoved
+		}
+	}
+	return nil
+}
@@ -11,9 +11,11 @@ type Message interface {
 }
 
 type Room struct {
-	ID    string         `json:"id"`
-	Mode  ConnectionMode `json:"mode"`
-	Users []User         `json:"users"`
+	ID        string         `json:"id"`
+	Mode      ConnectionMode `json:"mode"`
+	Users     []User         `json:"users"`
+	Protected bool           `json:"protected"` // Joining requires the room password
+	Waiting   bool           `json:"waiting"`   // Joining requires the approval of the owner
 }
 
 type User struct {
@@ -89,6 +91,65 @@ func (EndShare) Type() string {
 	return "endshare"
 }
 
+// TurnQuotaExceeded tells the room owner that the TURN relay of a user was throttled or closed.
+type TurnQuotaExceeded struct {
+	Session xid.ID `json:"session"`
+	User    xid.ID `json:"user"`
+	Reason  string `json:"reason"`
+}
+
+func (TurnQuotaExceeded) Type() string {
+	return "turnquota"
+}
+
+// The codes of Error.
+const (
+	ErrorPasswordRequired = "password_required"
+	ErrorWrongPassword    = "wrong_password"
+	ErrorTooManyAttempts  = "too_many_attempts"
+	ErrorJoinDenied       = "join_denied"
+	ErrorJoinTimeout      = "join_timeout"
+	ErrorRoomClosed       = "room_closed"
+	ErrorBanned           = "banned"
+)
+
+// Error tells the client that its request was rejected, without closing the connection.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (Error) Type() string {
+	return "error"
+}
+
+// JoinRequest asks the room owner to admit or deny a user in the waiting room.
+type JoinRequest struct {
+	ID            xid.ID `json:"id"`
+	Name          string `json:"name"`
+	Authenticated bool   `json:"authenticated"`
+}
+
+func (JoinRequest) Type() string {
+	return "joinrequest"
+}
+
+// JoinRequestClosed tells the room owner that a join request timed out or the user left.
+type JoinRequestClosed xid.ID
+
+func (JoinRequestClosed) Type() string {
+	return "joinrequestclosed"
+}
+
+// JoinPending tells a user that the room owner was asked to admit them.
+type JoinPending struct {
+	ID string `json:"id"`
+}
+
+func (JoinPending) Type() string {
+	return "joinpending"
+}
+
 type ConnectionMode string
 
 const (
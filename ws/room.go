@@ -2,11 +2,16 @@ package ws
 
 import (
 	"fmt"
+	"github.com/ezshare/server/auth"
+	"github.com/ezshare/server/config"
+	"github.com/ezshare/server/turn"
 	"github.com/ezshare/server/ws/outgoing"
 	"github.com/rs/xid"
 	"github.com/rs/zerolog/log"
 	"net"
 	"sort"
+	"strings"
+	"time"
 )
 
 type ConnectionMode string
@@ -23,16 +28,36 @@ type Room struct {
 	ConnectionMode    ConnectionMode
 	Users             map[xid.ID]*User
 	Sessions          map[xid.ID]*RoomSession
+	PasswordHash      string                  // If set, joining requires the password, see setPassword
+	joinFailures      map[string]*joinFailure // Wrong passwords per IP address ("ip:"+addr) and username ("user:"+name)
+	WaitingRoom       bool                    // Joining users wait until the owner admits them
+	Pending           map[xid.ID]*PendingUser
+	Banned            map[string]bool // Banned client ids ("id:"+id), usernames ("user:"+name) and IP addresses ("ip:"+addr)
+}
+
+// joinFailure counts the wrong room passwords since the first one.
+type joinFailure struct {
+	count int
+	since time.Time
+}
+
+// PendingUser is a user in the waiting room of a room.
+type PendingUser struct {
+	Info  ClientInfo
+	Name  string
+	timer *time.Timer // Expires the join request
 }
 
 type User struct {
-	ID        xid.ID // Client ID
-	Addr      net.IP // Client IP address
-	Name      string // If the client is authenticated, it is the authenticated username, otherwise it is a random username
-	Streaming bool
-	Owner     bool
-	Write     chan<- outgoing.Message // Client write channel which to send messages to the client
-	Close     chan<- string           // Client close channel which to send a close signal to the client
+	ID                xid.ID // Client ID
+	Addr              net.IP // Client IP address
+	Name              string // If the client is authenticated, it is the authenticated username, otherwise it is a random username
+	Authenticated     bool   // The creator of the client is authenticated or not
+	AuthenticatedUser string // If not authenticated, "guest"
+	Streaming         bool
+	Owner             bool
+	Write             chan<- outgoing.Message // Client write channel which to send messages to the client
+	Close             chan<- string           // Client close channel which to send a close signal to the client
 }
 
 // RoomSession here has a stream channel from the Host to the Client.
@@ -41,11 +66,149 @@ type RoomSession struct {
 	Client xid.ID
 }
 
+// maxJoinAttempts is the number of wrong room passwords after which an IP address or user cannot join the
+// room for joinFailureWindow.
 const (
-	CloseOwnerLeft = "Owner Left"
-	CloseDone      = "Read End"
+	maxJoinAttempts   = 5
+	joinFailureWindow = 15 * time.Minute
 )
 
+const (
+	CloseOwnerLeft    = "Owner Left"
+	CloseDone         = "Read End"
+	CloseUserRemoved  = "User Removed"
+	CloseRevoked      = "Session Revoked"
+	CloseTokenRevoked = "Token Revoked"
+	CloseKicked       = "Kicked"
+	CloseBanned       = "Banned"
+)
+
+// addUser adds the client to the room and starts sessions with the users who are streaming.
+func (r *Room) addUser(rooms *Rooms, client ClientInfo, name string) error {
+	r.Users[client.ID] = &User{
+		ID:                client.ID,
+		Name:              name,
+		Authenticated:     client.Authenticated,
+		AuthenticatedUser: client.AuthenticatedUser,
+		Streaming:         false,
+		Owner:             false,
+		Addr:              client.Addr,
+		Write:             client.Write,
+		Close:             client.Close,
+	}
+	r.notifyInfoChanged()
+
+	v4, v6, err := rooms.config.TurnIPProvider.Get()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get turn ip")
+		return err
+	}
+
+	for _, user := range r.Users {
+		if client.ID == user.ID || !user.Streaming {
+			continue
+		}
+		r.newSession(user.ID, client.ID, rooms, v4, v6)
+	}
+	return nil
+}
+
+// stopShare ends the sessions which the user hosts. The clients get EndShare, and the host too if it
+// did not stop the share itself.
+func (r *Room) stopShare(rooms *Rooms, host xid.ID, notifyHost bool) {
+	r.Users[host].Streaming = false
+	for id, session := range r.Sessions {
+		if session.Host != host {
+			continue
+		}
+		if client, ok := r.Users[session.Client]; ok {
+			client.Write <- outgoing.EndShare(id)
+		}
+		if notifyHost {
+			r.Users[host].Write <- outgoing.EndShare(id)
+		}
+		r.closeSession(rooms, id)
+	}
+}
+
+// closeUserSessions ends the sessions of the user, the peers get EndShare.
+func (r *Room) closeUserSessions(rooms *Rooms, user xid.ID) {
+	for id, session := range r.Sessions {
+		if session.Host != user && session.Client != user {
+			continue
+		}
+		peer := session.Host
+		if peer == user {
+			peer = session.Client
+		}
+		if other, ok := r.Users[peer]; ok {
+			other.Write <- outgoing.EndShare(id)
+		}
+		r.closeSession(rooms, id)
+	}
+}
+
+// kick ends the sessions of the user and closes its connection with the reason. The Disconnected event of
+// the closed client removes it from the room.
+func (r *Room) kick(rooms *Rooms, user *User, reason string) {
+	user.Streaming = false
+	r.closeUserSessions(rooms, user.ID)
+	r.notifyInfoChanged()
+	user.Close <- reason
+}
+
+// banned checks if the client is banned from the room.
+func (r *Room) banned(client ClientInfo) bool {
+	if r.Banned["id:"+client.ID.String()] || r.Banned["ip:"+client.Addr.String()] {
+		return true
+	}
+	return client.Authenticated && r.Banned["user:"+client.AuthenticatedUser]
+}
+
+// owner returns the owner of the room, it is nil if the owner left.
+func (r *Room) owner() *User {
+	for _, user := range r.Users {
+		if user.Owner {
+			return user
+		}
+	}
+	return nil
+}
+
+// requestJoin puts the client into the waiting room and asks the owner to admit it. The request is
+// denied if it is not answered within the join request timeout.
+func (r *Room) requestJoin(rooms *Rooms, client ClientInfo, name string) {
+	owner := r.owner()
+	if owner == nil {
+		client.Write <- outgoing.Error{Code: outgoing.ErrorJoinDenied, Message: "the owner is not in the room"}
+		return
+	}
+	roomID, clientID := r.ID, client.ID
+	r.Pending[client.ID] = &PendingUser{
+		Info: client,
+		Name: name,
+		timer: time.AfterFunc(time.Duration(rooms.config.JoinRequestTimeoutSeconds)*time.Second, func() {
+			rooms.Incoming <- ClientMessage{Incoming: &JoinRequestExpired{RoomID: roomID, ClientID: clientID}}
+		}),
+	}
+	rooms.pending[client.ID] = r.ID
+	client.Write <- outgoing.JoinPending{ID: r.ID}
+	owner.Write <- outgoing.JoinRequest{ID: client.ID, Name: name, Authenticated: client.Authenticated}
+	log.Debug().Str("roomId", r.ID).Str("clientId", client.ID.String()).Msg("Join request")
+}
+
+// removePending removes the client from the waiting room, it returns nil if the client is not waiting.
+func (r *Room) removePending(rooms *Rooms, id xid.ID) *PendingUser {
+	pending, ok := r.Pending[id]
+	if !ok {
+		return nil
+	}
+	pending.timer.Stop()
+	delete(r.Pending, id)
+	delete(rooms.pending, id)
+	return pending
+}
+
 // newSession creates a new session between the host and the client. The host and client are the
 // ClientInfo.ID. The v4 and v6 are the IP addresses of the TURN server.
 func (r *Room) newSession(host, client xid.ID, rooms *Rooms, v4, v6 net.IP) {
@@ -64,7 +227,9 @@ func (r *Room) newSession(host, client xid.ID, rooms *Rooms, v4, v6 net.IP) {
 		iceClient = []outgoing.ICEServer{{URLs: rooms.addresses("stun", v4, v6, false)}}
 	case ConnectionTURN:
 		hostName, hostPW := rooms.turnServer.Credentials(id.String()+"host", r.Users[host].Addr)
+		rooms.turnServer.Track(id.String()+"host", r.turnOwner(rooms, id, r.Users[host]))
 		clientName, clientPW := rooms.turnServer.Credentials(id.String()+"client", r.Users[client].Addr)
+		rooms.turnServer.Track(id.String()+"client", r.turnOwner(rooms, id, r.Users[client]))
 		iceHost = []outgoing.ICEServer{{
 			URLs:       rooms.addresses("turn", v4, v6, true),
 			Credential: hostPW,
@@ -85,8 +250,35 @@ func (r *Room) newSession(host, client xid.ID, rooms *Rooms, v4, v6 net.IP) {
 		Msg("New session")
 }
 
-// addresses generates the STUN or TURN server address for the given IP.
+// turnOwner describes the user the TURN credentials of the session are issued for. When a quota is
+// exceeded, the room owner gets notified through the Rooms loop.
+func (r *Room) turnOwner(rooms *Rooms, session xid.ID, user *User) turn.Owner {
+	name := user.Name
+	if user.Authenticated {
+		name = user.AuthenticatedUser
+	}
+	roomID, userID := r.ID, user.ID
+	return turn.Owner{
+		Room:          roomID,
+		Session:       session.String(),
+		User:          name,
+		Authenticated: user.Authenticated,
+		Exceeded: func(username, reason string) {
+			go func() {
+				rooms.Incoming <- ClientMessage{
+					Incoming: &TurnQuotaExceeded{RoomID: roomID, SessionID: session, UserID: userID, Reason: reason},
+				}
+			}()
+		},
+	}
+}
+
+// addresses generates the STUN or TURN server address for the given IP. If an external
+// TURN server is used, its configured addresses will be returned instead.
 func (r *Rooms) addresses(prefix string, v4, v6 net.IP, tcp bool) (result []string) {
+	if r.config.TurnMode == config.TurnModeExternal {
+		return externalAddresses(prefix, r.config.TurnExternalURLs)
+	}
 	if v4 != nil {
 		result = append(result, fmt.Sprintf("%s:%s:%s", prefix, v4.String(), r.config.TurnPort))
 		if tcp {
@@ -99,6 +291,45 @@ func (r *Rooms) addresses(prefix string, v4, v6 net.IP, tcp bool) (result []stri
 			result = append(result, fmt.Sprintf("%s:[%s]:%s?transport=tcp", prefix, v6.String(), r.config.TurnPort))
 		}
 	}
+	if prefix == "turn" && r.config.TurnTLS() {
+		result = append(result, r.tlsAddresses(v4, v6)...)
+	}
+	return
+}
+
+// tlsAddresses generates the TURNS server address. The configured host is preferred, because
+// the certificate of the TLS listener is usually issued for a domain name.
+func (r *Rooms) tlsAddresses(v4, v6 net.IP) (result []string) {
+	if r.config.TurnTLSHost != "" {
+		return []string{fmt.Sprintf("turns:%s:%s?transport=tcp", r.config.TurnTLSHost, r.config.TurnTLSPort)}
+	}
+	if v4 != nil {
+		result = append(result, fmt.Sprintf("turns:%s:%s?transport=tcp", v4.String(), r.config.TurnTLSPort))
+	}
+	if v6 != nil {
+		result = append(result, fmt.Sprintf("turns:[%s]:%s?transport=tcp", v6.String(), r.config.TurnTLSPort))
+	}
+	return
+}
+
+// externalAddresses returns the configured TURN urls of the external server. For STUN, the
+// urls are derived from the plain TURN urls, because a TURN server also answers STUN requests.
+func externalAddresses(prefix string, urls []string) (result []string) {
+	if prefix == "turn" {
+		return urls
+	}
+	seen := map[string]bool{}
+	for _, u := range urls {
+		if !strings.HasPrefix(u, "turn:") {
+			continue
+		}
+		address, _, _ := strings.Cut(strings.TrimPrefix(u, "turn:"), "?")
+		stun := prefix + ":" + address
+		if !seen[stun] {
+			seen[stun] = true
+			result = append(result, stun)
+		}
+	}
 	return
 }
 
@@ -139,8 +370,83 @@ func (r *Room) notifyInfoChanged() {
 		})
 
 		current.Write <- outgoing.Room{
-			ID:    r.ID,
-			Users: users,
+			ID:        r.ID,
+			Users:     users,
+			Protected: r.PasswordHash != "",
+			Waiting:   r.WaitingRoom,
 		}
 	}
 }
+
+// setPassword sets the bcrypt hash of the room password, an empty hash clears it. The hash is created by
+// the reading goroutine of the client, see preparer.
+func (r *Room) setPassword(hash string) {
+	r.joinFailures = map[string]*joinFailure{}
+	r.PasswordHash = hash
+}
+
+// checkPassword starts checking the password of a client who wants to join. As bcrypt would block the
+// Rooms loop, the password is verified in a goroutine which sends JoinPasswordChecked. Every attempt
+// counts as a failure until it succeeded, so that parallel guesses are limited too. If the password is
+// missing or there were too many failures, the client gets an error event.
+func (r *Room) checkPassword(rooms *Rooms, client ClientInfo, password string) {
+	fail := func(code, message string) {
+		client.Write <- outgoing.Error{Code: code, Message: message}
+	}
+	if r.lockedOut(client) {
+		fail(outgoing.ErrorTooManyAttempts, "too many wrong passwords for this room")
+		return
+	}
+	if password == "" {
+		fail(outgoing.ErrorPasswordRequired, "the room requires a password")
+		return
+	}
+	now := time.Now()
+	for _, key := range joinFailureKeys(client) {
+		failure, ok := r.joinFailures[key]
+		if !ok {
+			failure = &joinFailure{since: now}
+			r.joinFailures[key] = failure
+		}
+		failure.count++
+	}
+	rooms.joining[client.ID] = r.ID
+	hash := r.PasswordHash
+	go func() {
+		ok := auth.VerifyPassword(hash, password)
+		rooms.Incoming <- ClientMessage{Info: client, Incoming: &JoinPasswordChecked{RoomID: r.ID, Hash: hash, OK: ok}}
+	}()
+}
+
+// lockedOut checks if the IP address or the user of the client had too many wrong passwords within
+// joinFailureWindow. Expired failures are dropped.
+func (r *Room) lockedOut(client ClientInfo) bool {
+	locked := false
+	for _, key := range joinFailureKeys(client) {
+		failure, ok := r.joinFailures[key]
+		if !ok {
+			continue
+		}
+		if time.Since(failure.since) > joinFailureWindow {
+			delete(r.joinFailures, key)
+			continue
+		}
+		locked = locked || failure.count >= maxJoinAttempts
+	}
+	return locked
+}
+
+// clearFailures forgets the failures of the client after the correct password.
+func (r *Room) clearFailures(client ClientInfo) {
+	for _, key := range joinFailureKeys(client) {
+		delete(r.joinFailures, key)
+	}
+}
+
+func joinFailureKeys(client ClientInfo) []string {
+	keys := []string{"ip:" + client.Addr.String()}
+	if client.Authenticated {
+		keys = append(keys, "user:"+client.AuthenticatedUser)
+	}
+	return keys
+}
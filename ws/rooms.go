@@ -6,21 +6,27 @@ import (
 	"github.com/ezshare/server/config"
 	"github.com/ezshare/server/turn"
 	"github.com/ezshare/server/util"
+	"github.com/ezshare/server/ws/outgoing"
 	"github.com/gorilla/websocket"
+	"github.com/rs/xid"
 	"github.com/rs/zerolog/log"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"reflect"
+	"slices"
 	"time"
 )
 
 type Rooms struct {
 	turnServer turn.Server
-	Rooms      map[string]*Room   // RoomID -> Room
-	Incoming   chan ClientMessage // Receive messages from clients. All clients send messages to this channel.
-	upgrader   websocket.Upgrader // The function to upgrade an HTTP request to a WebSocket connection.
-	users      *auth.Users        // Loaded user information from the user file in local.
+	Rooms      map[string]*Room      // RoomID -> Room
+	clients    map[xid.ID]ClientInfo // All connected clients, in a room or not
+	pending    map[xid.ID]string     // ClientID -> RoomID of the clients in a waiting room
+	joining    map[xid.ID]string     // ClientID -> RoomID of the clients whose room password is checked
+	Incoming   chan ClientMessage    // Receive messages from clients. All clients send messages to this channel.
+	upgrader   websocket.Upgrader    // The function to upgrade an HTTP request to a WebSocket connection.
+	users      *auth.Users           // Loaded user information from the user file in local.
 	config     config.Config
 	r          *rand.Rand
 }
@@ -33,6 +39,9 @@ func NewRooms(turnServer turn.Server, users *auth.Users, conf config.Config) *Ro
 	log.Debug().Msg("Creating rooms")
 	return &Rooms{
 		Rooms:      map[string]*Room{},
+		clients:    map[xid.ID]ClientInfo{},
+		pending:    map[xid.ID]string{},
+		joining:    map[xid.ID]string{},
 		Incoming:   make(chan ClientMessage),
 		turnServer: turnServer,
 		users:      users,
@@ -62,6 +71,13 @@ func NewRooms(turnServer turn.Server, users *auth.Users, conf config.Config) *Ro
 // Lastly, start two goroutines, one to read messages from websocket and them to Rooms, the other
 // write messages which received from Rooms to websocket.
 func (r *Rooms) Upgrade(w http.ResponseWriter, req *http.Request) {
+	token, err := r.users.TokenUser(req)
+	if err != nil {
+		w.WriteHeader(401)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
 	ws, err := r.upgrader.Upgrade(w, req, nil)
 	log.Debug().Str("remoteAddr", req.RemoteAddr).Msg("Upgrade to websocket")
 	if err != nil {
@@ -71,8 +87,23 @@ func (r *Rooms) Upgrade(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	user, loggedIn := r.users.CurrentUser(req)
-	c := newClient(ws, r.Incoming, user, loggedIn)
+	user := "guest"
+	var loggedIn bool
+	var scopes []auth.Permission
+	var sessionID, tokenID string
+	if token != nil {
+		user, loggedIn, scopes, tokenID = token.User, true, token.Scopes, token.ID
+	} else if session, ok := r.users.Session(req); ok {
+		user, loggedIn, sessionID = session.User, true, session.ID
+	} else if certUser, ok := r.users.CertificateUser(req); ok {
+		user, loggedIn = certUser, true
+	}
+	var roles []string
+	if loggedIn {
+		roles = r.users.Roles(user)
+	}
+	c := newClient(ws, r.Incoming, user, loggedIn, roles, scopes, sessionID, tokenID)
+	r.Incoming <- ClientMessage{Info: c.info, Incoming: &Connected{}}
 	go c.startReading(time.Second * 20)
 	log.Debug().Str("clientId", c.info.ID.String()).Str("user", c.info.AuthenticatedUser).Msg("Start reading from websocket")
 	go c.startWriteHandler(time.Second * 5)
@@ -83,20 +114,66 @@ func (r *Rooms) Upgrade(w http.ResponseWriter, req *http.Request) {
 func (r *Rooms) Start() {
 	for {
 		msg := <-r.Incoming
+		var logged interface{} = msg.Incoming
+		if event, ok := msg.Incoming.(redactor); ok {
+			logged = event.redacted()
+		}
 		log.Debug().
 			Str("clientId", msg.Info.ID.String()).
 			Str("user", msg.Info.AuthenticatedUser).
 			Str("event", reflect.TypeOf(msg.Incoming).Elem().Name()).
-			Interface("eventInfo", msg.Incoming).
+			Interface("eventInfo", logged).
 			Msg("Server received a message from client")
 
 		if err := msg.Incoming.Execute(r, msg.Info); err != nil {
 			log.Error().Err(err).Msg("Failed to execute Incoming message")
-			msg.Info.Close <- err.Error()
+			// Internal events have no client to close.
+			if msg.Info.Close != nil {
+				msg.Info.Close <- err.Error()
+			}
 		}
 	}
 }
 
+// can checks if the client is allowed to do the action. Clients authenticated with an API token are
+// additionally limited by the scopes of the token.
+func (r *Rooms) can(info ClientInfo, permission auth.Permission) bool {
+	if info.Scopes != nil && !slices.Contains(info.Scopes, permission) {
+		return false
+	}
+	return auth.Can(r.config.AuthMode, info.Authenticated, info.Roles, permission)
+}
+
+// RemoveUsers closes the connections of users which were removed from the users file.
+func (r *Rooms) RemoveUsers(names []string) {
+	r.Incoming <- ClientMessage{Incoming: &UsersRemoved{Names: names}}
+}
+
+// RevokeSessions closes the connections opened by login sessions which were revoked.
+func (r *Rooms) RevokeSessions(ids []string) {
+	r.Incoming <- ClientMessage{Incoming: &SessionsRevoked{IDs: ids}}
+}
+
+// RevokeTokens closes the connections opened with API tokens which were revoked.
+func (r *Rooms) RevokeTokens(ids []string) {
+	r.Incoming <- ClientMessage{Incoming: &TokensRevoked{IDs: ids}}
+}
+
+// ownedRoom returns the room of the client, if the client is its owner.
+func (r *Rooms) ownedRoom(current ClientInfo) (*Room, error) {
+	if current.RoomID == "" {
+		return nil, fmt.Errorf("not in a room")
+	}
+	room, ok := r.Rooms[current.RoomID]
+	if !ok {
+		return nil, fmt.Errorf("room with id %s does not exist", current.RoomID)
+	}
+	if user, ok := room.Users[current.ID]; !ok || !user.Owner {
+		return nil, fmt.Errorf("only the owner can moderate the room")
+	}
+	return room, nil
+}
+
 // closeRoom closes a room. First it closes all sessions in the room, then it
 // deletes the room.
 func (r *Rooms) closeRoom(roomID string) {
@@ -109,6 +186,10 @@ func (r *Rooms) closeRoom(roomID string) {
 		room.closeSession(r, id)
 		log.Debug().Str("roomId", roomID).Str("sessionId", id.String()).Msg("Close session")
 	}
+	for id := range room.Pending {
+		pending := room.removePending(r, id)
+		pending.Info.Write <- outgoing.Error{Code: outgoing.ErrorRoomClosed, Message: "the room was closed"}
+	}
 	delete(r.Rooms, roomID)
 	log.Debug().Str("roomId", roomID).Msg("Room closed")
 }
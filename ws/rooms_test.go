@@ -0,0 +1,350 @@
+package ws
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ezshare/server/config"
+	"github.com/ezshare/server/ws/outgoing"
+	"github.com/rs/xid"
+)
+
+// stubIP is a TURN ip provider which never does I/O.
+type stubIP struct{}
+
+func (stubIP) Get() (net.IP, net.IP, error) {
+	return net.IPv4(127, 0, 0, 1), nil, nil
+}
+
+func startTestRooms(t *testing.T) *Rooms {
+	rooms := NewRooms(nil, nil, config.Config{AuthMode: config.AuthModeNone, TurnIPProvider: stubIP{}, JoinRequestTimeoutSeconds: 1})
+	go rooms.Start()
+	return rooms
+}
+
+// testClient is a connected client whose messages are read by the test instead of a websocket writer.
+type testClient struct {
+	t     *testing.T
+	rooms *Rooms
+	info  ClientInfo
+}
+
+func connect(t *testing.T, rooms *Rooms, addr, user string) *testClient {
+	info := ClientInfo{
+		ID:                xid.New(),
+		AuthenticatedUser: "guest",
+		Write:             make(chan outgoing.Message, 64),
+		Close:             make(chan string, 1),
+		Addr:              net.ParseIP(addr),
+	}
+	if user != "" {
+		info.Authenticated, info.AuthenticatedUser, info.Roles = true, user, []string{"host"}
+	}
+	c := &testClient{t: t, rooms: rooms, info: info}
+	c.send(&Connected{})
+	return c
+}
+
+// send prepares the event like the reading goroutine and sends it to the Rooms loop.
+func (c *testClient) send(event Event) {
+	if p, ok := event.(preparer); ok {
+		if err := p.prepare(); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	c.rooms.Incoming <- ClientMessage{Info: c.info, Incoming: event}
+}
+
+// next returns the next message of the client which matches, the room id is tracked like the writer does.
+func (c *testClient) next(match func(outgoing.Message) bool) outgoing.Message {
+	c.t.Helper()
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case message := <-c.info.Write:
+			if room, ok := message.(outgoing.Room); ok {
+				c.info.RoomID = room.ID
+			}
+			if match(message) {
+				return message
+			}
+		case reason := <-c.info.Close:
+			c.t.Fatalf("client closed: %s", reason)
+		case <-timeout:
+			c.t.Fatal("no message")
+		}
+	}
+}
+
+// result waits for the room or an error, and returns "room" or the error code.
+func (c *testClient) result() string {
+	c.t.Helper()
+	message := c.next(func(message outgoing.Message) bool {
+		switch message.(type) {
+		case outgoing.Room, outgoing.Error:
+			return true
+		}
+		return false
+	})
+	if failure, ok := message.(outgoing.Error); ok {
+		return failure.Code
+	}
+	return "room"
+}
+
+// closed waits for the close reason of the client.
+func (c *testClient) closed() string {
+	c.t.Helper()
+	select {
+	case reason := <-c.info.Close:
+		return reason
+	case <-time.After(3 * time.Second):
+		c.t.Fatal("client not closed")
+		return ""
+	}
+}
+
+func createRoom(t *testing.T, rooms *Rooms, create *Create) *testClient {
+	owner := connect(t, rooms, "192.0.2.1", "owner")
+	create.RoomId, create.ConnectionMode = "room", ConnectionLocal
+	owner.send(create)
+	if result := owner.result(); result != "room" {
+		t.Fatalf("create failed: %s", result)
+	}
+	return owner
+}
+
+func TestRoomPassword(t *testing.T) {
+	type attempt struct {
+		addr, user, password string
+		want                 string // "room" or the error code
+	}
+	wrong := func(addr, user string) attempt {
+		return attempt{addr: addr, user: user, password: "wrong", want: outgoing.ErrorWrongPassword}
+	}
+	for _, test := range []struct {
+		name     string
+		attempts []attempt
+	}{
+		{name: "missing password", attempts: []attempt{{addr: "198.51.100.1", want: outgoing.ErrorPasswordRequired}}},
+		{name: "correct password", attempts: []attempt{
+			wrong("198.51.100.1", ""),
+			{addr: "198.51.100.1", password: "secret", want: "room"},
+		}},
+		{name: "lockout by ip", attempts: []attempt{
+			wrong("198.51.100.1", ""), wrong("198.51.100.1", ""), wrong("198.51.100.1", ""), wrong("198.51.100.1", ""), wrong("198.51.100.1", ""),
+			{addr: "198.51.100.1", password: "secret", want: outgoing.ErrorTooManyAttempts},
+			{addr: "198.51.100.2", password: "secret", want: "room"},
+		}},
+		{name: "lockout by user", attempts: []attempt{
+			wrong("198.51.100.1", "alice"), wrong("198.51.100.2", "alice"), wrong("198.51.100.3", "alice"), wrong("198.51.100.4", "alice"), wrong("198.51.100.5", "alice"),
+			{addr: "198.51.100.6", user: "alice", password: "secret", want: outgoing.ErrorTooManyAttempts},
+			{addr: "198.51.100.6", user: "bob", password: "secret", want: "room"},
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			rooms := startTestRooms(t)
+			createRoom(t, rooms, &Create{Password: "secret"})
+			for i, attempt := range test.attempts {
+				// Every attempt uses a new connection, the failures are counted per address and user.
+				client := connect(t, rooms, attempt.addr, attempt.user)
+				client.send(&Join{RoomID: "room", Password: attempt.password})
+				if result := client.result(); result != attempt.want {
+					t.Fatalf("attempt %d: expected %s, got %s", i, attempt.want, result)
+				}
+			}
+		})
+	}
+}
+
+func TestWaitingRoom(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		answer func(owner, member *testClient, id xid.ID)
+		want   string // "room" or the error code of the joining user
+	}{
+		{name: "admit", answer: func(owner, member *testClient, id xid.ID) { owner.send(&Admit{ID: id}) }, want: "room"},
+		{name: "deny", answer: func(owner, member *testClient, id xid.ID) { owner.send(&Deny{ID: id}) }, want: outgoing.ErrorJoinDenied},
+		{name: "timeout", answer: func(owner, member *testClient, id xid.ID) {}, want: outgoing.ErrorJoinTimeout},
+		{name: "admit by member", answer: func(owner, member *testClient, id xid.ID) {
+			member.send(&Admit{ID: id})
+			member.closed()
+			owner.send(&Deny{ID: id})
+		}, want: outgoing.ErrorJoinDenied},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			rooms := startTestRooms(t)
+			owner := createRoom(t, rooms, &Create{WaitingRoom: true})
+			request := func(client *testClient) {
+				t.Helper()
+				client.send(&Join{RoomID: "room"})
+				client.next(func(message outgoing.Message) bool { _, ok := message.(outgoing.JoinPending); return ok })
+				message := owner.next(func(message outgoing.Message) bool { _, ok := message.(outgoing.JoinRequest); return ok })
+				if id := message.(outgoing.JoinRequest).ID; id != client.info.ID {
+					t.Fatalf("unexpected join request %s", id)
+				}
+			}
+
+			member := connect(t, rooms, "192.0.2.2", "")
+			request(member)
+			owner.send(&Admit{ID: member.info.ID})
+			if result := member.result(); result != "room" {
+				t.Fatalf("member not admitted: %s", result)
+			}
+
+			joiner := connect(t, rooms, "198.51.100.1", "")
+			request(joiner)
+			test.answer(owner, member, joiner.info.ID)
+			if result := joiner.result(); result != test.want {
+				t.Fatalf("expected %s, got %s", test.want, result)
+			}
+			if test.want == outgoing.ErrorJoinTimeout {
+				owner.next(func(message outgoing.Message) bool { _, ok := message.(outgoing.JoinRequestClosed); return ok })
+			}
+		})
+	}
+}
+
+func TestInternalEventError(t *testing.T) {
+	rooms := startTestRooms(t)
+	// A failing event without a client must not block the loop on the nil close channel.
+	rooms.Incoming <- ClientMessage{Incoming: &Admit{ID: xid.New()}}
+	createRoom(t, rooms, &Create{})
+}
+
+func TestModeration(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		run  func(t *testing.T, rooms *Rooms, owner, alice, bob *testClient)
+	}{
+		{name: "kick", run: func(t *testing.T, rooms *Rooms, owner, alice, bob *testClient) {
+			owner.send(&Kick{ID: alice.info.ID})
+			if reason := alice.closed(); reason != CloseKicked {
+				t.Fatalf("unexpected close reason %s", reason)
+			}
+			again := connect(t, rooms, "198.51.100.1", "alice")
+			again.send(&Join{RoomID: "room"})
+			if result := again.result(); result != "room" {
+				t.Fatalf("kicked user cannot join again: %s", result)
+			}
+		}},
+		{name: "kick by member", run: func(t *testing.T, rooms *Rooms, owner, alice, bob *testClient) {
+			bob.send(&Kick{ID: alice.info.ID})
+			if reason := bob.closed(); reason == CloseKicked {
+				t.Fatal("member kicked a user")
+			}
+			select {
+			case reason := <-alice.info.Close:
+				t.Fatalf("user closed by member: %s", reason)
+			default:
+			}
+		}},
+		{name: "ban", run: func(t *testing.T, rooms *Rooms, owner, alice, bob *testClient) {
+			owner.send(&Ban{ID: alice.info.ID})
+			if reason := alice.closed(); reason != CloseBanned {
+				t.Fatalf("unexpected close reason %s", reason)
+			}
+			for _, client := range []*testClient{
+				connect(t, rooms, "198.51.100.9", "alice"),
+				connect(t, rooms, "198.51.100.1", ""),
+			} {
+				client.send(&Join{RoomID: "room"})
+				want := outgoing.ErrorBanned
+				if !client.info.Authenticated {
+					want = "room" // The address is only banned with IP
+				}
+				if result := client.result(); result != want {
+					t.Fatalf("%s: expected %s, got %s", client.info.AuthenticatedUser, want, result)
+				}
+			}
+		}},
+		{name: "ban ip", run: func(t *testing.T, rooms *Rooms, owner, alice, bob *testClient) {
+			owner.send(&Ban{ID: alice.info.ID, IP: true})
+			alice.closed()
+			guest := connect(t, rooms, "198.51.100.1", "")
+			guest.send(&Join{RoomID: "room"})
+			if result := guest.result(); result != outgoing.ErrorBanned {
+				t.Fatalf("banned address joined: %s", result)
+			}
+		}},
+		{name: "ban by member", run: func(t *testing.T, rooms *Rooms, owner, alice, bob *testClient) {
+			bob.send(&Ban{ID: alice.info.ID})
+			if reason := bob.closed(); reason == CloseBanned {
+				t.Fatal("member banned a user")
+			}
+		}},
+		{name: "stop share", run: func(t *testing.T, rooms *Rooms, owner, alice, bob *testClient) {
+			alice.send(&StartShare{})
+			alice.next(func(message outgoing.Message) bool { _, ok := message.(outgoing.HostSession); return ok })
+			owner.send(&StopUserShare{ID: alice.info.ID})
+			alice.next(func(message outgoing.Message) bool { _, ok := message.(outgoing.EndShare); return ok })
+			bob.next(func(message outgoing.Message) bool { _, ok := message.(outgoing.EndShare); return ok })
+		}},
+		{name: "stop share by member", run: func(t *testing.T, rooms *Rooms, owner, alice, bob *testClient) {
+			alice.send(&StartShare{})
+			bob.send(&StopUserShare{ID: alice.info.ID})
+			if reason := bob.closed(); reason == "" {
+				t.Fatal("member stopped a share")
+			}
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			rooms := startTestRooms(t)
+			owner := createRoom(t, rooms, &Create{})
+			alice := connect(t, rooms, "198.51.100.1", "alice")
+			bob := connect(t, rooms, "198.51.100.2", "bob")
+			for _, client := range []*testClient{alice, bob} {
+				client.send(&Join{RoomID: "room"})
+				if result := client.result(); result != "room" {
+					t.Fatalf("join failed: %s", result)
+				}
+			}
+			test.run(t, rooms, owner, alice, bob)
+		})
+	}
+}
+
+func TestExternalAddresses(t *testing.T) {
+	rooms := NewRooms(nil, nil, config.Config{
+		TurnMode: config.TurnModeExternal,
+		TurnExternalURLs: []string{
+			"turn:turn.example.com:3478",
+			"turn:turn.example.com:3478?transport=tcp",
+			"turns:turn.example.com:5349?transport=tcp",
+			"turn:[2001:db8::1]:3478?transport=udp",
+		},
+	})
+
+	stun := rooms.addresses("stun", nil, nil, false)
+	if expected := []string{"stun:turn.example.com:3478", "stun:[2001:db8::1]:3478"}; !reflect.DeepEqual(stun, expected) {
+		t.Errorf("expected stun urls %v, got %v", expected, stun)
+	}
+	if turn := rooms.addresses("turn", nil, nil, true); !reflect.DeepEqual(turn, rooms.config.TurnExternalURLs) {
+		t.Errorf("expected the configured turn urls, got %v", turn)
+	}
+}
+
+func TestTLSAddresses(t *testing.T) {
+	v4, v6 := net.ParseIP("203.0.113.5"), net.ParseIP("2001:db8::5")
+	for _, test := range []struct {
+		host     string
+		expected []string
+	}{
+		{host: "", expected: []string{"turns:203.0.113.5:5349?transport=tcp", "turns:[2001:db8::5]:5349?transport=tcp"}},
+		{host: "turn.example.com", expected: []string{"turns:turn.example.com:5349?transport=tcp"}},
+	} {
+		rooms := NewRooms(nil, nil, config.Config{TurnPort: "3478", TurnTLSPort: "5349", TurnTLSHost: test.host})
+		urls := rooms.addresses("turn", v4, v6, true)
+		if !reflect.DeepEqual(urls[len(urls)-len(test.expected):], test.expected) {
+			t.Errorf("host %q: expected turns urls %v, got %v", test.host, test.expected, urls)
+		}
+		for _, url := range rooms.addresses("stun", v4, v6, false) {
+			if strings.HasPrefix(url, "turns:") {
+				t.Errorf("host %q: turns url %s in stun urls", test.host, url)
+			}
+		}
+	}
+}